@@ -15,6 +15,7 @@ const (
 const (
 	SetDataFrame string = "@setDataFrame"
 	OnMetaData   string = "onMetaData"
+	OnTextData   string = "onTextData"
 )
 
 var setFrameFrame []byte
@@ -69,3 +70,22 @@ func MetaDataReform(p []byte, flag uint8) ([]byte, error) {
 	}
 	return p, nil
 }
+
+// ScriptDataName 获取script tag的名称 忽略@setDataFrame
+func ScriptDataName(p []byte) string {
+	r := bytes.NewReader(p)
+	decoder := &Decoder{}
+	v, err := decoder.Decode(r, AMF0)
+	if err != nil {
+		return ""
+	}
+	name, _ := v.(string)
+	if name == SetDataFrame {
+		v, err = decoder.Decode(r, AMF0)
+		if err != nil {
+			return ""
+		}
+		name, _ = v.(string)
+	}
+	return name
+}
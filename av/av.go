@@ -35,6 +35,12 @@ const (
 
 	AAC_SEQHDR = 0
 	AAC_RAW    = 1
+
+	// SOUND_EX_HEADER enhanced rtmp 低4位为AudioPacketType
+	SOUND_EX_HEADER = 9
+
+	AUDIO_PACKET_SEQUENCE_START = 0
+	AUDIO_PACKET_CODED_FRAMES   = 1
 )
 
 const (
@@ -46,6 +52,16 @@ const (
 	FRAME_INTER = 2
 
 	VIDEO_H264 = 7
+	// VIDEO_HEVC 国内扩展的hevc codecID
+	VIDEO_HEVC = 12
+
+	// VIDEO_EX_HEADER enhanced rtmp 首字节最高位 低4位为VideoPacketType
+	VIDEO_EX_HEADER = 0x80
+
+	VIDEO_PACKET_SEQUENCE_START = 0
+	VIDEO_PACKET_CODED_FRAMES   = 1
+	VIDEO_PACKET_SEQUENCE_END   = 2
+	VIDEO_PACKET_CODED_FRAMES_X = 3
 )
 
 var (
@@ -85,6 +101,17 @@ type AudioPacketHeader interface {
 	AACPacketType() uint8
 }
 
+// IsAudioSeqHeader aac的sequence header或enhanced rtmp的SequenceStart
+func IsAudioSeqHeader(h AudioPacketHeader) bool {
+	switch h.SoundFormat() {
+	case SOUND_AAC:
+		return h.AACPacketType() == AAC_SEQHDR
+	case SOUND_EX_HEADER:
+		return h.AACPacketType() == AUDIO_PACKET_SEQUENCE_START
+	}
+	return false
+}
+
 type VideoPacketHeader interface {
 	PacketHeader
 	IsKeyFrame() bool
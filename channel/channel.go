@@ -0,0 +1,260 @@
+package channel
+
+import (
+	"context"
+	"errors"
+	"github.com/LeeZXin/z-live/av"
+	"github.com/LeeZXin/z-live/flv"
+	"github.com/LeeZXin/zsf/logger"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// fileGap 切换文件时和上个文件最后一帧的时间间隔
+	fileGap = 40
+)
+
+var (
+	ErrUnsupportedFile = errors.New("unsupported file")
+)
+
+// fileReader 按顺序读取文件中的packet 结束返回io.EOF
+type fileReader interface {
+	ReadPacket() (*av.Packet, error)
+	Close() error
+}
+
+func openFile(path string) (fileReader, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".flv":
+		return flv.Open(path)
+	default:
+		return nil, ErrUnsupportedFile
+	}
+}
+
+// Status 频道状态
+type Status struct {
+	Key         string    `json:"key"`
+	CurrentFile string    `json:"currentFile"`
+	StartTime   time.Time `json:"startTime"`
+	// Timestamp 当前输出的时间戳 单位毫秒
+	Timestamp uint32 `json:"timestamp"`
+}
+
+/*
+Channel 虚拟直播频道
+按播放列表或者节目单顺序读取文件 按实际时间输出
+切换文件时重新计算时间戳 输出的时间戳是连续的 作为rtmp.PacketSource注册为推流
+*/
+type Channel struct {
+	config Config
+	reader fileReader
+
+	files     []string
+	fileIndex int
+	// failed 连续打开失败的文件数
+	failed int
+	// schedule 当前节目和下次切换的时间
+	scheduleIndex int
+	nextSwitch    time.Time
+
+	// offset 当前文件的输出起始时间戳
+	offset   uint32
+	firstTs  uint32
+	hasFirst bool
+	hasPkt   bool
+	lastTs   uint32
+	baseTime time.Time
+
+	mu          sync.RWMutex
+	currentFile string
+	startTime   time.Time
+
+	ctx       context.Context
+	cancelFn  context.CancelFunc
+	closeOnce sync.Once
+}
+
+func newChannel(config Config) *Channel {
+	ctx, cancelFn := context.WithCancel(context.Background())
+	ret := &Channel{
+		config:    config,
+		fileIndex: -1,
+		ctx:       ctx,
+		cancelFn:  cancelFn,
+		closeOnce: sync.Once{},
+		startTime: time.Now(),
+	}
+	if len(config.Schedule) > 0 {
+		ret.switchSchedule(time.Now())
+	} else {
+		ret.files = config.Files
+	}
+	return ret
+}
+
+// switchSchedule 切换到当前时间的节目
+func (c *Channel) switchSchedule(now time.Time) {
+	c.scheduleIndex, c.nextSwitch = c.config.current(now)
+	c.files = c.config.Schedule[c.scheduleIndex].Files
+	c.fileIndex = -1
+	c.failed = 0
+}
+
+// ReadPacket 按实际时间返回下一个packet 频道结束返回io.EOF
+func (c *Channel) ReadPacket(p *av.Packet) error {
+	for {
+		if c.ctx.Err() != nil {
+			c.closeReader()
+			return io.EOF
+		}
+		if c.reader == nil {
+			if err := c.openNext(); err != nil {
+				return err
+			}
+			continue
+		}
+		if len(c.config.Schedule) > 0 && !time.Now().Before(c.nextSwitch) {
+			c.closeReader()
+			c.switchSchedule(time.Now())
+			continue
+		}
+		pkt, err := c.reader.ReadPacket()
+		if err != nil {
+			if err != io.EOF {
+				logger.Logger.Errorf("channel %s read %s failed: %v", c.config.Key, c.CurrentFile(), err)
+			}
+			// 没有数据的文件算作失败 防止空转
+			if !c.hasFirst {
+				c.failed++
+			}
+			c.closeReader()
+			continue
+		}
+		// onMetaData是单个文件的信息 直播不需要
+		if pkt.IsMetadata {
+			continue
+		}
+		if !c.hasFirst {
+			c.firstTs = pkt.Timestamp
+			c.hasFirst = true
+		}
+		ts := c.offset
+		if pkt.Timestamp > c.firstTs {
+			ts += pkt.Timestamp - c.firstTs
+		}
+		pkt.Timestamp = ts
+		if !c.hasPkt {
+			c.hasPkt = true
+			c.baseTime = time.Now().Add(-time.Duration(ts) * time.Millisecond)
+		}
+		if ts > c.lastTs {
+			c.mu.Lock()
+			c.lastTs = ts
+			c.mu.Unlock()
+		}
+		c.failed = 0
+		if !c.sleepUntil(c.baseTime.Add(time.Duration(ts) * time.Millisecond)) {
+			continue
+		}
+		*p = *pkt
+		return nil
+	}
+}
+
+// openNext 打开下一个文件 播放列表结束且不循环时返回io.EOF
+func (c *Channel) openNext() error {
+	// 所有文件都打开失败
+	if c.failed >= len(c.files) {
+		if len(c.config.Schedule) > 0 {
+			// 等到下一个节目
+			if !c.sleepUntil(c.nextSwitch) {
+				return io.EOF
+			}
+			c.switchSchedule(time.Now())
+			return nil
+		}
+		logger.Logger.Errorf("channel %s has no playable file", c.config.Key)
+		return io.EOF
+	}
+	c.fileIndex++
+	if c.fileIndex >= len(c.files) {
+		if len(c.config.Schedule) == 0 && !c.config.Loop {
+			return io.EOF
+		}
+		c.fileIndex = 0
+	}
+	path := c.files[c.fileIndex]
+	reader, err := openFile(path)
+	if err != nil {
+		logger.Logger.Errorf("channel %s open %s failed: %v", c.config.Key, path, err)
+		c.failed++
+		return nil
+	}
+	c.reader = reader
+	c.hasFirst = false
+	// 接着上个文件的时间戳
+	if c.hasPkt {
+		c.offset = c.lastTs + fileGap
+	}
+	c.mu.Lock()
+	c.currentFile = path
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *Channel) closeReader() {
+	if c.reader != nil {
+		c.reader.Close()
+		c.reader = nil
+	}
+}
+
+// sleepUntil 频道关闭返回false
+func (c *Channel) sleepUntil(t time.Time) bool {
+	wait := time.Until(t)
+	if wait <= 0 {
+		return c.ctx.Err() == nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-c.ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func (c *Channel) Key() string {
+	return c.config.Key
+}
+
+func (c *Channel) CurrentFile() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.currentFile
+}
+
+func (c *Channel) Status() Status {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return Status{
+		Key:         c.config.Key,
+		CurrentFile: c.currentFile,
+		StartTime:   c.startTime,
+		Timestamp:   c.lastTs,
+	}
+}
+
+func (c *Channel) Close() error {
+	c.closeOnce.Do(func() {
+		c.cancelFn()
+	})
+	return nil
+}
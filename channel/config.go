@@ -0,0 +1,152 @@
+package channel
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/LeeZXin/z-live/vod"
+	"github.com/LeeZXin/zsf/property/static"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidConfig = errors.New("invalid channel config")
+)
+
+// Dir 频道文件目录 配置channel.dir 默认和点播目录相同
+func Dir() string {
+	ret := static.GetString("channel.dir")
+	if ret == "" {
+		ret = vod.Dir()
+	}
+	return ret
+}
+
+// filePath 文件路径转为频道目录下的路径 绝对路径或者跳出目录返回false
+func filePath(name string) (string, bool) {
+	if name == "" || filepath.IsAbs(name) {
+		return "", false
+	}
+	name = filepath.Clean(name)
+	if name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	dir := filepath.Clean(Dir())
+	ret := filepath.Join(dir, name)
+	if !strings.HasPrefix(ret, dir+string(filepath.Separator)) {
+		return "", false
+	}
+	return ret, true
+}
+
+// resolveFiles 文件都转为频道目录下的路径
+func resolveFiles(files []string) ([]string, error) {
+	ret := make([]string, 0, len(files))
+	for _, file := range files {
+		path, ok := filePath(file)
+		if !ok {
+			return nil, fmt.Errorf("%w: file=%s", ErrInvalidConfig, file)
+		}
+		ret = append(ret, path)
+	}
+	return ret, nil
+}
+
+// Config 虚拟直播频道
+type Config struct {
+	// Key 推流key 例如live/channel1
+	Key string `json:"key"`
+	// Files 按顺序播放的文件 没有Schedule时使用
+	Files []string `json:"files"`
+	// Loop 播放完后从头循环 否则频道结束
+	Loop bool `json:"loop"`
+	// Schedule 每天的节目单 到时间切换到对应的文件列表 节目内循环播放
+	Schedule []ScheduleItem `json:"schedule,omitempty"`
+}
+
+// ScheduleItem 节目单 Start为每天的开始时间 15:04:05
+type ScheduleItem struct {
+	Start string   `json:"start"`
+	Files []string `json:"files"`
+
+	offset time.Duration
+}
+
+func (c *Config) check() error {
+	app, name, ok := strings.Cut(c.Key, "/")
+	if !ok || app == "" || name == "" {
+		return fmt.Errorf("%w: key=%s", ErrInvalidConfig, c.Key)
+	}
+	if len(c.Schedule) == 0 {
+		if len(c.Files) == 0 {
+			return fmt.Errorf("%w: empty files", ErrInvalidConfig)
+		}
+		files, err := resolveFiles(c.Files)
+		if err != nil {
+			return err
+		}
+		c.Files = files
+		return nil
+	}
+	// 不修改调用方的节目单
+	c.Schedule = append([]ScheduleItem(nil), c.Schedule...)
+	for i := range c.Schedule {
+		item := &c.Schedule[i]
+		t, err := time.Parse(time.TimeOnly, item.Start)
+		if err != nil {
+			return fmt.Errorf("%w: start=%s", ErrInvalidConfig, item.Start)
+		}
+		if len(item.Files) == 0 {
+			return fmt.Errorf("%w: empty files at %s", ErrInvalidConfig, item.Start)
+		}
+		if item.Files, err = resolveFiles(item.Files); err != nil {
+			return err
+		}
+		item.offset = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	}
+	sort.Slice(c.Schedule, func(i, j int) bool {
+		return c.Schedule[i].offset < c.Schedule[j].offset
+	})
+	return nil
+}
+
+// current 当前时间的节目和下次切换的时间
+func (c *Config) current(now time.Time) (int, time.Time) {
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	offset := now.Sub(day)
+	index := -1
+	for i, item := range c.Schedule {
+		if item.offset <= offset {
+			index = i
+		}
+	}
+	// 还没到第一个节目时 播放前一天的最后一个节目
+	if index < 0 {
+		return len(c.Schedule) - 1, day.Add(c.Schedule[0].offset)
+	}
+	if index+1 < len(c.Schedule) {
+		return index, day.Add(c.Schedule[index+1].offset)
+	}
+	return index, day.AddDate(0, 0, 1).Add(c.Schedule[0].offset)
+}
+
+// LoadConfigs 启动时加载channel.file配置的频道 json数组
+func LoadConfigs() ([]Config, error) {
+	path := static.GetString("channel.file")
+	if path == "" {
+		return nil, nil
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var ret []Config
+	if err = json.Unmarshal(content, &ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
@@ -0,0 +1,100 @@
+package channel
+
+import (
+	"errors"
+	"github.com/LeeZXin/z-live/rtmp"
+	"github.com/LeeZXin/zsf/logger"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrChannelExists   = errors.New("channel exists")
+	ErrChannelNotFound = errors.New("channel not found")
+)
+
+/*
+运行中的频道
+*/
+var (
+	cmu        = sync.RWMutex{}
+	channelMap = make(map[string]*Channel, 8)
+)
+
+// Start 开始频道 同步注册为推流 key已经有推流时返回rtmp.ErrPublisherExists
+func Start(config Config) (*Channel, error) {
+	if err := config.check(); err != nil {
+		return nil, err
+	}
+	app, name, _ := strings.Cut(config.Key, "/")
+	cmu.Lock()
+	defer cmu.Unlock()
+	if _, ok := channelMap[config.Key]; ok {
+		return nil, ErrChannelExists
+	}
+	ret := newChannel(config)
+	done, err := rtmp.StartPublish(app, name, ret)
+	if err != nil {
+		ret.Close()
+		return nil, err
+	}
+	channelMap[config.Key] = ret
+	go func() {
+		<-done
+		deregisterChannel(ret)
+		ret.Close()
+	}()
+	return ret, nil
+}
+
+// StartFromConfig 启动配置文件中的频道
+func StartFromConfig() {
+	configs, err := LoadConfigs()
+	if err != nil {
+		logger.Logger.Error(err)
+		return
+	}
+	for _, config := range configs {
+		if _, err = Start(config); err != nil {
+			logger.Logger.Errorf("start channel %s failed: %v", config.Key, err)
+		}
+	}
+}
+
+// Stop 停止频道 推流结束
+func Stop(key string) error {
+	cmu.Lock()
+	ch, ok := channelMap[key]
+	delete(channelMap, key)
+	cmu.Unlock()
+	if !ok {
+		return ErrChannelNotFound
+	}
+	return ch.Close()
+}
+
+func Find(key string) (*Channel, bool) {
+	cmu.RLock()
+	defer cmu.RUnlock()
+	ret, ok := channelMap[key]
+	return ret, ok
+}
+
+func List() []Status {
+	cmu.RLock()
+	defer cmu.RUnlock()
+	ret := make([]Status, 0, len(channelMap))
+	for _, ch := range channelMap {
+		ret = append(ret, ch.Status())
+	}
+	return ret
+}
+
+// deregisterChannel 频道结束 只移除自己
+func deregisterChannel(ch *Channel) {
+	cmu.Lock()
+	defer cmu.Unlock()
+	if channelMap[ch.Key()] == ch {
+		delete(channelMap, ch.Key())
+	}
+}
@@ -0,0 +1,77 @@
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+)
+
+var (
+	errNoInput = errors.New("input file is required")
+)
+
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+/*
+命令行工具 不启动服务 例如
+z-live probe -i demo.flv
+z-live hls -i demo.flv -o ./demo -t 6
+z-live mp4 -i demo.flv -o demo.mp4
+*/
+var commands = map[string]command{
+	"probe": {
+		usage: "打印flv文件的tag、时间戳、关键帧间隔和编码参数",
+		run:   runProbe,
+	},
+	"hls": {
+		usage: "flv转为hls点播 生成m3u8和ts分片",
+		run:   runHls,
+	},
+	"mp4": {
+		usage: "flv转为mp4(fragmented)",
+		run:   runMp4,
+	},
+}
+
+// IsCommand 是否是命令行工具的子命令
+func IsCommand(name string) bool {
+	if name == "help" {
+		return true
+	}
+	_, ok := commands[name]
+	return ok
+}
+
+// Run 执行子命令 返回进程退出码
+func Run(args []string) int {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		printUsage()
+		return 0
+	}
+	if err := cmd.run(args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		fmt.Fprintf(os.Stderr, "%s: %v\n", args[0], err)
+		return 1
+	}
+	return 0
+}
+
+func printUsage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Println("usage: z-live <command> [arguments]")
+	for _, name := range names {
+		fmt.Printf("  %-6s %s\n", name, commands[name].usage)
+	}
+}
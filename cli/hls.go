@@ -0,0 +1,204 @@
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"github.com/LeeZXin/z-live/av"
+	"github.com/LeeZXin/z-live/flv"
+	"github.com/LeeZXin/z-live/hls/ts"
+	"github.com/LeeZXin/z-live/parser"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+// runHls flv转hls点播 在关键帧处切割分片 只支持h264和aac
+func runHls(args []string) error {
+	fs := flag.NewFlagSet("hls", flag.ContinueOnError)
+	input := fs.String("i", "", "input flv file")
+	output := fs.String("o", ".", "output dir")
+	target := fs.Int("t", 6, "target segment duration in seconds")
+	name := fs.String("name", "index", "m3u8 name")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *input == "" {
+		return errNoInput
+	}
+	if *target <= 0 {
+		*target = 6
+	}
+	if err := os.MkdirAll(*output, 0755); err != nil {
+		return err
+	}
+	reader, err := flv.Open(*input)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	s := newHlsSegmenter(*output, uint32(*target*1000))
+	// 出错时关闭未完成的分片
+	defer s.closeSegment(0)
+	for {
+		p, err := reader.ReadPacket()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err = s.writePacket(p); err != nil {
+			return err
+		}
+	}
+	if err = s.closeSegment(s.lastTs); err != nil {
+		return err
+	}
+	m3u8Path := filepath.Join(*output, *name+".m3u8")
+	if err = os.WriteFile(m3u8Path, s.playlist(), 0644); err != nil {
+		return err
+	}
+	fmt.Printf("%s: %d segments\n", m3u8Path, len(s.segments))
+	return nil
+}
+
+type hlsSegment struct {
+	name     string
+	duration float64
+}
+
+// hlsSegmenter 和hls直播一样 h264转annexb aac转adts后写入ts
+type hlsSegmenter struct {
+	dir      string
+	target   uint32
+	parser   *parser.CodecParser
+	buf      *bytes.Buffer
+	hasVideo bool
+	hasAudio bool
+
+	file     *os.File
+	writer   *bufio.Writer
+	muxer    *ts.Muxer
+	startTs  uint32
+	lastTs   uint32
+	segments []hlsSegment
+}
+
+func newHlsSegmenter(dir string, target uint32) *hlsSegmenter {
+	buf := bytes.NewBuffer(nil)
+	return &hlsSegmenter{
+		dir:    dir,
+		target: target,
+		parser: parser.NewCodecParser(buf),
+		buf:    buf,
+	}
+}
+
+func (s *hlsSegmenter) writePacket(p *av.Packet) error {
+	if p.IsMetadata {
+		return nil
+	}
+	p = p.Copy()
+	err := flv.Demux(p)
+	if err == flv.ErrAvcEndSEQ {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	isKey := false
+	if p.IsVideo {
+		vh := p.Header.(av.VideoPacketHeader)
+		if vh.CodecID() != av.VIDEO_H264 {
+			return nil
+		}
+		if vh.IsSeq() {
+			s.hasVideo = true
+			return s.parser.Parse(p)
+		}
+		isKey = vh.IsKeyFrame()
+	} else {
+		ah := p.Header.(av.AudioPacketHeader)
+		if ah.SoundFormat() != av.SOUND_AAC {
+			return nil
+		}
+		if ah.AACPacketType() == av.AAC_SEQHDR {
+			s.hasAudio = true
+			return s.parser.Parse(p)
+		}
+		isKey = !s.hasVideo
+	}
+	if s.muxer == nil && !isKey {
+		// 第一个分片从关键帧开始
+		return nil
+	}
+	if isKey && (s.muxer == nil || p.Timestamp >= s.startTs+s.target) {
+		if err = s.closeSegment(p.Timestamp); err != nil {
+			return err
+		}
+		if err = s.openSegment(p.Timestamp); err != nil {
+			return err
+		}
+	}
+	s.buf.Reset()
+	if err = s.parser.Parse(p); err != nil {
+		return err
+	}
+	p.Data = s.buf.Bytes()
+	if p.Timestamp > s.lastTs {
+		s.lastTs = p.Timestamp
+	}
+	return s.muxer.WritePacket(p)
+}
+
+func (s *hlsSegmenter) openSegment(startTs uint32) error {
+	name := fmt.Sprintf("seg_%d.ts", len(s.segments))
+	file, err := os.OpenFile(filepath.Join(s.dir, name), os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	s.file = file
+	s.writer = bufio.NewWriter(file)
+	s.muxer = ts.NewMuxer(s.writer)
+	s.startTs = startTs
+	s.segments = append(s.segments, hlsSegment{name: name})
+	if err = s.muxer.WritePAT(); err != nil {
+		return err
+	}
+	// 只声明存在的流 纯视频的文件不声明音频
+	return s.muxer.WritePMTStreams(av.SOUND_AAC, s.hasAudio, s.hasVideo)
+}
+
+// closeSegment endTs为下一个分片的开始时间
+func (s *hlsSegmenter) closeSegment(endTs uint32) error {
+	if s.file == nil {
+		return nil
+	}
+	file := s.file
+	s.file = nil
+	if endTs > s.startTs {
+		s.segments[len(s.segments)-1].duration = float64(endTs-s.startTs) / 1000
+	}
+	err := s.writer.Flush()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (s *hlsSegmenter) playlist() []byte {
+	maxDuration := 0.0
+	for _, seg := range s.segments {
+		maxDuration = math.Max(maxDuration, seg.duration)
+	}
+	ret := bytes.NewBuffer(nil)
+	fmt.Fprintf(ret, "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-PLAYLIST-TYPE:VOD\n", int(math.Ceil(maxDuration)))
+	for _, seg := range s.segments {
+		fmt.Fprintf(ret, "#EXTINF:%.3f,\n%s\n", seg.duration, seg.name)
+	}
+	ret.WriteString("#EXT-X-ENDLIST\n")
+	return ret.Bytes()
+}
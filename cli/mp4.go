@@ -0,0 +1,50 @@
+package cli
+
+import (
+	"flag"
+	"github.com/LeeZXin/z-live/flv"
+	"github.com/LeeZXin/z-live/fmp4"
+	"io"
+	"os"
+	"strings"
+)
+
+// runMp4 flv转fragmented mp4 只支持h264和aac
+func runMp4(args []string) error {
+	fs := flag.NewFlagSet("mp4", flag.ContinueOnError)
+	input := fs.String("i", "", "input flv file")
+	output := fs.String("o", "", "output mp4 file, default input name with .mp4")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *input == "" {
+		return errNoInput
+	}
+	if *output == "" {
+		*output = strings.TrimSuffix(*input, ".flv") + ".mp4"
+	}
+	reader, err := flv.Open(*input)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	file, err := os.OpenFile(*output, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	muxer := fmp4.NewMuxer(file)
+	for {
+		p, err := reader.ReadPacket()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err = muxer.WritePacket(p); err != nil {
+			return err
+		}
+	}
+	return muxer.Close()
+}
@@ -0,0 +1,239 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"github.com/LeeZXin/z-live/amf"
+	"github.com/LeeZXin/z-live/av"
+	"github.com/LeeZXin/z-live/flv"
+	"github.com/LeeZXin/z-live/parser/aac"
+	"github.com/LeeZXin/z-live/parser/h264"
+	"io"
+	"sort"
+)
+
+var (
+	videoCodecNames = map[uint8]string{
+		av.VIDEO_H264: "h264",
+	}
+	soundFormatNames = map[uint8]string{
+		av.SOUND_MP3: "mp3",
+		av.SOUND_AAC: "aac",
+	}
+)
+
+// probeStat 统计信息
+type probeStat struct {
+	tags        int
+	videoTags   int
+	audioTags   int
+	scriptTags  int
+	videoSize   int64
+	audioSize   int64
+	firstTs     uint32
+	lastTs      uint32
+	hasTs       bool
+	lastVideoTs uint32
+	lastAudioTs uint32
+	// backwards 时间戳回退的次数
+	backwards int
+	keyTimes  []uint32
+}
+
+// runProbe 打印flv文件信息 -tags打印每个tag
+func runProbe(args []string) error {
+	fs := flag.NewFlagSet("probe", flag.ContinueOnError)
+	input := fs.String("i", "", "input flv file")
+	showTags := fs.Bool("tags", false, "print every tag")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *input == "" {
+		return errNoInput
+	}
+	reader, err := flv.Open(*input)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	fmt.Printf("file: %s\n", *input)
+	fmt.Printf("header: hasVideo=%v hasAudio=%v\n", reader.HasVideo(), reader.HasAudio())
+	if metadata := reader.Metadata(); metadata != nil {
+		fmt.Println("onMetaData:")
+		printObject(metadata, "  ")
+	}
+	var stat probeStat
+	for {
+		p, err := reader.ReadPacket()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		stat.add(p)
+		if *showTags {
+			printTag(p)
+		}
+		if p.IsVideo {
+			if vh, ok := p.Header.(av.VideoPacketHeader); ok && isVideoSeq(vh) {
+				printVideoConfig(p)
+			}
+		} else if p.IsAudio {
+			if ah, ok := p.Header.(av.AudioPacketHeader); ok && ah.SoundFormat() == av.SOUND_AAC && ah.AACPacketType() == av.AAC_SEQHDR {
+				printAudioConfig(p)
+			}
+		}
+	}
+	stat.print()
+	return nil
+}
+
+func (s *probeStat) add(p *av.Packet) {
+	s.tags++
+	if !s.hasTs {
+		s.firstTs = p.Timestamp
+		s.hasTs = true
+	}
+	if p.Timestamp > s.lastTs {
+		s.lastTs = p.Timestamp
+	}
+	switch {
+	case p.IsMetadata:
+		s.scriptTags++
+	case p.IsVideo:
+		s.videoTags++
+		s.videoSize += int64(len(p.Data))
+		if p.Timestamp < s.lastVideoTs {
+			s.backwards++
+		}
+		s.lastVideoTs = p.Timestamp
+		if vh, ok := p.Header.(av.VideoPacketHeader); ok && vh.IsKeyFrame() && !isVideoSeq(vh) {
+			s.keyTimes = append(s.keyTimes, p.Timestamp)
+		}
+	default:
+		s.audioTags++
+		s.audioSize += int64(len(p.Data))
+		if p.Timestamp < s.lastAudioTs {
+			s.backwards++
+		}
+		s.lastAudioTs = p.Timestamp
+	}
+}
+
+func (s *probeStat) print() {
+	duration := float64(s.lastTs-s.firstTs) / 1000
+	fmt.Println("summary:")
+	fmt.Printf("  tags: %d video=%d audio=%d script=%d\n", s.tags, s.videoTags, s.audioTags, s.scriptTags)
+	fmt.Printf("  timestamp: first=%dms last=%dms duration=%.3fs backwards=%d\n", s.firstTs, s.lastTs, duration, s.backwards)
+	if duration > 0 {
+		fmt.Printf("  bitrate: video=%.1fkbps audio=%.1fkbps\n", float64(s.videoSize)*8/1000/duration, float64(s.audioSize)*8/1000/duration)
+		if s.videoTags > 0 {
+			fmt.Printf("  framerate: %.2f\n", float64(s.videoTags)/duration)
+		}
+	}
+	fmt.Printf("  keyframes: %d\n", len(s.keyTimes))
+	if len(s.keyTimes) > 1 {
+		var minGap, maxGap, total uint32
+		for i := 1; i < len(s.keyTimes); i++ {
+			gap := s.keyTimes[i] - s.keyTimes[i-1]
+			if i == 1 || gap < minGap {
+				minGap = gap
+			}
+			if gap > maxGap {
+				maxGap = gap
+			}
+			total += gap
+		}
+		fmt.Printf("  keyframe interval: min=%dms avg=%dms max=%dms\n", minGap, total/uint32(len(s.keyTimes)-1), maxGap)
+	}
+}
+
+func printTag(p *av.Packet) {
+	switch {
+	case p.IsMetadata:
+		fmt.Printf("script ts=%d size=%d name=%s\n", p.Timestamp, len(p.Data), amf.ScriptDataName(p.Data))
+	case p.IsVideo:
+		vh, ok := p.Header.(av.VideoPacketHeader)
+		if !ok {
+			return
+		}
+		fmt.Printf("video  ts=%d size=%d codec=%s key=%v seq=%v cts=%d\n", p.Timestamp, len(p.Data),
+			codecName(videoCodecNames, vh.CodecID()), vh.IsKeyFrame(), isVideoSeq(vh), vh.CompositionTime())
+	default:
+		ah, ok := p.Header.(av.AudioPacketHeader)
+		if !ok {
+			return
+		}
+		fmt.Printf("audio  ts=%d size=%d codec=%s seq=%v\n", p.Timestamp, len(p.Data),
+			codecName(soundFormatNames, ah.SoundFormat()), ah.SoundFormat() == av.SOUND_AAC && ah.AACPacketType() == av.AAC_SEQHDR)
+	}
+}
+
+// printVideoConfig 打印avc sequence header和sps
+func printVideoConfig(p *av.Packet) {
+	if len(p.Data) <= 5 {
+		return
+	}
+	record, err := h264.ParseAVCDecoderConfigurationRecord(p.Data[5:])
+	if err != nil {
+		fmt.Printf("video config: invalid avc sequence header: %v\n", err)
+		return
+	}
+	fmt.Printf("video config: codec=h264 profile=%d level=%d naluLen=%d sps=%d pps=%d\n",
+		record.Profile, record.Level, record.NaluLen, len(record.SPS), len(record.PPS))
+	sps, err := record.SPSInfo()
+	if err != nil {
+		fmt.Printf("  invalid sps: %v\n", err)
+		return
+	}
+	fmt.Printf("  sps: %dx%d profile=%d level=%d chromaFormat=%d bitDepth=%d refFrames=%d frameMbsOnly=%v\n",
+		sps.Width, sps.Height, sps.Profile, sps.Level, sps.ChromaFormatIDC, sps.BitDepthLumaMinus8+8, sps.NumRefFrames, sps.FrameMbsOnlyFlag)
+	if sps.VUI != nil {
+		fmt.Printf("  vui: sar=%d:%d fullRange=%v\n", sps.VUI.SampleAspectRatioWidth, sps.VUI.SampleAspectRatioHeight, sps.VUI.VideoFullRangeFlag)
+	}
+}
+
+// printAudioConfig 打印AudioSpecificConfig
+func printAudioConfig(p *av.Packet) {
+	if len(p.Data) <= 2 {
+		return
+	}
+	cfg, err := aac.ParseAudioSpecificConfig(p.Data[2:])
+	if err != nil {
+		fmt.Printf("audio config: invalid aac sequence header: %v\n", err)
+		return
+	}
+	fmt.Printf("audio config: codec=aac objectType=%d sampleRate=%d channels=%d\n", cfg.ObjectType, cfg.SampleRate, cfg.Channels)
+}
+
+func printObject(obj amf.Object, indent string) {
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		switch v := obj[k].(type) {
+		case amf.Object:
+			fmt.Printf("%s%s:\n", indent, k)
+			printObject(v, indent+"  ")
+		case amf.Array:
+			fmt.Printf("%s%s: [%d items]\n", indent, k, len(v))
+		default:
+			fmt.Printf("%s%s: %v\n", indent, k, v)
+		}
+	}
+}
+
+// isVideoSeq 只有h264有sequence header
+func isVideoSeq(vh av.VideoPacketHeader) bool {
+	return vh.CodecID() == av.VIDEO_H264 && vh.IsSeq()
+}
+
+func codecName(names map[uint8]string, id uint8) string {
+	if name, ok := names[id]; ok {
+		return name
+	}
+	return fmt.Sprintf("%d", id)
+}
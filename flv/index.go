@@ -0,0 +1,222 @@
+package flv
+
+import (
+	"bytes"
+	"github.com/LeeZXin/z-live/amf"
+	"github.com/LeeZXin/z-live/av"
+	"github.com/LeeZXin/z-live/parser/aac"
+	"github.com/LeeZXin/z-live/parser/h264"
+	"io"
+	"os"
+)
+
+const (
+	// fileHeaderLen flv头加第一个PreviousTagSize
+	fileHeaderLen = 13
+)
+
+/*
+fileIndex 记录写入文件的tag信息
+文件关闭后重写开头的onMetaData 加上时长、文件大小、编码信息和关键帧索引 使播放器可以拖动
+*/
+type fileIndex struct {
+	// metaSize 文件开头onMetaData tag的长度 包含PreviousTagSize
+	metaSize        int64
+	metaData        amf.Object
+	hasVideo        bool
+	hasAudio        bool
+	videoCodecId    int
+	audioCodecId    int
+	width           int
+	height          int
+	audioSampleRate int
+	audioSampleSize int
+	stereo          bool
+	lastTimestamp   uint32
+	videoFrames     int
+	videoSize       int64
+	audioSize       int64
+	keyTimes        []float64
+	keyPositions    []int64
+}
+
+func newFileIndex() *fileIndex {
+	return &fileIndex{}
+}
+
+// update pos为tag在文件中的位置
+func (i *fileIndex) update(p *av.Packet, data []byte, pos int64) {
+	if p.IsMetadata {
+		if pos != fileHeaderLen || amf.ScriptDataName(data) != amf.OnMetaData {
+			return
+		}
+		i.metaSize = int64(headerLen + len(data) + 4)
+		vs, _ := amf.NewDecoder().DecodeBatch(bytes.NewReader(data), amf.AMF0)
+		if len(vs) > 1 {
+			i.metaData, _ = vs[1].(amf.Object)
+		}
+		return
+	}
+	if len(data) == 0 {
+		return
+	}
+	if p.IsVideo {
+		i.hasVideo = true
+		i.videoCodecId = int(data[0] & 0x0f)
+		vh, ok := p.Header.(av.VideoPacketHeader)
+		if !ok {
+			return
+		}
+		if vh.IsSeq() {
+			if vh.CodecID() == av.VIDEO_H264 && len(data) > 5 {
+				record, err := h264.ParseAVCDecoderConfigurationRecord(data[5:])
+				if err == nil {
+					if sps, err := record.SPSInfo(); err == nil {
+						i.width, i.height = int(sps.Width), int(sps.Height)
+					}
+				}
+			}
+			return
+		}
+		i.videoFrames++
+		i.videoSize += int64(len(data))
+		if vh.IsKeyFrame() {
+			i.keyTimes = append(i.keyTimes, float64(p.Timestamp)/1000)
+			i.keyPositions = append(i.keyPositions, pos)
+		}
+	} else {
+		i.hasAudio = true
+		i.audioCodecId = int(data[0] >> 4)
+		i.audioSampleSize = 8 << (data[0] >> 1 & 0x01)
+		i.stereo = data[0]&0x01 == 1
+		if i.audioSampleRate == 0 {
+			i.audioSampleRate = []int{5500, 11025, 22050, 44100}[data[0]>>2&0x03]
+		}
+		if i.audioCodecId == av.SOUND_AAC && len(data) > 2 && data[1] == av.AAC_SEQHDR {
+			if cfg, err := aac.ParseAudioSpecificConfig(data[2:]); err == nil {
+				i.audioSampleRate = cfg.SampleRate
+				i.stereo = cfg.Channels > 1
+			}
+			return
+		}
+		i.audioSize += int64(len(data))
+	}
+	if p.Timestamp > i.lastTimestamp {
+		i.lastTimestamp = p.Timestamp
+	}
+}
+
+// build 生成onMetaData delta为重写后tag位置的偏移
+func (i *fileIndex) build(fileSize, delta int64) ([]byte, error) {
+	obj := make(amf.Object, len(i.metaData)+24)
+	for k, v := range i.metaData {
+		obj[k] = v
+	}
+	duration := float64(i.lastTimestamp) / 1000
+	obj["duration"] = duration
+	obj["filesize"] = float64(fileSize + delta)
+	obj["hasVideo"] = i.hasVideo
+	obj["hasAudio"] = i.hasAudio
+	obj["hasMetadata"] = true
+	obj["canSeekToEnd"] = len(i.keyTimes) > 0
+	obj["hasKeyframes"] = len(i.keyTimes) > 0
+	if i.hasVideo {
+		obj["videocodecid"] = float64(i.videoCodecId)
+		obj["videosize"] = float64(i.videoSize)
+		if i.width > 0 {
+			obj["width"] = float64(i.width)
+			obj["height"] = float64(i.height)
+		}
+		if duration > 0 {
+			obj["framerate"] = float64(i.videoFrames) / duration
+			obj["videodatarate"] = float64(i.videoSize) * 8 / 1024 / duration
+		}
+	}
+	if i.hasAudio {
+		obj["audiocodecid"] = float64(i.audioCodecId)
+		obj["audiosamplerate"] = float64(i.audioSampleRate)
+		obj["audiosamplesize"] = float64(i.audioSampleSize)
+		obj["stereo"] = i.stereo
+		obj["audiosize"] = float64(i.audioSize)
+		if duration > 0 {
+			obj["audiodatarate"] = float64(i.audioSize) * 8 / 1024 / duration
+		}
+	}
+	times := make(amf.Array, 0, len(i.keyTimes))
+	positions := make(amf.Array, 0, len(i.keyPositions))
+	for n := range i.keyTimes {
+		times = append(times, i.keyTimes[n])
+		positions = append(positions, float64(i.keyPositions[n]+delta))
+	}
+	if len(times) > 0 {
+		obj["lastkeyframetimestamp"] = times[len(times)-1]
+		obj["lastkeyframelocation"] = positions[len(positions)-1]
+	}
+	obj["keyframes"] = amf.Object{
+		"times":         times,
+		"filepositions": positions,
+	}
+	b := bytes.NewBuffer(nil)
+	encoder := amf.NewEncoder()
+	if _, err := encoder.EncodeAmf0String(b, amf.OnMetaData, true); err != nil {
+		return nil, err
+	}
+	if _, err := encoder.EncodeAmf0EcmaArray(b, obj, true); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Finalize 文件写完并关闭后 重写开头的onMetaData 返回新的文件大小 只用于NewFileMuxer
+func (m *Muxer) Finalize(path string) (int64, error) {
+	if m.index == nil {
+		return m.size, ErrNoIndex
+	}
+	if m.size < fileHeaderLen {
+		return m.size, nil
+	}
+	// 数字都是定长的 先算出新tag的长度 再计算关键帧位置的偏移
+	data, err := m.index.build(m.size, 0)
+	if err != nil {
+		return m.size, err
+	}
+	delta := int64(headerLen+len(data)+4) - m.index.metaSize
+	if data, err = m.index.build(m.size, delta); err != nil {
+		return m.size, err
+	}
+	src, err := os.Open(path)
+	if err != nil {
+		return m.size, err
+	}
+	defer src.Close()
+	tmpPath := path + ".tmp"
+	dst, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		return m.size, err
+	}
+	err = func() error {
+		defer dst.Close()
+		nm := NewMuxer(dst)
+		if err := nm.WriteHeader(); err != nil {
+			return err
+		}
+		if err := nm.writeTag(av.TAG_SCRIPTDATAAMF0, 0, data); err != nil {
+			return err
+		}
+		if _, err := src.Seek(fileHeaderLen+m.index.metaSize, io.SeekStart); err != nil {
+			return err
+		}
+		_, err := io.Copy(dst, src)
+		return err
+	}()
+	if err != nil {
+		os.Remove(tmpPath)
+		return m.size, err
+	}
+	src.Close()
+	if err = os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return m.size, err
+	}
+	return m.size + delta, nil
+}
@@ -0,0 +1,112 @@
+package flv
+
+import (
+	"fmt"
+	"github.com/LeeZXin/z-live/amf"
+	"github.com/LeeZXin/z-live/av"
+	"github.com/LeeZXin/z-live/util/bytesutil"
+	"io"
+)
+
+var (
+	ErrNoIndex = fmt.Errorf("muxer has no file index")
+)
+
+// Muxer 同步写flv tag
+type Muxer struct {
+	w    io.Writer
+	buf  []byte
+	size int64
+	// index 只有文件muxer记录
+	index *fileIndex
+}
+
+func NewMuxer(w io.Writer) *Muxer {
+	return &Muxer{
+		w:   w,
+		buf: make([]byte, headerLen),
+	}
+}
+
+// NewFileMuxer 写文件 记录tag信息 文件关闭后调用Finalize生成关键帧索引
+func NewFileMuxer(w io.Writer) *Muxer {
+	ret := NewMuxer(w)
+	ret.index = newFileIndex()
+	return ret
+}
+
+// WriteHeader 写flv头和第一个PreviousTagSize
+func (m *Muxer) WriteHeader() error {
+	return m.WriteHeaderFlags(true, true)
+}
+
+// WriteHeaderFlags 指定flv头的音视频标志
+func (m *Muxer) WriteHeaderFlags(hasAudio, hasVideo bool) error {
+	header := append([]byte(nil), flvHeader...)
+	header[4] = 0
+	if hasAudio {
+		header[4] |= 0x04
+	}
+	if hasVideo {
+		header[4] |= 0x01
+	}
+	if err := m.write(header); err != nil {
+		return err
+	}
+	bytesutil.PutI32BE(m.buf[:4], 0)
+	return m.write(m.buf[:4])
+}
+
+// WritePacket 写一个tag p.Data包含音视频tag头
+func (m *Muxer) WritePacket(p *av.Packet) error {
+	data := p.Data
+	typeID := av.TAG_VIDEO
+	if !p.IsVideo {
+		if p.IsMetadata {
+			var err error
+			typeID = av.TAG_SCRIPTDATAAMF0
+			data, err = amf.MetaDataReform(data, amf.DEL)
+			if err != nil {
+				return err
+			}
+		} else {
+			typeID = av.TAG_AUDIO
+		}
+	}
+	if m.index != nil {
+		m.index.update(p, data, m.size)
+	}
+	return m.writeTag(typeID, p.Timestamp, data)
+}
+
+func (m *Muxer) writeTag(typeID int, timestamp uint32, data []byte) error {
+	h := m.buf[:headerLen]
+	dataLen := len(data)
+	preDataLen := dataLen + headerLen
+	timestampBase := timestamp & 0xffffff
+	timestampExt := timestamp >> 24 & 0xff
+	bytesutil.PutU8(h[0:1], uint8(typeID))
+	bytesutil.PutI24BE(h[1:4], int32(dataLen))
+	bytesutil.PutI24BE(h[4:7], int32(timestampBase))
+	bytesutil.PutU8(h[7:8], uint8(timestampExt))
+	bytesutil.PutI24BE(h[8:11], 0)
+	if err := m.write(h); err != nil {
+		return err
+	}
+	if err := m.write(data); err != nil {
+		return err
+	}
+	bytesutil.PutI32BE(h[:4], int32(preDataLen))
+	return m.write(h[:4])
+}
+
+// Size 已写入的字节数
+func (m *Muxer) Size() int64 {
+	return m.size
+}
+
+func (m *Muxer) write(b []byte) error {
+	n, err := m.w.Write(b)
+	m.size += int64(n)
+	return err
+}
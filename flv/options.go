@@ -0,0 +1,119 @@
+package flv
+
+import (
+	"github.com/LeeZXin/z-live/av"
+	"net/url"
+)
+
+const (
+	onlyAudio = "audio"
+	onlyVideo = "video"
+
+	startKeyFrame = "keyframe"
+)
+
+// Options 拉流选项 http-flv和rtmp拉流通用
+type Options struct {
+	// NoAudio 只输出视频
+	NoAudio bool
+	// NoVideo 只输出音频
+	NoVideo bool
+	// ZeroTimestamp 每个观众的时间戳从0开始
+	ZeroTimestamp bool
+	// FromKeyFrame 不发送gop缓存 从最新的关键帧开始
+	FromKeyFrame bool
+}
+
+// ParseOptions 解析参数 only=audio|video zeroTs=1 start=gop|keyframe
+func ParseOptions(values url.Values) Options {
+	var ret Options
+	switch values.Get("only") {
+	case onlyAudio:
+		ret.NoVideo = true
+	case onlyVideo:
+		ret.NoAudio = true
+	}
+	switch values.Get("zeroTs") {
+	case "1", "true":
+		ret.ZeroTimestamp = true
+	}
+	ret.FromKeyFrame = values.Get("start") == startKeyFrame
+	return ret
+}
+
+// HasAudio flv头的音频标志
+func (o Options) HasAudio() bool {
+	return !o.NoAudio
+}
+
+// HasVideo flv头的视频标志
+func (o Options) HasVideo() bool {
+	return !o.NoVideo
+}
+
+// PacketFilter 按选项过滤音视频 重写时间戳
+type PacketFilter struct {
+	opts Options
+	// waitKeyFrame 从关键帧开始时 收到关键帧前丢弃视频
+	waitKeyFrame bool
+	hasBase      bool
+	baseTs       uint32
+}
+
+func NewPacketFilter(opts Options) *PacketFilter {
+	return &PacketFilter{
+		opts:         opts,
+		waitKeyFrame: opts.FromKeyFrame && !opts.NoVideo,
+	}
+}
+
+// Filter 返回false时丢弃 时间戳需要重写时返回副本
+func (f *PacketFilter) Filter(p *av.Packet) (*av.Packet, bool) {
+	if p.IsAudio && f.opts.NoAudio {
+		return nil, false
+	}
+	isSeq := false
+	if p.IsVideo {
+		if f.opts.NoVideo {
+			return nil, false
+		}
+		vh, ok := p.Header.(av.VideoPacketHeader)
+		if !ok {
+			return nil, false
+		}
+		isSeq = vh.IsSeq()
+		if f.waitKeyFrame && !isSeq {
+			if !vh.IsKeyFrame() {
+				return nil, false
+			}
+			f.waitKeyFrame = false
+		}
+	} else if p.IsAudio {
+		ah, ok := p.Header.(av.AudioPacketHeader)
+		isSeq = ok && av.IsAudioSeqHeader(ah)
+	}
+	if !f.opts.ZeroTimestamp {
+		return p, true
+	}
+	// 第一个音视频帧作为0点 之前的metadata和sequence header时间戳为0
+	if !f.hasBase {
+		if p.IsMetadata || isSeq {
+			return f.withTimestamp(p, 0), true
+		}
+		f.hasBase = true
+		f.baseTs = p.Timestamp
+	}
+	if p.Timestamp < f.baseTs {
+		return f.withTimestamp(p, 0), true
+	}
+	return f.withTimestamp(p, p.Timestamp-f.baseTs), true
+}
+
+func (f *PacketFilter) withTimestamp(p *av.Packet, ts uint32) *av.Packet {
+	if p.Timestamp == ts {
+		return p
+	}
+	ret := *p
+	ret.Timestamp = ts
+	return &ret
+}
@@ -0,0 +1,331 @@
+package flv
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/LeeZXin/z-live/amf"
+	"github.com/LeeZXin/z-live/av"
+	"io"
+	"os"
+	"sort"
+)
+
+var (
+	ErrInvalidHeader  = fmt.Errorf("invalid flv header")
+	ErrPreTagSize     = fmt.Errorf("previous tag size not match")
+	ErrNoKeyFrame     = fmt.Errorf("keyframe not found")
+	errInvalidTagSize = fmt.Errorf("invalid tag size")
+)
+
+const (
+	// maxHeaderTags 文件开头最多读取多少个tag查找metadata和sequence header
+	maxHeaderTags = 64
+	maxTagSize    = 16 * 1024 * 1024
+)
+
+/*
+Reader 读取flv文件
+按tag转为av.Packet 支持按onMetaData中的keyframes索引或者扫描文件定位到关键帧
+*/
+type Reader struct {
+	r          io.ReadSeeker
+	closer     io.Closer
+	hasAudio   bool
+	hasVideo   bool
+	dataOffset int64
+	metadata   amf.Object
+	// headers 文件开头的metadata和sequence header
+	headers      []*av.Packet
+	keyTimes     []float64
+	keyPositions []int64
+	buf          []byte
+}
+
+// Open 打开flv文件
+func Open(path string) (*Reader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	ret, err := NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	ret.closer = file
+	return ret, nil
+}
+
+func NewReader(r io.ReadSeeker) (*Reader, error) {
+	ret := &Reader{
+		r:   r,
+		buf: make([]byte, headerLen),
+	}
+	header := make([]byte, 9)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[0] != 'F' || header[1] != 'L' || header[2] != 'V' {
+		return nil, ErrInvalidHeader
+	}
+	ret.hasAudio = header[4]&0x04 != 0
+	ret.hasVideo = header[4]&0x01 != 0
+	dataOffset := int64(header[5])<<24 | int64(header[6])<<16 | int64(header[7])<<8 | int64(header[8])
+	if dataOffset < 9 {
+		return nil, ErrInvalidHeader
+	}
+	// 跳过第一个PreviousTagSize
+	ret.dataOffset = dataOffset + 4
+	if err := ret.readHeaders(); err != nil {
+		return nil, err
+	}
+	if _, err := r.Seek(ret.dataOffset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// readHeaders 读取文件开头的metadata和sequence header
+func (r *Reader) readHeaders() error {
+	if _, err := r.r.Seek(r.dataOffset, io.SeekStart); err != nil {
+		return err
+	}
+	for i := 0; i < maxHeaderTags; i++ {
+		p, err := r.ReadPacket()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch {
+		case p.IsMetadata:
+			if r.metadata == nil && amf.ScriptDataName(p.Data) == amf.OnMetaData {
+				r.parseMetadata(p.Data)
+				r.headers = append(r.headers, p)
+			}
+		case isSeqPacket(p):
+			r.headers = append(r.headers, p)
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func (r *Reader) parseMetadata(data []byte) {
+	vs, _ := amf.NewDecoder().DecodeBatch(bytes.NewReader(data), amf.AMF0)
+	if len(vs) > 0 && vs[0] == amf.SetDataFrame {
+		vs = vs[1:]
+	}
+	if len(vs) < 2 {
+		return
+	}
+	r.metadata, _ = vs[1].(amf.Object)
+	keyframes, ok := r.metadata["keyframes"].(amf.Object)
+	if !ok {
+		return
+	}
+	times, _ := keyframes["times"].(amf.Array)
+	positions, _ := keyframes["filepositions"].(amf.Array)
+	if len(times) != len(positions) {
+		return
+	}
+	for i := range times {
+		t, ok1 := times[i].(float64)
+		pos, ok2 := positions[i].(float64)
+		if !ok1 || !ok2 {
+			r.keyTimes, r.keyPositions = nil, nil
+			return
+		}
+		r.keyTimes = append(r.keyTimes, t)
+		r.keyPositions = append(r.keyPositions, int64(pos))
+	}
+}
+
+// ReadPacket 读取下一个tag 文件结束返回io.EOF
+func (r *Reader) ReadPacket() (*av.Packet, error) {
+	for {
+		h := r.buf[:headerLen]
+		if _, err := io.ReadFull(r.r, h); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return nil, io.EOF
+			}
+			return nil, err
+		}
+		typeID := h[0] & 0x1f
+		dataLen := int(h[1])<<16 | int(h[2])<<8 | int(h[3])
+		timestamp := uint32(h[7])<<24 | uint32(h[4])<<16 | uint32(h[5])<<8 | uint32(h[6])
+		if dataLen > maxTagSize {
+			return nil, errInvalidTagSize
+		}
+		data := make([]byte, dataLen)
+		if _, err := io.ReadFull(r.r, data); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return nil, io.EOF
+			}
+			return nil, err
+		}
+		if _, err := io.ReadFull(r.r, h[:4]); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return nil, io.EOF
+			}
+			return nil, err
+		}
+		preTagSize := int(h[0])<<24 | int(h[1])<<16 | int(h[2])<<8 | int(h[3])
+		if preTagSize != dataLen+headerLen {
+			return nil, ErrPreTagSize
+		}
+		p := &av.Packet{
+			IsAudio:    typeID == av.TAG_AUDIO,
+			IsVideo:    typeID == av.TAG_VIDEO,
+			IsMetadata: typeID == av.TAG_SCRIPTDATAAMF0 || typeID == av.TAG_SCRIPTDATAAMF3,
+			Timestamp:  timestamp,
+			Data:       data,
+		}
+		if p.IsMetadata {
+			return p, nil
+		}
+		// 跳过未知类型和空tag
+		if (!p.IsAudio && !p.IsVideo) || dataLen == 0 {
+			continue
+		}
+		if err := DemuxH(p); err != nil {
+			continue
+		}
+		return p, nil
+	}
+}
+
+// Headers 文件开头的metadata和sequence header 定位后需要先发送
+func (r *Reader) Headers() []*av.Packet {
+	return r.headers
+}
+
+// Metadata 文件的onMetaData
+func (r *Reader) Metadata() amf.Object {
+	return r.metadata
+}
+
+// Duration 文件时长 单位毫秒 没有onMetaData返回0
+func (r *Reader) Duration() int64 {
+	duration, _ := r.metadata["duration"].(float64)
+	return int64(duration * 1000)
+}
+
+func (r *Reader) HasAudio() bool {
+	return r.hasAudio
+}
+
+func (r *Reader) HasVideo() bool {
+	return r.hasVideo
+}
+
+// Seek 定位到不晚于ms的最近关键帧 返回关键帧的时间戳
+// 优先使用keyframes索引 索引不可用时扫描文件
+func (r *Reader) Seek(ms uint32) (uint32, error) {
+	if len(r.keyTimes) > 0 {
+		target := float64(ms) / 1000
+		i := sort.Search(len(r.keyTimes), func(i int) bool {
+			return r.keyTimes[i] > target
+		}) - 1
+		if i < 0 {
+			i = 0
+		}
+		if ts, ok := r.checkKeyFrame(r.keyPositions[i]); ok {
+			return ts, nil
+		}
+	}
+	return r.scan(ms)
+}
+
+// checkKeyFrame 检查索引位置是否是视频关键帧
+func (r *Reader) checkKeyFrame(pos int64) (uint32, bool) {
+	if _, err := r.r.Seek(pos, io.SeekStart); err != nil {
+		return 0, false
+	}
+	p, err := r.ReadPacket()
+	if err != nil || !isKeyFramePacket(p) {
+		return 0, false
+	}
+	if _, err = r.r.Seek(pos, io.SeekStart); err != nil {
+		return 0, false
+	}
+	return p.Timestamp, true
+}
+
+// scan 从头扫描tag头 找到不晚于ms的最后一个关键帧
+func (r *Reader) scan(ms uint32) (uint32, error) {
+	pos := r.dataOffset
+	keyPos := int64(-1)
+	var keyTs uint32
+	h := make([]byte, headerLen+2)
+	for {
+		if _, err := r.r.Seek(pos, io.SeekStart); err != nil {
+			return 0, err
+		}
+		if _, err := io.ReadFull(r.r, h); err != nil {
+			break
+		}
+		typeID := h[0] & 0x1f
+		dataLen := int64(h[1])<<16 | int64(h[2])<<8 | int64(h[3])
+		timestamp := uint32(h[7])<<24 | uint32(h[4])<<16 | uint32(h[5])<<8 | uint32(h[6])
+		// 视频关键帧且不是sequence header 纯音频时每个音频帧都可以定位
+		isKey := false
+		if typeID == av.TAG_VIDEO && dataLen >= 2 {
+			isKey = isVideoKeyFrame(h[headerLen], h[headerLen+1])
+		} else if typeID == av.TAG_AUDIO && dataLen >= 2 && !r.hasVideo {
+			isKey = h[headerLen]>>4 != av.SOUND_AAC || h[headerLen+1] == av.AAC_RAW
+		}
+		if isKey {
+			if timestamp > ms && keyPos >= 0 {
+				break
+			}
+			keyPos = pos
+			keyTs = timestamp
+		}
+		pos += headerLen + dataLen + 4
+	}
+	if keyPos < 0 {
+		return 0, ErrNoKeyFrame
+	}
+	_, err := r.r.Seek(keyPos, io.SeekStart)
+	return keyTs, err
+}
+
+func (r *Reader) Close() error {
+	if r.closer != nil {
+		return r.closer.Close()
+	}
+	return nil
+}
+
+func isSeqPacket(p *av.Packet) bool {
+	if p.IsVideo {
+		vh, ok := p.Header.(av.VideoPacketHeader)
+		return ok && vh.IsSeq()
+	}
+	ah, ok := p.Header.(av.AudioPacketHeader)
+	return ok && av.IsAudioSeqHeader(ah)
+}
+
+func isKeyFramePacket(p *av.Packet) bool {
+	return p.IsVideo && len(p.Data) >= 2 && isVideoKeyFrame(p.Data[0], p.Data[1])
+}
+
+// isVideoKeyFrame 根据视频tag的前两个字节判断是否是可定位的关键帧
+// 使用通用的FrameType位 兼容hevc和enhanced rtmp
+func isVideoKeyFrame(b0, b1 byte) bool {
+	if b0>>4&0x07 != av.FRAME_KEY {
+		return false
+	}
+	if b0&av.VIDEO_EX_HEADER != 0 {
+		packetType := b0 & 0x0f
+		return packetType == av.VIDEO_PACKET_CODED_FRAMES || packetType == av.VIDEO_PACKET_CODED_FRAMES_X
+	}
+	switch b0 & 0x0f {
+	case av.VIDEO_H264, av.VIDEO_HEVC:
+		return b1 == av.AVC_NALU
+	}
+	return true
+}
@@ -0,0 +1,261 @@
+package flv
+
+import (
+	"bytes"
+	"github.com/LeeZXin/z-live/amf"
+	"github.com/LeeZXin/z-live/av"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// videoFrame 生成视频tag数据 key为是否关键帧
+type videoFrame func(key bool) []byte
+
+func avcFrame(key bool) []byte {
+	if key {
+		return []byte{0x17, av.AVC_NALU, 0, 0, 0, 0x65}
+	}
+	return []byte{0x27, av.AVC_NALU, 0, 0, 0, 0x41}
+}
+
+// hevcFrame 国内扩展的codecID 12
+func hevcFrame(key bool) []byte {
+	if key {
+		return []byte{0x1c, av.AVC_NALU, 0, 0, 0, 0x26}
+	}
+	return []byte{0x2c, av.AVC_NALU, 0, 0, 0, 0x02}
+}
+
+// enhancedFrame enhanced rtmp的hvc1 关键帧带cts 非关键帧用CodedFramesX
+func enhancedFrame(key bool) []byte {
+	if key {
+		return []byte{av.VIDEO_EX_HEADER | 0x10 | av.VIDEO_PACKET_CODED_FRAMES, 'h', 'v', 'c', '1', 0, 0, 0, 0x26}
+	}
+	return []byte{av.VIDEO_EX_HEADER | 0x20 | av.VIDEO_PACKET_CODED_FRAMES_X, 'h', 'v', 'c', '1', 0x02}
+}
+
+func videoSeq(frame videoFrame) []byte {
+	b := frame(true)
+	if b[0]&av.VIDEO_EX_HEADER != 0 {
+		return []byte{av.VIDEO_EX_HEADER | 0x10 | av.VIDEO_PACKET_SEQUENCE_START, 'h', 'v', 'c', '1', 0x01}
+	}
+	return []byte{b[0], av.AVC_SEQHDR, 0, 0, 0, 0x01}
+}
+
+func newTestPacket(t *testing.T, isVideo bool, ts uint32, data []byte) *av.Packet {
+	p := &av.Packet{
+		IsVideo:   isVideo,
+		IsAudio:   !isVideo,
+		Timestamp: ts,
+		Data:      data,
+	}
+	if err := DemuxH(p); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// writeTestFile 5秒 每秒一个关键帧 每40ms一帧视频 每20ms一帧aac
+func writeTestFile(t *testing.T, frame videoFrame, indexed bool) string {
+	path := filepath.Join(t.TempDir(), "test.flv")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMuxer(file)
+	if indexed {
+		m = NewFileMuxer(file)
+	}
+	if err = m.WriteHeader(); err != nil {
+		t.Fatal(err)
+	}
+	packets := []*av.Packet{
+		newTestPacket(t, true, 0, videoSeq(frame)),
+		newTestPacket(t, false, 0, []byte{0xaf, av.AAC_SEQHDR, 0x12, 0x10}),
+	}
+	for ts := uint32(0); ts < 5000; ts += 20 {
+		if ts%40 == 0 {
+			packets = append(packets, newTestPacket(t, true, ts, frame(ts%1000 == 0)))
+		}
+		packets = append(packets, newTestPacket(t, false, ts, []byte{0xaf, av.AAC_RAW, 0x21}))
+	}
+	for _, p := range packets {
+		if err = m.WritePacket(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = file.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if indexed {
+		size, err := m.Finalize(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() != size {
+			t.Fatalf("Finalize size = %d, file size = %d", size, info.Size())
+		}
+	} else if _, err = m.Finalize(path); err != ErrNoIndex {
+		t.Fatalf("Finalize without index err = %v", err)
+	}
+	return path
+}
+
+func TestReaderSeek(t *testing.T) {
+	frames := []struct {
+		name  string
+		frame videoFrame
+	}{
+		{name: "avc", frame: avcFrame},
+		{name: "hevc", frame: hevcFrame},
+		{name: "enhanced hevc", frame: enhancedFrame},
+	}
+	seeks := []struct {
+		ms   uint32
+		want uint32
+	}{
+		{ms: 0, want: 0},
+		{ms: 999, want: 0},
+		{ms: 1000, want: 1000},
+		{ms: 2500, want: 2000},
+		{ms: 10000, want: 4000},
+	}
+	for _, f := range frames {
+		for _, indexed := range []bool{true, false} {
+			name := f.name + " scan"
+			if indexed {
+				name = f.name + " index"
+			}
+			t.Run(name, func(t *testing.T) {
+				r, err := Open(writeTestFile(t, f.frame, indexed))
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer r.Close()
+				if !r.HasAudio() || !r.HasVideo() {
+					t.Fatal("flv header flags not set")
+				}
+				if indexed {
+					if r.Duration() != 4980 {
+						t.Fatalf("Duration() = %d", r.Duration())
+					}
+					if len(r.keyTimes) != 5 {
+						t.Fatalf("keyframes = %v", r.keyTimes)
+					}
+				} else if r.Metadata() != nil || len(r.keyTimes) != 0 {
+					t.Fatal("unexpected metadata")
+				}
+				if n := len(r.Headers()); indexed && n != 3 || !indexed && n != 2 {
+					t.Fatalf("headers = %d", n)
+				}
+				for _, s := range seeks {
+					ts, err := r.Seek(s.ms)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if ts != s.want {
+						t.Fatalf("Seek(%d) = %d, want %d", s.ms, ts, s.want)
+					}
+					p, err := r.ReadPacket()
+					if err != nil {
+						t.Fatal(err)
+					}
+					if !isKeyFramePacket(p) || p.Timestamp != s.want {
+						t.Fatalf("Seek(%d) read %v ts=%d", s.ms, p.Data, p.Timestamp)
+					}
+					if !bytes.Equal(p.Data, f.frame(true)) {
+						t.Fatalf("keyframe data = %x", p.Data)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestReaderMetadata(t *testing.T) {
+	r, err := Open(writeTestFile(t, avcFrame, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	meta := r.Metadata()
+	if meta["videocodecid"] != float64(av.VIDEO_H264) || meta["audiocodecid"] != float64(av.SOUND_AAC) {
+		t.Fatalf("codec ids = %v %v", meta["videocodecid"], meta["audiocodecid"])
+	}
+	keyframes, _ := meta["keyframes"].(amf.Object)
+	positions, _ := keyframes["filepositions"].(amf.Array)
+	if len(positions) != 5 {
+		t.Fatalf("filepositions = %v", positions)
+	}
+	// 索引位置必须指向关键帧
+	for i, pos := range positions {
+		ts, ok := r.checkKeyFrame(int64(pos.(float64)))
+		if !ok || ts != uint32(i*1000) {
+			t.Fatalf("filepositions[%d] = %v ts=%d ok=%v", i, pos, ts, ok)
+		}
+	}
+}
+
+func TestIsVideoKeyFrame(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want bool
+	}{
+		{name: "avc key", data: avcFrame(true), want: true},
+		{name: "avc inter", data: avcFrame(false)},
+		{name: "avc seq", data: videoSeq(avcFrame)},
+		{name: "avc end of sequence", data: []byte{0x17, av.AVC_EOS}},
+		{name: "hevc key", data: hevcFrame(true), want: true},
+		{name: "hevc seq", data: videoSeq(hevcFrame)},
+		{name: "enhanced key", data: enhancedFrame(true), want: true},
+		{name: "enhanced key coded frames x", data: []byte{av.VIDEO_EX_HEADER | 0x10 | av.VIDEO_PACKET_CODED_FRAMES_X, 'h', 'v', 'c', '1'}, want: true},
+		{name: "enhanced inter", data: enhancedFrame(false)},
+		{name: "enhanced seq", data: videoSeq(enhancedFrame)},
+		{name: "enhanced sequence end", data: []byte{av.VIDEO_EX_HEADER | 0x10 | av.VIDEO_PACKET_SEQUENCE_END, 'h', 'v', 'c', '1'}},
+		{name: "vp6 key", data: []byte{0x14, 0x00}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isVideoKeyFrame(tt.data[0], tt.data[1]); got != tt.want {
+				t.Fatalf("isVideoKeyFrame(%x) = %v, want %v", tt.data[:2], got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFileWriterFinalize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "writer.flv")
+	w, err := NewFileWriter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.WritePacket(newTestPacket(t, true, 0, videoSeq(avcFrame))); err != nil {
+		t.Fatal(err)
+	}
+	for ts := uint32(0); ts < 3000; ts += 40 {
+		if err = w.WritePacket(newTestPacket(t, true, ts, avcFrame(ts%1000 == 0))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 关闭后队列中的packet仍然写入文件
+	w.Close()
+	w.Wait()
+	r, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if r.Duration() != 2960 || len(r.keyTimes) != 3 {
+		t.Fatalf("duration = %d keyframes = %v", r.Duration(), r.keyTimes)
+	}
+	ts, err := r.Seek(2500)
+	if err != nil || ts != 2000 {
+		t.Fatalf("Seek(2500) = %d %v", ts, err)
+	}
+}
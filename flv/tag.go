@@ -155,6 +155,9 @@ func (t *Tag) parseAudioHeader(b []byte) (n int, err error) {
 	case av.SOUND_AAC:
 		t.media.aacPacketType = b[1]
 		n++
+	case av.SOUND_EX_HEADER:
+		// enhanced rtmp的AudioPacketType
+		t.media.aacPacketType = flags & 0x0f
 	}
 	return
 }
@@ -165,9 +168,21 @@ func (t *Tag) parseVideoHeader(b []byte) (n int, err error) {
 		return
 	}
 	flags := b[0]
-	t.media.frameType = flags >> 4
-	t.media.codecID = flags & 0xf
+	t.media.frameType = flags >> 4 & 0x07
 	n++
+	if flags&av.VIDEO_EX_HEADER != 0 {
+		// enhanced rtmp 低4位为VideoPacketType 之后是FourCC
+		t.media.avcPacketType = flags & 0x0f
+		n += 4
+		if t.media.avcPacketType == av.VIDEO_PACKET_CODED_FRAMES && len(b) >= n+3 {
+			for i := n; i < n+3; i++ {
+				t.media.compositionTime = t.media.compositionTime<<8 + int32(b[i])
+			}
+			n += 3
+		}
+		return
+	}
+	t.media.codecID = flags & 0xf
 	if t.media.frameType == av.FRAME_INTER || t.media.frameType == av.FRAME_KEY {
 		t.media.avcPacketType = b[1]
 		for i := 2; i < 5; i++ {
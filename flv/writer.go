@@ -2,11 +2,10 @@ package flv
 
 import (
 	"context"
-	"github.com/LeeZXin/z-live/amf"
 	"github.com/LeeZXin/z-live/av"
-	"github.com/LeeZXin/z-live/util/bytesutil"
 	"github.com/LeeZXin/zsf-utils/quit"
 	"github.com/LeeZXin/zsf-utils/threadutil"
+	"github.com/LeeZXin/zsf/logger"
 	"io"
 	"net/http"
 	"os"
@@ -25,17 +24,32 @@ const (
 const (
 	fileMode = iota + 1
 	httpMode
+	wsMode
 )
 
+const (
+	ViewerType   = "httpFlv"
+	WsViewerType = "wsFlv"
+)
+
+// tagFlusher 每个tag写完后刷新 websocket每个tag一帧
+type tagFlusher interface {
+	Flush() error
+}
+
 // Writer 实现rtmp保存到本地flv文件或者使用http-flv传输
 type Writer struct {
-	buf         []byte
+	muxer       *Muxer
 	writer      io.WriteCloser
 	packetQueue chan *av.Packet
 	ctx         context.Context
 	cancelFn    context.CancelFunc
 	mode        int
-	closeOnce   sync.Once
+	filter      *PacketFilter
+	// fileName 文件模式下关闭后生成关键帧索引
+	fileName  string
+	doneCh    chan struct{}
+	closeOnce sync.Once
 }
 
 func NewFileWriter(fileName string) (*Writer, error) {
@@ -43,7 +57,12 @@ func NewFileWriter(fileName string) (*Writer, error) {
 	if err != nil {
 		return nil, err
 	}
-	return newWriter(file, fileMode)
+	ret, err := newWriter(file, fileMode, Options{})
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return ret, nil
 }
 
 type httpWriterWrapper struct {
@@ -69,31 +88,35 @@ func (w *httpWriterWrapper) Close() error {
 	return nil
 }
 
-func NewHttpWriter(writer http.ResponseWriter) (*Writer, error) {
+// NewHttpWriter opts可选只输出音频或视频、时间戳从0开始
+func NewHttpWriter(writer http.ResponseWriter, opts Options) (*Writer, error) {
 	return newWriter(&httpWriterWrapper{
 		writer:  writer,
 		flusher: writer.(http.Flusher),
-	}, httpMode)
+	}, httpMode, opts)
 }
 
-func newWriter(writer io.WriteCloser, mode int) (*Writer, error) {
+func newWriter(writer io.WriteCloser, mode int, opts Options) (*Writer, error) {
 	ctx, cancelFunc := context.WithCancel(context.Background())
 	ret := &Writer{
 		writer:      writer,
 		packetQueue: make(chan *av.Packet, maxQueueNum),
-		buf:         make([]byte, headerLen),
+		muxer:       NewMuxer(writer),
 		ctx:         ctx,
 		cancelFn:    cancelFunc,
+		doneCh:      make(chan struct{}),
 		closeOnce:   sync.Once{},
 		mode:        mode,
+		filter:      NewPacketFilter(opts),
 	}
-	_, err := ret.writer.Write(flvHeader)
-	if err != nil {
+	if file, ok := writer.(*os.File); ok && mode == fileMode {
+		ret.fileName = file.Name()
+		ret.muxer = NewFileMuxer(writer)
+	}
+	if err := ret.muxer.WriteHeaderFlags(opts.HasAudio(), opts.HasVideo()); err != nil {
 		return nil, err
 	}
-	bytesutil.PutI32BE(ret.buf[:4], 0)
-	_, err = ret.writer.Write(ret.buf[:4])
-	if err != nil {
+	if err := ret.flushTag(); err != nil {
 		return nil, err
 	}
 	quit.AddShutdownHook(func() {
@@ -134,63 +157,65 @@ func (w *Writer) WritePacket(p *av.Packet) error {
 }
 
 func (w *Writer) muxPacket() {
-	defer w.Close()
+	defer w.finish()
 	for {
 		select {
 		case p, ok := <-w.packetQueue:
 			if !ok {
 				return
 			}
-			h := w.buf[:headerLen]
-			typeID := av.TAG_VIDEO
-			if !p.IsVideo {
-				if p.IsMetadata {
-					var err error
-					typeID = av.TAG_SCRIPTDATAAMF0
-					p.Data, err = amf.MetaDataReform(p.Data, amf.DEL)
-					if err != nil {
-						return
-					}
-				} else {
-					typeID = av.TAG_AUDIO
-				}
-			}
-			dataLen := len(p.Data)
-			timestamp := p.Timestamp
-			preDataLen := dataLen + headerLen
-			timestampBase := timestamp & 0xffffff
-			timestampExt := timestamp >> 24 & 0xff
-			bytesutil.PutU8(h[0:1], uint8(typeID))
-			bytesutil.PutI24BE(h[1:4], int32(dataLen))
-			bytesutil.PutI24BE(h[4:7], int32(timestampBase))
-			bytesutil.PutU8(h[7:8], uint8(timestampExt))
-			if _, err := w.writer.Write(h); err != nil {
-				return
+			p, ok = w.filter.Filter(p)
+			if !ok {
+				continue
 			}
-			if _, err := w.writer.Write(p.Data); err != nil {
+			if err := w.muxer.WritePacket(p); err != nil {
 				return
 			}
-			bytesutil.PutI32BE(h[:4], int32(preDataLen))
-			if _, err := w.writer.Write(h[:4]); err != nil {
+			if err := w.flushTag(); err != nil {
 				return
 			}
 		}
 	}
 }
 
+// finish 队列写完后关闭 文件模式生成关键帧索引
+func (w *Writer) finish() {
+	w.Close()
+	_ = w.writer.Close()
+	if w.fileName != "" {
+		if _, err := w.muxer.Finalize(w.fileName); err != nil {
+			logger.Logger.Errorf("finalize flv %s failed: %v", w.fileName, err)
+		}
+	}
+	close(w.doneCh)
+}
+
+func (w *Writer) flushTag() error {
+	if f, ok := w.writer.(tagFlusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// ViewerType 文件模式不算观众
+func (w *Writer) ViewerType() string {
+	switch w.mode {
+	case httpMode:
+		return ViewerType
+	case wsMode:
+		return WsViewerType
+	}
+	return ""
+}
+
 func (w *Writer) Close() {
 	w.closeOnce.Do(func() {
 		w.cancelFn()
 		close(w.packetQueue)
-		_ = w.writer.Close()
 	})
 }
 
+// Wait 等待队列写完并关闭
 func (w *Writer) Wait() {
-	for {
-		select {
-		case <-w.ctx.Done():
-			return
-		}
-	}
+	<-w.doneCh
 }
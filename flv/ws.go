@@ -0,0 +1,44 @@
+package flv
+
+import (
+	"bytes"
+	"context"
+	"nhooyr.io/websocket"
+	"time"
+)
+
+const (
+	wsWriteTimeout = 10 * time.Second
+)
+
+// wsWriterWrapper 缓存一个tag的数据 作为一个binary帧发送
+type wsWriterWrapper struct {
+	conn *websocket.Conn
+	buf  bytes.Buffer
+}
+
+func (w *wsWriterWrapper) Write(content []byte) (int, error) {
+	return w.buf.Write(content)
+}
+
+func (w *wsWriterWrapper) Flush() error {
+	if w.buf.Len() == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), wsWriteTimeout)
+	defer cancel()
+	err := w.conn.Write(ctx, websocket.MessageBinary, w.buf.Bytes())
+	w.buf.Reset()
+	return err
+}
+
+func (w *wsWriterWrapper) Close() error {
+	return w.conn.Close(websocket.StatusNormalClosure, "")
+}
+
+// NewWsWriter websocket-flv 和http-flv相同的flv字节流 每个tag一个binary帧
+func NewWsWriter(conn *websocket.Conn, opts Options) (*Writer, error) {
+	return newWriter(&wsWriterWrapper{
+		conn: conn,
+	}, wsMode, opts)
+}
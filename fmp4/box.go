@@ -0,0 +1,200 @@
+package fmp4
+
+import "encoding/binary"
+
+// box 拼接mp4 box
+func box(typ string, children ...[]byte) []byte {
+	size := 8
+	for _, c := range children {
+		size += len(c)
+	}
+	ret := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(ret[0:4], uint32(size))
+	copy(ret[4:8], typ)
+	for _, c := range children {
+		ret = append(ret, c...)
+	}
+	return ret
+}
+
+// fullBox 带version和flags的box
+func fullBox(typ string, version byte, flags uint32, children ...[]byte) []byte {
+	vf := u32(flags)
+	vf[0] = version
+	return box(typ, append([][]byte{vf}, children...)...)
+}
+
+func u8(v uint8) []byte {
+	return []byte{v}
+}
+
+func u16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
+
+func u32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func u64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+func zeros(n int) []byte {
+	return make([]byte, n)
+}
+
+var (
+	// matrix 单位矩阵
+	matrix = concat(
+		u32(0x00010000), u32(0), u32(0),
+		u32(0), u32(0x00010000), u32(0),
+		u32(0), u32(0), u32(0x40000000),
+	)
+)
+
+func concat(bs ...[]byte) []byte {
+	size := 0
+	for _, b := range bs {
+		size += len(b)
+	}
+	ret := make([]byte, 0, size)
+	for _, b := range bs {
+		ret = append(ret, b...)
+	}
+	return ret
+}
+
+func ftyp() []byte {
+	return box("ftyp", []byte("isom"), u32(0x200), []byte("isomiso5iso6avc1mp41"))
+}
+
+func mvhd(nextTrackId uint32) []byte {
+	return fullBox("mvhd", 0, 0,
+		u32(0), u32(0), // creation modification
+		u32(1000), u32(0), // timescale duration
+		u32(0x00010000), u16(0x0100), zeros(10),
+		matrix,
+		zeros(24),
+		u32(nextTrackId),
+	)
+}
+
+func trak(t *track) []byte {
+	var volume uint16
+	if !t.isVideo {
+		volume = 0x0100
+	}
+	tkhd := fullBox("tkhd", 0, 0x03,
+		u32(0), u32(0), u32(t.id), u32(0), u32(0),
+		zeros(8), u16(0), u16(0), u16(volume), u16(0),
+		matrix,
+		u32(t.width<<16), u32(t.height<<16),
+	)
+	mdhd := fullBox("mdhd", 0, 0, u32(0), u32(0), u32(t.timescale), u32(0), u16(0x55c4), u16(0))
+	handler, name := "vide", "VideoHandler"
+	var mhd []byte
+	if t.isVideo {
+		mhd = fullBox("vmhd", 0, 1, zeros(8))
+	} else {
+		handler, name = "soun", "SoundHandler"
+		mhd = fullBox("smhd", 0, 0, zeros(4))
+	}
+	hdlr := fullBox("hdlr", 0, 0, u32(0), []byte(handler), zeros(12), []byte(name), u8(0))
+	dinf := box("dinf", fullBox("dref", 0, 0, u32(1), fullBox("url ", 0, 1)))
+	stbl := box("stbl",
+		fullBox("stsd", 0, 0, u32(1), sampleEntry(t)),
+		fullBox("stts", 0, 0, u32(0)),
+		fullBox("stsc", 0, 0, u32(0)),
+		fullBox("stsz", 0, 0, u32(0), u32(0)),
+		fullBox("stco", 0, 0, u32(0)),
+	)
+	return box("trak", tkhd, box("mdia", mdhd, hdlr, box("minf", mhd, dinf, stbl)))
+}
+
+func sampleEntry(t *track) []byte {
+	if t.isVideo {
+		compressorName := zeros(32)
+		return box("avc1",
+			zeros(6), u16(1),
+			zeros(16),
+			u16(uint16(t.width)), u16(uint16(t.height)),
+			u32(0x00480000), u32(0x00480000),
+			u32(0), u16(1),
+			compressorName,
+			u16(0x0018), u16(0xffff),
+			box("avcC", t.config),
+		)
+	}
+	return box("mp4a",
+		zeros(6), u16(1),
+		zeros(8),
+		u16(uint16(t.channels)), u16(16),
+		u16(0), u16(0),
+		u32(uint32(t.sampleRate)<<16),
+		esds(t.config),
+	)
+}
+
+// esds aac的ES_Descriptor
+func esds(asc []byte) []byte {
+	decSpecific := descriptor(0x05, asc)
+	decConfig := descriptor(0x04, concat(
+		u8(0x40), u8(0x15), zeros(3), u32(0), u32(0),
+		decSpecific,
+	))
+	sl := descriptor(0x06, u8(0x02))
+	return fullBox("esds", 0, 0, descriptor(0x03, concat(u16(0), u8(0), decConfig, sl)))
+}
+
+func descriptor(tag byte, payload []byte) []byte {
+	n := len(payload)
+	return concat(
+		[]byte{tag, byte(n>>21&0x7f | 0x80), byte(n>>14&0x7f | 0x80), byte(n>>7&0x7f | 0x80), byte(n & 0x7f)},
+		payload,
+	)
+}
+
+func mvex(tracks []*track) []byte {
+	trexs := make([][]byte, 0, len(tracks))
+	for _, t := range tracks {
+		trexs = append(trexs, fullBox("trex", 0, 0, u32(t.id), u32(1), u32(0), u32(0), u32(0)))
+	}
+	return box("mvex", trexs...)
+}
+
+const (
+	// trun flags data-offset duration size flags composition-time-offset
+	trunFlags = 0x000001 | 0x000100 | 0x000200 | 0x000400 | 0x000800
+	// tfhd flags default-base-is-moof
+	tfhdFlags = 0x020000
+
+	keySampleFlags    = 0x02000000
+	nonKeySampleFlags = 0x01010000
+)
+
+// traf dataOffset为该track数据相对moof起始位置的偏移
+func traf(t *track, samples []sample, baseTime uint64, dataOffset int) []byte {
+	entries := make([]byte, 0, len(samples)*16)
+	for _, s := range samples {
+		flags := uint32(keySampleFlags)
+		if t.isVideo && !s.key {
+			flags = nonKeySampleFlags
+		}
+		entries = append(entries, u32(s.duration)...)
+		entries = append(entries, u32(uint32(len(s.data)))...)
+		entries = append(entries, u32(flags)...)
+		entries = append(entries, u32(uint32(s.cts))...)
+	}
+	return box("traf",
+		fullBox("tfhd", 0, tfhdFlags, u32(t.id)),
+		fullBox("tfdt", 1, 0, u64(baseTime)),
+		fullBox("trun", 1, trunFlags, u32(uint32(len(samples))), u32(uint32(dataOffset)), entries),
+	)
+}
@@ -0,0 +1,294 @@
+package fmp4
+
+import (
+	"github.com/LeeZXin/z-live/av"
+	"github.com/LeeZXin/z-live/parser/aac"
+	"github.com/LeeZXin/z-live/parser/h264"
+	"io"
+)
+
+/*
+fmp4封装
+rtmp的avc和aac转为fragmented mp4
+收到第一帧时写ftyp+moov 之后每个gop一个moof+mdat
+按帧分片时每个视频帧一个moof+mdat 降低直播延迟
+*/
+
+const (
+	videoTimescale = 90000
+	videoHz        = videoTimescale / 1000
+	aacSampleLen   = 1024
+
+	videoTrackId = 1
+	audioTrackId = 2
+
+	// audioOnlyFragmentMs 纯音频时每秒一个分片
+	audioOnlyFragmentMs  = 1000
+	defaultVideoDuration = 40 * videoHz
+)
+
+type sample struct {
+	// dts 毫秒
+	dts int64
+	// cts timescale单位
+	cts      int32
+	key      bool
+	duration uint32
+	data     []byte
+}
+
+type track struct {
+	id         uint32
+	isVideo    bool
+	timescale  uint32
+	config     []byte
+	width      uint32
+	height     uint32
+	sampleRate int
+	channels   int
+	samples    []sample
+	// lastDuration 最后一帧不知道时长时使用上一帧的时长
+	lastDuration uint32
+}
+
+// decodeTime 毫秒转为timescale单位
+func (t *track) decodeTime(ms int64) uint64 {
+	if ms < 0 {
+		ms = 0
+	}
+	return uint64(ms) * uint64(t.timescale) / 1000
+}
+
+// Muxer p.Data为带flv音视频tag头的数据
+type Muxer struct {
+	w        io.Writer
+	video    *track
+	audio    *track
+	tracks   []*track
+	initDone bool
+	seq      uint32
+	baseDts  int64
+	hasBase  bool
+	size     int64
+	// perFrame 每个视频帧一个分片
+	perFrame bool
+}
+
+func NewMuxer(w io.Writer) *Muxer {
+	return &Muxer{
+		w: w,
+	}
+}
+
+func (m *Muxer) WritePacket(p *av.Packet) error {
+	if p.IsMetadata {
+		return nil
+	}
+	if p.IsVideo {
+		vh, ok := p.Header.(av.VideoPacketHeader)
+		if !ok || vh.CodecID() != av.VIDEO_H264 || len(p.Data) < 5 {
+			return nil
+		}
+		if vh.IsSeq() {
+			return m.setVideoConfig(p.Data[5:])
+		}
+		if p.Data[1] != av.AVC_NALU {
+			return nil
+		}
+		return m.addSample(m.video, int64(p.Timestamp), vh.CompositionTime()*videoHz, vh.IsKeyFrame(), p.Data[5:])
+	}
+	ah, ok := p.Header.(av.AudioPacketHeader)
+	if !ok || ah.SoundFormat() != av.SOUND_AAC || len(p.Data) < 2 {
+		return nil
+	}
+	if ah.AACPacketType() == av.AAC_SEQHDR {
+		return m.setAudioConfig(p.Data[2:])
+	}
+	return m.addSample(m.audio, int64(p.Timestamp), 0, true, p.Data[2:])
+}
+
+// SetFragmentPerFrame 按帧分片 默认按gop分片
+func (m *Muxer) SetFragmentPerFrame(perFrame bool) {
+	m.perFrame = perFrame
+}
+
+// Size 已写入的字节数
+func (m *Muxer) Size() int64 {
+	return m.size
+}
+
+// Close 写入剩余的帧
+func (m *Muxer) Close() error {
+	return m.flush(0, false)
+}
+
+func (m *Muxer) setVideoConfig(b []byte) error {
+	// 初始化分片已写入 不再修改track
+	if m.initDone {
+		return nil
+	}
+	record, err := h264.ParseAVCDecoderConfigurationRecord(b)
+	if err != nil {
+		return err
+	}
+	t := &track{
+		id:           videoTrackId,
+		isVideo:      true,
+		timescale:    videoTimescale,
+		config:       append([]byte(nil), b...),
+		lastDuration: defaultVideoDuration,
+	}
+	if sps, err := record.SPSInfo(); err == nil {
+		t.width = uint32(sps.Width)
+		t.height = uint32(sps.Height)
+	}
+	m.video = t
+	return nil
+}
+
+func (m *Muxer) setAudioConfig(b []byte) error {
+	if m.initDone {
+		return nil
+	}
+	cfg, err := aac.ParseAudioSpecificConfig(b)
+	if err != nil {
+		return err
+	}
+	m.audio = &track{
+		id:           audioTrackId,
+		timescale:    uint32(cfg.SampleRate),
+		config:       append([]byte(nil), b...),
+		sampleRate:   cfg.SampleRate,
+		channels:     cfg.Channels,
+		lastDuration: aacSampleLen,
+	}
+	return nil
+}
+
+func (m *Muxer) addSample(t *track, dts int64, cts int32, key bool, data []byte) error {
+	if t == nil {
+		return nil
+	}
+	if !m.initDone {
+		// 有视频时从关键帧开始
+		if m.video != nil && (!t.isVideo || !key) {
+			return nil
+		}
+		if err := m.writeInit(); err != nil {
+			return err
+		}
+	}
+	if !m.hasBase {
+		m.hasBase = true
+		m.baseDts = dts
+	}
+	if t.isVideo && (key || m.perFrame) && len(t.samples) > 0 {
+		if err := m.flush(dts, true); err != nil {
+			return err
+		}
+	} else if m.video == nil && len(t.samples) > 0 && dts-t.samples[0].dts >= audioOnlyFragmentMs {
+		if err := m.flush(0, false); err != nil {
+			return err
+		}
+	}
+	t.samples = append(t.samples, sample{
+		dts:  dts,
+		cts:  cts,
+		key:  key,
+		data: append([]byte(nil), data...),
+	})
+	return nil
+}
+
+func (m *Muxer) writeInit() error {
+	m.initDone = true
+	m.tracks = m.tracks[:0]
+	if m.video != nil {
+		m.tracks = append(m.tracks, m.video)
+	}
+	if m.audio != nil {
+		m.tracks = append(m.tracks, m.audio)
+	}
+	traks := make([][]byte, 0, len(m.tracks)+2)
+	traks = append(traks, mvhd(audioTrackId+1))
+	for _, t := range m.tracks {
+		traks = append(traks, trak(t))
+	}
+	traks = append(traks, mvex(m.tracks))
+	return m.write(concat(ftyp(), box("moov", traks...)))
+}
+
+// flush 写moof+mdat nextDts为下一个视频帧的dts 用于计算最后一帧时长
+func (m *Muxer) flush(nextDts int64, hasNext bool) error {
+	tracks := make([]*track, 0, len(m.tracks))
+	for _, t := range m.tracks {
+		if len(t.samples) > 0 {
+			tracks = append(tracks, t)
+		}
+	}
+	if len(tracks) == 0 {
+		return nil
+	}
+	for _, t := range tracks {
+		m.calcDuration(t, nextDts, hasNext)
+	}
+	m.seq++
+	// 先算出moof长度 再计算数据偏移
+	moof := m.moof(tracks, 0)
+	moof = m.moof(tracks, len(moof)+8)
+	datas := make([][]byte, 0, 16)
+	for _, t := range tracks {
+		for _, s := range t.samples {
+			datas = append(datas, s.data)
+		}
+		t.samples = t.samples[:0]
+	}
+	return m.write(concat(moof, box("mdat", datas...)))
+}
+
+func (m *Muxer) moof(tracks []*track, dataOffset int) []byte {
+	trafs := make([][]byte, 0, len(tracks)+1)
+	trafs = append(trafs, fullBox("mfhd", 0, 0, u32(m.seq)))
+	for _, t := range tracks {
+		trafs = append(trafs, traf(t, t.samples, t.decodeTime(t.samples[0].dts-m.baseDts), dataOffset))
+		for _, s := range t.samples {
+			dataOffset += len(s.data)
+		}
+	}
+	return box("moof", trafs...)
+}
+
+func (m *Muxer) calcDuration(t *track, nextDts int64, hasNext bool) {
+	samples := t.samples
+	if !t.isVideo {
+		for i := range samples {
+			samples[i].duration = aacSampleLen
+		}
+		return
+	}
+	for i := 0; i < len(samples)-1; i++ {
+		samples[i].duration = durationOf(samples[i+1].dts - samples[i].dts)
+	}
+	last := &samples[len(samples)-1]
+	if hasNext && nextDts > last.dts {
+		last.duration = durationOf(nextDts - last.dts)
+	} else if len(samples) > 1 {
+		last.duration = samples[len(samples)-2].duration
+	} else {
+		last.duration = t.lastDuration
+	}
+	t.lastDuration = last.duration
+}
+
+func durationOf(ms int64) uint32 {
+	if ms <= 0 {
+		return 1
+	}
+	return uint32(ms * videoHz)
+}
+
+func (m *Muxer) write(b []byte) error {
+	n, err := m.w.Write(b)
+	m.size += int64(n)
+	return err
+}
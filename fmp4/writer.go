@@ -0,0 +1,115 @@
+package fmp4
+
+import (
+	"context"
+	"github.com/LeeZXin/z-live/av"
+	"github.com/LeeZXin/zsf-utils/threadutil"
+	"net/http"
+	"sync"
+)
+
+const (
+	maxQueueNum = 1024
+)
+
+const (
+	ViewerType = "httpFmp4"
+)
+
+type httpWriterWrapper struct {
+	writer  http.ResponseWriter
+	flusher http.Flusher
+}
+
+func (w *httpWriterWrapper) Write(content []byte) (int, error) {
+	n, err := w.writer.Write(content)
+	if err == nil && w.flusher != nil {
+		w.flusher.Flush()
+	}
+	return n, err
+}
+
+// HttpWriter 直播转为fmp4通过http传输 可直接用于MSE
+type HttpWriter struct {
+	muxer       *Muxer
+	packetQueue chan *av.Packet
+	ctx         context.Context
+	cancelFn    context.CancelFunc
+	closeOnce   sync.Once
+}
+
+// NewHttpWriter perFrame每个视频帧一个分片 否则每个gop一个分片
+func NewHttpWriter(writer http.ResponseWriter, perFrame bool) *HttpWriter {
+	flusher, _ := writer.(http.Flusher)
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	muxer := NewMuxer(&httpWriterWrapper{
+		writer:  writer,
+		flusher: flusher,
+	})
+	muxer.SetFragmentPerFrame(perFrame)
+	ret := &HttpWriter{
+		muxer:       muxer,
+		packetQueue: make(chan *av.Packet, maxQueueNum),
+		ctx:         ctx,
+		cancelFn:    cancelFunc,
+		closeOnce:   sync.Once{},
+	}
+	go ret.muxPacket()
+	return ret
+}
+
+func (w *HttpWriter) WritePacket(p *av.Packet) error {
+	if err := w.ctx.Err(); err != nil {
+		return err
+	}
+	return threadutil.RunSafe(func() {
+		if p.IsAudio {
+			w.packetQueue <- p.Copy()
+			return
+		}
+		if p.IsVideo {
+			videoPkt, ok := p.Header.(av.VideoPacketHeader)
+			if ok {
+				if videoPkt.IsSeq() || videoPkt.IsKeyFrame() {
+					w.packetQueue <- p.Copy()
+					return
+				}
+			}
+		}
+		select {
+		case w.packetQueue <- p.Copy():
+		default:
+		}
+	})
+}
+
+func (w *HttpWriter) muxPacket() {
+	defer w.Close()
+	for {
+		select {
+		case p, ok := <-w.packetQueue:
+			if !ok {
+				return
+			}
+			if err := w.muxer.WritePacket(p); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (w *HttpWriter) ViewerType() string {
+	return ViewerType
+}
+
+func (w *HttpWriter) Close() {
+	w.closeOnce.Do(func() {
+		w.cancelFn()
+		close(w.packetQueue)
+	})
+}
+
+// Wait 等待连接断开或推流结束
+func (w *HttpWriter) Wait() {
+	<-w.ctx.Done()
+}
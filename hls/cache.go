@@ -11,8 +11,9 @@ import (
 )
 
 const (
-	maxTsCacheNum = 10
-	dirPrefix     = "./hlstmp/"
+	maxTsCacheNum    = 10
+	dirPrefix        = "./hlstmp/"
+	defaultBandwidth = 1000000
 
 	encryptFlag = true
 )
@@ -56,6 +57,7 @@ type TsCache struct {
 	itemList     []string
 	itemMap      map[string]TsItem
 	util         cryptoutil.Crypto
+	bandwidth    int
 }
 
 func NewTsCache(app, name string) *TsCache {
@@ -154,24 +156,48 @@ func (t *TsCache) SetItem(duration, seqNum int, b []byte) {
 	}
 	t.itemMap[tsName] = item
 	t.itemList[t.index] = tsName
+	if duration > 0 {
+		// 按分片估算码率 用于master m3u8
+		bandwidth := len(b) * 8 * 1000 / duration
+		if bandwidth > t.bandwidth {
+			t.bandwidth = bandwidth
+		}
+	}
 	if SaveFileFlag {
 		// save m3u8
-		t.saveFileContent(t.m3u8Path, t.genM3U8PlayList())
+		saveFileContent(t.m3u8Path, t.genM3U8PlayList())
+		if SubtitleFlag {
+			saveFileContent(t.tsPathPrefix+masterM3u8Name, genMasterPlayList(t.name, t.getBandwidth(), true))
+		}
 		// save ts
 		if encryptFlag {
-			t.saveFileContent(dirPrefix+tsName, t.encryptTs(b))
+			saveFileContent(dirPrefix+tsName, t.encryptTs(b))
 		} else {
-			t.saveFileContent(dirPrefix+tsName, b)
+			saveFileContent(dirPrefix+tsName, b)
 		}
 	}
 }
 
+// Bandwidth 最大分片码率 bit/s
+func (t *TsCache) Bandwidth() int {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return t.getBandwidth()
+}
+
+func (t *TsCache) getBandwidth() int {
+	if t.bandwidth == 0 {
+		return defaultBandwidth
+	}
+	return t.bandwidth
+}
+
 func (t *TsCache) encryptTs(b []byte) []byte {
 	ret, _ := t.util.Encrypt(b)
 	return ret
 }
 
-func (t *TsCache) saveFileContent(fileName string, content []byte) error {
+func saveFileContent(fileName string, content []byte) error {
 	f, err := os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0755)
 	if err != nil {
 		return err
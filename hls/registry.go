@@ -1,6 +1,7 @@
 package hls
 
 import (
+	"github.com/LeeZXin/zsf-utils/quit"
 	"os"
 	"sync"
 )
@@ -8,6 +9,8 @@ import (
 var (
 	rmu      = sync.RWMutex{}
 	registry = make(map[string]*StreamWriter, 8)
+	// hookOnce 只注册一次关闭hook 由registry关闭所有writer
+	hookOnce = sync.Once{}
 )
 
 func registerStreamWriter(writer *StreamWriter) {
@@ -16,13 +19,51 @@ func registerStreamWriter(writer *StreamWriter) {
 	}
 	rmu.Lock()
 	defer rmu.Unlock()
+	addShutdownHook()
 	registry[writer.name] = writer
 }
 
-func deregisterStreamWriter(name string) {
+func addShutdownHook() {
+	hookOnce.Do(func() {
+		quit.AddShutdownHook(closeAllStreamWriter)
+	})
+}
+
+// closeAllStreamWriter 进程退出时关闭
+func closeAllStreamWriter() {
+	rmu.RLock()
+	writers := make([]*StreamWriter, 0, len(registry))
+	for _, writer := range registry {
+		writers = append(writers, writer)
+	}
+	rmu.RUnlock()
+	// Close会注销自己 不能持有锁
+	for _, writer := range writers {
+		writer.Close()
+	}
+}
+
+func deregisterStreamWriter(writer *StreamWriter) {
 	rmu.Lock()
 	defer rmu.Unlock()
-	delete(registry, name)
+	// 懒加载模式下同名writer可能已被重新创建
+	if registry[writer.name] == writer {
+		delete(registry, writer.name)
+	}
+}
+
+// LoadOrNewLazyStreamWriter 懒加载模式 首次请求m3u8时创建
+// 返回的bool表示是否新创建 新创建的writer需注册到推流端
+func LoadOrNewLazyStreamWriter(app, name string) (*StreamWriter, bool) {
+	rmu.Lock()
+	defer rmu.Unlock()
+	if ret, ok := registry[app+"/"+name]; ok {
+		return ret, false
+	}
+	addShutdownHook()
+	ret := newStreamWriter(app, name, IdleTimeout(app))
+	registry[ret.name] = ret
+	return ret, true
 }
 
 func FindStreamWriter(name string) (*StreamWriter, bool) {
@@ -0,0 +1,188 @@
+package hls
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"github.com/LeeZXin/zsf-utils/quit"
+	"github.com/LeeZXin/zsf-utils/taskutil"
+	"github.com/LeeZXin/zsf/logger"
+	"github.com/LeeZXin/zsf/property/static"
+	"github.com/google/uuid"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SessionParam = "sid"
+	ViewerType   = "hls"
+
+	ParamSessionMode       = "param"
+	FingerprintSessionMode = "fingerprint"
+
+	defaultSessionTimeout = 20 * time.Second
+)
+
+/*
+hls观看会话
+hls本身无状态 通过m3u8里注入的sid参数或客户端指纹区分观众
+一段时间没有请求则认为会话结束
+*/
+var (
+	sessionMu  = sync.RWMutex{}
+	sessionMap = make(map[string]*ViewerSession, 8)
+
+	SessionMode    string
+	sessionTimeout time.Duration
+)
+
+func init() {
+	SessionMode = static.GetString("hls.session.mode")
+	if SessionMode != FingerprintSessionMode {
+		SessionMode = ParamSessionMode
+	}
+	sessionTimeout = time.Duration(static.GetInt("hls.session.timeout")) * time.Second
+	if sessionTimeout <= 0 {
+		sessionTimeout = defaultSessionTimeout
+	}
+	// 定时清除过期会话
+	task, _ := taskutil.NewPeriodicalTask(5*time.Second, checkExpiredSession)
+	task.Start()
+	quit.AddShutdownHook(func() {
+		task.Stop()
+	})
+}
+
+// ViewerSession 单个观众会话
+type ViewerSession struct {
+	Id         string    `json:"id"`
+	Key        string    `json:"key"`
+	ClientIp   string    `json:"clientIp"`
+	UserAgent  string    `json:"userAgent"`
+	StartTime  time.Time `json:"startTime"`
+	LastActive time.Time `json:"lastActive"`
+	EndTime    time.Time `json:"endTime"`
+	BytesSent  int64     `json:"bytesSent"`
+	Segments   int       `json:"segments"`
+}
+
+// NewSessionId 生成会话id
+func NewSessionId() string {
+	return strings.ReplaceAll(uuid.NewString(), "-", "")
+}
+
+// FingerprintSessionId 根据客户端信息生成会话id
+func FingerprintSessionId(key, clientIp, userAgent string) string {
+	sum := sha1.Sum([]byte(key + "|" + clientIp + "|" + userAgent))
+	return hex.EncodeToString(sum[:10])
+}
+
+// TouchSession 记录一次请求 不存在则创建会话
+func TouchSession(id, key, clientIp, userAgent string, bytesSent int, isSegment bool) {
+	if id == "" {
+		return
+	}
+	now := time.Now()
+	sessionMu.Lock()
+	defer sessionMu.Unlock()
+	session, ok := sessionMap[id]
+	if !ok || session.Key != key {
+		session = &ViewerSession{
+			Id:        id,
+			Key:       key,
+			ClientIp:  clientIp,
+			UserAgent: userAgent,
+			StartTime: now,
+		}
+		sessionMap[id] = session
+	}
+	session.LastActive = now
+	session.BytesSent += int64(bytesSent)
+	if isSegment {
+		session.Segments++
+	}
+}
+
+// ListSessions 获取流的观看会话
+func ListSessions(key string) []ViewerSession {
+	sessionMu.RLock()
+	defer sessionMu.RUnlock()
+	ret := make([]ViewerSession, 0)
+	for _, session := range sessionMap {
+		if session.Key == key {
+			ret = append(ret, *session)
+		}
+	}
+	return ret
+}
+
+// ViewerCount 当前hls观看人数
+func ViewerCount(key string) int {
+	sessionMu.RLock()
+	defer sessionMu.RUnlock()
+	ret := 0
+	for _, session := range sessionMap {
+		if session.Key == key {
+			ret++
+		}
+	}
+	return ret
+}
+
+func checkExpiredSession() {
+	now := time.Now()
+	expired := make([]*ViewerSession, 0)
+	sessionMu.Lock()
+	for id, session := range sessionMap {
+		if now.Sub(session.LastActive) > sessionTimeout {
+			session.EndTime = session.LastActive
+			expired = append(expired, session)
+			delete(sessionMap, id)
+		}
+	}
+	sessionMu.Unlock()
+	for _, session := range expired {
+		logger.Logger.Infof("hls session end id: %s key: %s ip: %s duration: %v bytes: %d segments: %d",
+			session.Id, session.Key, session.ClientIp, session.EndTime.Sub(session.StartTime), session.BytesSent, session.Segments)
+	}
+}
+
+// InjectSessionId 将sid注入m3u8中的uri
+func InjectSessionId(body []byte, id string) []byte {
+	ret := bytes.NewBuffer(nil)
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			ret.WriteString("\n")
+			continue
+		}
+		if !strings.HasPrefix(line, "#") {
+			ret.WriteString(appendSessionId(line, id))
+		} else if start := strings.Index(line, "URI=\""); start >= 0 {
+			start += len("URI=\"")
+			end := strings.Index(line[start:], "\"")
+			if end >= 0 {
+				ret.WriteString(line[:start])
+				ret.WriteString(appendSessionId(line[start:start+end], id))
+				ret.WriteString(line[start+end:])
+			} else {
+				ret.WriteString(line)
+			}
+		} else {
+			ret.WriteString(line)
+		}
+		ret.WriteString("\n")
+	}
+	return ret.Bytes()
+}
+
+func appendSessionId(uri, id string) string {
+	if strings.Contains(uri, "?") {
+		return uri + "&" + SessionParam + "=" + url.QueryEscape(id)
+	}
+	return uri + "?" + SessionParam + "=" + url.QueryEscape(id)
+}
@@ -4,14 +4,17 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"github.com/LeeZXin/z-live/amf"
 	"github.com/LeeZXin/z-live/av"
 	"github.com/LeeZXin/z-live/flv"
 	"github.com/LeeZXin/z-live/hls/ts"
 	"github.com/LeeZXin/z-live/parser"
-	"github.com/LeeZXin/zsf-utils/quit"
 	"github.com/LeeZXin/zsf-utils/threadutil"
+	"github.com/LeeZXin/zsf/logger"
 	"github.com/LeeZXin/zsf/property/static"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -20,6 +23,13 @@ const (
 	maxQueueNum          = 512
 	h264DefaultHz uint64 = 90
 	duration             = 3000
+
+	defaultIdleTimeout = 30 * time.Second
+)
+
+const (
+	EagerMode = "eager"
+	LazyMode  = "lazy"
 )
 
 var (
@@ -28,6 +38,7 @@ var (
 
 func init() {
 	SaveFileFlag = static.GetBool("hls.saveFile")
+	SubtitleFlag = static.GetBool("hls.subtitle")
 }
 
 var (
@@ -45,6 +56,7 @@ const (
 // StreamWriter 实现hls m3u8 ts转换
 type StreamWriter struct {
 	name        string
+	shortName   string
 	seq         int
 	bwriter     *bytes.Buffer
 	btswriter   *bytes.Buffer
@@ -54,21 +66,54 @@ type StreamWriter struct {
 	align       *align
 	audioCache  *audioCache
 	tsCache     *TsCache
+	subtitle    *subtitleWriter
 	tsParser    *parser.CodecParser
 	packetQueue chan *av.Packet
 	ctx         context.Context
 	cancelFn    context.CancelFunc
 	closeOnce   sync.Once
+	// lastAccess 最后一次请求m3u8的时间 懒加载模式下用于判断空闲
+	lastAccess atomic.Int64
 
 	firstCut bool
 }
 
+// IsLazyApp app是否按需生成hls
+// 配置hls.apps.{app}.mode 未配置时取hls.mode
+func IsLazyApp(app string) bool {
+	mode := static.GetString("hls.apps." + app + ".mode")
+	if mode == "" {
+		mode = static.GetString("hls.mode")
+	}
+	return mode == LazyMode
+}
+
+// IdleTimeout 懒加载模式下多久没有请求m3u8就停止生成hls
+func IdleTimeout(app string) time.Duration {
+	timeout := static.GetInt("hls.apps." + app + ".idleTimeout")
+	if timeout <= 0 {
+		timeout = static.GetInt("hls.idleTimeout")
+	}
+	if timeout <= 0 {
+		return defaultIdleTimeout
+	}
+	return time.Duration(timeout) * time.Second
+}
+
+// NewStreamWriter 推流时立即生成hls
 func NewStreamWriter(app, name string) *StreamWriter {
+	w := newStreamWriter(app, name, 0)
+	registerStreamWriter(w)
+	return w
+}
+
+func newStreamWriter(app, name string, idleTimeout time.Duration) *StreamWriter {
 	ctx, cancelFunc := context.WithCancel(context.Background())
 	bwriter := bytes.NewBuffer(make([]byte, 100*1024))
 	btswriter := bytes.NewBuffer(nil)
 	w := &StreamWriter{
 		name:        app + "/" + name,
+		shortName:   name,
 		align:       &align{},
 		stat:        newStatus(),
 		audioCache:  newAudioCache(),
@@ -82,18 +127,74 @@ func NewStreamWriter(app, name string) *StreamWriter {
 		cancelFn:    cancelFunc,
 		closeOnce:   sync.Once{},
 	}
-	registerStreamWriter(w)
-	quit.AddShutdownHook(func() {
-		w.Close()
-	})
+	if SubtitleFlag {
+		w.subtitle = newSubtitleWriter(app, name)
+	}
+	w.Touch()
 	go w.muxPacket()
+	if idleTimeout > 0 {
+		go w.checkIdle(idleTimeout)
+	}
 	return w
 }
 
+// Touch 记录m3u8请求时间
+func (w *StreamWriter) Touch() {
+	w.lastAccess.Store(time.Now().UnixMilli())
+}
+
+// Context writer关闭时结束
+func (w *StreamWriter) Context() context.Context {
+	return w.ctx
+}
+
+// checkIdle 空闲超时关闭
+func (w *StreamWriter) checkIdle(timeout time.Duration) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.ctx.Done():
+			return
+		case <-ticker.C:
+			if time.Since(time.UnixMilli(w.lastAccess.Load())) > timeout {
+				logger.Logger.Infof("hls %s idle for %v, stop packaging", w.name, timeout)
+				w.Close()
+				return
+			}
+		}
+	}
+}
+
 func (w *StreamWriter) GetM3u8Body() []byte {
 	return w.tsCache.GenM3U8PlayList()
 }
 
+// GetMasterM3u8Body master m3u8 开启字幕时包含字幕rendition
+func (w *StreamWriter) GetMasterM3u8Body() []byte {
+	return genMasterPlayList(w.shortName, w.tsCache.Bandwidth(), w.subtitle != nil)
+}
+
+// GetSubtitleM3u8Body 字幕m3u8
+func (w *StreamWriter) GetSubtitleM3u8Body() []byte {
+	if w.subtitle == nil {
+		return []byte{}
+	}
+	return w.subtitle.GenM3U8PlayList()
+}
+
+// GetVttBody 获取vtt分片
+func (w *StreamWriter) GetVttBody(vtt string) []byte {
+	if w.subtitle == nil {
+		return []byte{}
+	}
+	item, err := w.subtitle.GetItem(vtt)
+	if err != nil {
+		return []byte{}
+	}
+	return item
+}
+
 func (w *StreamWriter) GetTsBody(ts string) []byte {
 	item, err := w.tsCache.GetItem(ts)
 	if err != nil {
@@ -141,6 +242,7 @@ func (w *StreamWriter) muxPacket() {
 				return
 			}
 			if p.IsMetadata {
+				w.handleScriptData(p)
 				continue
 			}
 			err := flv.Demux(p)
@@ -154,6 +256,11 @@ func (w *StreamWriter) muxPacket() {
 			if err != nil || isSeq {
 				continue
 			}
+			if p.IsVideo && w.subtitle != nil {
+				if ccData := w.tsParser.CCData(); len(ccData) > 0 {
+					w.subtitle.addCCData(ccData, int64(p.Timestamp)+int64(compositionTime))
+				}
+			}
 			w.stat.update(p.Timestamp)
 			w.calcPtsDts(p.IsVideo, p.Timestamp, uint32(compositionTime))
 			w.tsMux(p)
@@ -164,7 +271,7 @@ func (w *StreamWriter) muxPacket() {
 func (w *StreamWriter) Close() {
 	w.closeOnce.Do(func() {
 		w.cancelFn()
-		deregisterStreamWriter(w.name)
+		deregisterStreamWriter(w)
 		close(w.packetQueue)
 	})
 }
@@ -183,12 +290,35 @@ func (w *StreamWriter) flush2Cache() {
 	w.flushAudio()
 	w.seq++
 	w.tsCache.SetItem(int(w.stat.durationMs()), w.seq, w.btswriter.Bytes())
+	if w.subtitle != nil {
+		w.subtitle.flush(w.seq, w.stat.firstTimestamp, w.stat.lastTimestamp)
+	}
 	w.btswriter.Reset()
 	w.stat.resetAndNew()
 	w.muxer.WritePAT()
 	w.muxer.WritePMT(av.SOUND_AAC, true)
 }
 
+// handleScriptData 处理onTextData字幕
+func (w *StreamWriter) handleScriptData(p *av.Packet) {
+	if w.subtitle == nil {
+		return
+	}
+	vs, _ := amf.NewDecoder().DecodeBatch(bytes.NewReader(p.Data), amf.AMF0)
+	if len(vs) > 0 && vs[0] == amf.SetDataFrame {
+		vs = vs[1:]
+	}
+	if len(vs) < 2 || vs[0] != amf.OnTextData {
+		return
+	}
+	obj, ok := vs[1].(amf.Object)
+	if !ok {
+		return
+	}
+	text, _ := obj["text"].(string)
+	w.subtitle.addTextData(text, int64(p.Timestamp))
+}
+
 func (w *StreamWriter) parse(p *av.Packet) (int32, bool, error) {
 	var compositionTime int32
 	var ah av.AudioPacketHeader
@@ -0,0 +1,219 @@
+package hls
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/LeeZXin/z-live/parser/caption"
+	"sync"
+)
+
+const (
+	subtitleM3u8Name = "subtitles.m3u8"
+	masterM3u8Name   = "master.m3u8"
+	subtitleGroupId  = "subs"
+	// textDataDuration onTextData没有结束时间 默认展示4秒
+	textDataDuration = 4000
+	mpegTsMaxPts     = 1 << 33
+)
+
+var (
+	SubtitleFlag bool
+)
+
+/*
+webvtt字幕
+从h264 sei中的cea-608/708和onTextData提取
+按ts分片切割 通过X-TIMESTAMP-MAP与ts对齐
+*/
+type subtitleWriter struct {
+	lock     sync.RWMutex
+	index    int
+	key      string
+	m3u8Path string
+	decoder  *caption.Decoder
+	cues     []caption.Cue
+	textData *caption.Cue
+	itemList []string
+	itemMap  map[string]*vttItem
+}
+
+type vttItem struct {
+	Name     string
+	SeqNum   int
+	Duration int
+	Data     []byte
+}
+
+func newSubtitleWriter(app, name string) *subtitleWriter {
+	key := app + "/" + name
+	return &subtitleWriter{
+		lock:     sync.RWMutex{},
+		index:    -1,
+		key:      key,
+		m3u8Path: dirPrefix + key + "/" + subtitleM3u8Name,
+		decoder:  caption.NewDecoder(),
+		itemList: make([]string, maxTsCacheNum),
+		itemMap:  make(map[string]*vttItem),
+	}
+}
+
+// addCCData 添加sei中的字幕数据 pts单位毫秒
+func (s *subtitleWriter) addCCData(ccData []byte, pts int64) {
+	s.decoder.Decode(ccData, pts)
+	s.cues = append(s.cues, s.decoder.PopCues()...)
+}
+
+// addTextData 添加onTextData字幕
+func (s *subtitleWriter) addTextData(text string, ts int64) {
+	if s.textData != nil {
+		if s.textData.End > ts {
+			s.textData.End = ts
+		}
+		if s.textData.End > s.textData.Start {
+			s.cues = append(s.cues, *s.textData)
+		}
+		s.textData = nil
+	}
+	if text == "" {
+		return
+	}
+	s.textData = &caption.Cue{
+		Start: ts,
+		End:   ts + textDataDuration,
+		Text:  text,
+	}
+}
+
+// flush 生成与ts分片对应的vtt分片
+func (s *subtitleWriter) flush(seqNum int, start, end int64) {
+	if s.textData != nil && s.textData.End <= end {
+		s.cues = append(s.cues, *s.textData)
+		s.textData = nil
+	}
+	segCues := make([]caption.Cue, 0, len(s.cues)+2)
+	remain := s.cues[:0]
+	for _, cue := range s.cues {
+		if cue.Start < end && cue.End > start {
+			segCues = append(segCues, cue)
+		}
+		// 跨分片的字幕在下个分片继续出现
+		if cue.End > end {
+			remain = append(remain, cue)
+		}
+	}
+	s.cues = remain
+	if cue, ok := s.decoder.Pending(end); ok {
+		segCues = append(segCues, cue)
+	}
+	if s.textData != nil && s.textData.Start < end {
+		cue := *s.textData
+		cue.End = end
+		segCues = append(segCues, cue)
+	}
+	s.setItem(int(end-start), seqNum, genWebVtt(start, segCues))
+}
+
+func (s *subtitleWriter) setItem(duration, seqNum int, b []byte) {
+	// /live/movie/1.vtt
+	vttName := fmt.Sprintf("/%s/%d.vtt", s.key, seqNum)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.index = (s.index + 1) % maxTsCacheNum
+	delete(s.itemMap, s.itemList[s.index])
+	s.itemMap[vttName] = &vttItem{
+		Name:     vttName,
+		SeqNum:   seqNum,
+		Duration: duration,
+		Data:     b,
+	}
+	s.itemList[s.index] = vttName
+	if SaveFileFlag {
+		saveFileContent(s.m3u8Path, s.genM3U8PlayList())
+		saveFileContent(dirPrefix+vttName, b)
+	}
+}
+
+func (s *subtitleWriter) GenM3U8PlayList() []byte {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.genM3U8PlayList()
+}
+
+func (s *subtitleWriter) genM3U8PlayList() []byte {
+	var seq int
+	var getSeq bool
+	var maxDuration int
+	ret := bytes.NewBuffer(nil)
+	order := make([]int, 0, maxTsCacheNum)
+	if s.itemList[maxTsCacheNum-1] != "" {
+		for i := s.index + 1; i < maxTsCacheNum; i++ {
+			order = append(order, i)
+		}
+	}
+	for i := 0; i <= s.index; i++ {
+		order = append(order, i)
+	}
+	for _, i := range order {
+		v, ok := s.itemMap[s.itemList[i]]
+		if !ok {
+			continue
+		}
+		if v.Duration > maxDuration {
+			maxDuration = v.Duration
+		}
+		if !getSeq {
+			getSeq = true
+			seq = v.SeqNum
+		}
+		fmt.Fprintf(ret, "#EXTINF:%.3f,\n%s\n", float64(v.Duration)/float64(1000), v.Name)
+	}
+	w := bytes.NewBuffer(nil)
+	fmt.Fprintf(w,
+		"#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-ALLOW-CACHE:NO\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:%d\n\n",
+		maxDuration/1000+1,
+		seq)
+	w.Write(ret.Bytes())
+	return w.Bytes()
+}
+
+func (s *subtitleWriter) GetItem(key string) ([]byte, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	item, ok := s.itemMap[key]
+	if !ok {
+		return nil, ErrNoKey
+	}
+	return item.Data, nil
+}
+
+// genWebVtt 生成vtt分片 cue时间与ts的pts一致
+func genWebVtt(start int64, cues []caption.Cue) []byte {
+	w := bytes.NewBuffer(nil)
+	fmt.Fprintf(w, "WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:%d,LOCAL:%s\n\n", (uint64(start)*h264DefaultHz)%mpegTsMaxPts, formatVttTime(start))
+	for _, cue := range cues {
+		fmt.Fprintf(w, "%s --> %s\n%s\n\n", formatVttTime(cue.Start), formatVttTime(cue.End), cue.Text)
+	}
+	return w.Bytes()
+}
+
+func formatVttTime(ms int64) string {
+	if ms < 0 {
+		ms = 0
+	}
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// genMasterPlayList master m3u8 没有字幕时不声明字幕rendition 避免播放器请求空的字幕m3u8
+func genMasterPlayList(name string, bandwidth int, hasSubtitle bool) []byte {
+	w := bytes.NewBuffer(nil)
+	fmt.Fprintf(w, "#EXTM3U\n#EXT-X-VERSION:3\n")
+	if !hasSubtitle {
+		fmt.Fprintf(w, "#EXT-X-STREAM-INF:BANDWIDTH=%d\n%s.m3u8\n", bandwidth, name)
+		return w.Bytes()
+	}
+	fmt.Fprintf(w,
+		"#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID=\"%s\",NAME=\"CC1\",LANGUAGE=\"und\",DEFAULT=YES,AUTOSELECT=YES,FORCED=NO,URI=\"%s\"\n",
+		subtitleGroupId, subtitleM3u8Name)
+	fmt.Fprintf(w, "#EXT-X-STREAM-INF:BANDWIDTH=%d,SUBTITLES=\"%s\"\n%s.m3u8\n", bandwidth, subtitleGroupId, name)
+	return w.Bytes()
+}
@@ -180,19 +180,29 @@ func (m *Muxer) WritePAT() error {
 }
 
 func (m *Muxer) WritePMT(soundFormat byte, hasVideo bool) error {
+	return m.WritePMTStreams(soundFormat, true, hasVideo)
+}
+
+// WritePMTStreams 只声明存在的音视频流 没有视频时pcr在音频流上
+func (m *Muxer) WritePMTStreams(soundFormat byte, hasAudio, hasVideo bool) error {
 	i := 0
 	j := 0
 	var progInfo []byte
 	remainBytes := 0
 	tsHeader := []byte{0x47, 0x50, 0x01, 0x10, 0x00}
 	pmtHeader := []byte{0x02, 0xb0, 0xff, 0x00, 0x01, 0xc1, 0x00, 0x00, 0xe1, 0x00, 0xf0, 0x00}
-	if !hasVideo {
-		pmtHeader[9] = 0x01
-		progInfo = []byte{0x0f, 0xe1, 0x01, 0xf0, 0x00}
+	if hasVideo {
+		progInfo = append(progInfo, 0x1b, 0xe1, 0x00, 0xf0, 0x00) //h264 or h265*
 	} else {
-		progInfo = []byte{0x1b, 0xe1, 0x00, 0xf0, 0x00, //h264 or h265*
-			0x0f, 0xe1, 0x01, 0xf0, 0x00, //mp3 or aac
+		pmtHeader[9] = 0x01
+	}
+	if hasAudio {
+		streamType := byte(0x0f) //mp3 or aac
+		if soundFormat == 2 ||
+			soundFormat == 14 {
+			streamType = 0x4
 		}
+		progInfo = append(progInfo, streamType, 0xe1, 0x01, 0xf0, 0x00)
 	}
 	pmtHeader[2] = byte(len(progInfo) + 9 + 4)
 	if m.pmtCc > 0xf {
@@ -200,14 +210,6 @@ func (m *Muxer) WritePMT(soundFormat byte, hasVideo bool) error {
 	}
 	tsHeader[3] |= m.pmtCc & 0x0f
 	m.pmtCc++
-	if soundFormat == 2 ||
-		soundFormat == 14 {
-		if hasVideo {
-			progInfo[5] = 0x4
-		} else {
-			progInfo[0] = 0x4
-		}
-	}
 	copy(m.pmt[i:], tsHeader)
 	i += len(tsHeader)
 	copy(m.pmt[i:], pmtHeader)
@@ -0,0 +1,253 @@
+package httpserver
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"github.com/LeeZXin/z-live/channel"
+	"github.com/LeeZXin/z-live/record"
+	"github.com/LeeZXin/z-live/rtmp"
+	"github.com/LeeZXin/z-live/timeshift"
+	"github.com/LeeZXin/zsf-utils/quit"
+	"github.com/LeeZXin/zsf/logger"
+	"github.com/LeeZXin/zsf/property/static"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ApiServer 管理接口
+录制的开始、停止、查询 虚拟直播频道的开始、停止、查询 时移片段导出
+*/
+type ApiServer struct {
+	addr   string
+	engine *gin.Engine
+
+	startOnce sync.Once
+}
+
+func NewApiServer(addr string) *ApiServer {
+	gin.SetMode(gin.ReleaseMode)
+	engine := gin.New()
+	engine.Use(apiAuthorize)
+	// 录制
+	engine.POST("/record/start", handleRecordStart)
+	engine.POST("/record/stop", handleRecordStop)
+	engine.GET("/record/status", handleRecordStatus)
+	engine.GET("/record/list", handleRecordList)
+	// 虚拟直播频道
+	engine.POST("/channel/start", handleChannelStart)
+	engine.POST("/channel/stop", handleChannelStop)
+	engine.GET("/channel/list", handleChannelList)
+	// 时移缓存和导出片段
+	engine.GET("/timeshift/status", handleTimeshiftStatus)
+	engine.GET("/timeshift/list", handleTimeshiftList)
+	engine.POST("/timeshift/clip", handleTimeshiftClip)
+	return &ApiServer{
+		addr:   addr,
+		engine: engine,
+
+		startOnce: sync.Once{},
+	}
+}
+
+// apiAuthorize 管理接口的bearer token鉴权 配置api.token为空时不鉴权
+func apiAuthorize(c *gin.Context) {
+	token := static.GetString("api.token")
+	if token == "" {
+		return
+	}
+	bearer, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+		c.AbortWithStatus(http.StatusUnauthorized)
+	}
+}
+
+func (s *ApiServer) ListenAndServe() {
+	s.startOnce.Do(func() {
+		logger.Logger.Info("listen api http server: ", s.addr)
+		server := &http.Server{
+			Addr:         s.addr,
+			ReadTimeout:  30 * time.Second,
+			WriteTimeout: 30 * time.Second,
+			IdleTimeout:  30 * time.Second,
+			Handler:      s.engine,
+		}
+		go func() {
+			quit.AddShutdownHook(func() {
+				logger.Logger.Info("shutdown api http server")
+				server.Shutdown(context.Background())
+			})
+			err := server.ListenAndServe()
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Logger.Panic(err.Error())
+			}
+		}()
+	})
+}
+
+// handleRecordStart 开始录制 从下一个关键帧开始
+// 参数key=live/demo 可选format=flv|ts|fmp4
+func handleRecordStart(c *gin.Context) {
+	key := c.Query("key")
+	app, name, ok := strings.Cut(key, "/")
+	if !ok || app == "" || name == "" {
+		c.String(http.StatusBadRequest, "invalid arguments")
+		return
+	}
+	pub, ok := rtmp.FindPublisher(key)
+	if !ok {
+		c.String(http.StatusNotFound, "stream not found")
+		return
+	}
+	config := record.GetConfig(app)
+	if format := c.Query("format"); format != "" {
+		switch format {
+		case record.FlvFormat, record.TsFormat, record.Fmp4Format:
+			config.Format = format
+		default:
+			c.String(http.StatusBadRequest, "invalid format")
+			return
+		}
+	}
+	recorder, err := record.Start(app, name, config)
+	if err != nil {
+		c.String(http.StatusConflict, err.Error())
+		return
+	}
+	// 推流已经结束 移除recorder
+	if !pub.RegisterFromKeyFrame(recorder) {
+		recorder.Close()
+		c.String(http.StatusNotFound, "stream not found")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data": recorder.Status(),
+	})
+}
+
+// handleRecordStop 停止录制 文件在后台写完 返回202和当前状态 finishing表示还在写文件 写完后回调
+func handleRecordStop(c *gin.Context) {
+	key := c.Query("key")
+	recorder, ok := record.Find(key)
+	if !ok {
+		c.String(http.StatusNotFound, record.ErrNotRecording.Error())
+		return
+	}
+	// 先从推流端移除 再关闭
+	if pub, ok := rtmp.FindPublisher(key); ok {
+		pub.Deregister(recorder)
+	}
+	if _, err := record.Stop(key); err != nil {
+		c.String(http.StatusNotFound, err.Error())
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{
+		"data": recorder.Status(),
+	})
+}
+
+func handleRecordStatus(c *gin.Context) {
+	recorder, ok := record.Find(c.Query("key"))
+	if !ok {
+		c.String(http.StatusNotFound, record.ErrNotRecording.Error())
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data": recorder.Status(),
+	})
+}
+
+func handleRecordList(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"data": record.List(),
+	})
+}
+
+// handleChannelStart 开始虚拟直播频道 body为channel.Config
+func handleChannelStart(c *gin.Context) {
+	var config channel.Config
+	if err := c.ShouldBindJSON(&config); err != nil {
+		c.String(http.StatusBadRequest, "invalid arguments")
+		return
+	}
+	ch, err := channel.Start(config)
+	if err != nil {
+		switch {
+		case errors.Is(err, channel.ErrInvalidConfig):
+			c.String(http.StatusBadRequest, err.Error())
+		case errors.Is(err, channel.ErrChannelExists), errors.Is(err, rtmp.ErrPublisherExists):
+			c.String(http.StatusConflict, err.Error())
+		default:
+			c.String(http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data": ch.Status(),
+	})
+}
+
+func handleChannelStop(c *gin.Context) {
+	if err := channel.Stop(c.Query("key")); err != nil {
+		c.String(http.StatusNotFound, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data": nil,
+	})
+}
+
+func handleChannelList(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"data": channel.List(),
+	})
+}
+
+func handleTimeshiftStatus(c *gin.Context) {
+	buffer, ok := timeshift.Find(c.Query("key"))
+	if !ok {
+		c.String(http.StatusNotFound, "stream not found")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data": buffer.Status(),
+	})
+}
+
+func handleTimeshiftList(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"data": timeshift.List(),
+	})
+}
+
+// handleTimeshiftClip 导出片段 参数key start end为直播中的时间戳 单位毫秒 可选format=flv|mp4
+func handleTimeshiftClip(c *gin.Context) {
+	buffer, ok := timeshift.Find(c.Query("key"))
+	if !ok {
+		c.String(http.StatusNotFound, "stream not found")
+		return
+	}
+	start, err1 := strconv.ParseUint(c.Query("start"), 10, 32)
+	end, err2 := strconv.ParseUint(c.Query("end"), 10, 32)
+	if err1 != nil || err2 != nil {
+		c.String(http.StatusBadRequest, "invalid arguments")
+		return
+	}
+	info, err := buffer.ExportClip(uint32(start), uint32(end), c.Query("format"))
+	if err != nil {
+		if errors.Is(err, timeshift.ErrInvalidRange) || errors.Is(err, timeshift.ErrNoData) {
+			c.String(http.StatusBadRequest, err.Error())
+		} else {
+			c.String(http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data": info,
+	})
+}
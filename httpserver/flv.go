@@ -3,15 +3,20 @@ package httpserver
 import (
 	"context"
 	"errors"
+	"github.com/LeeZXin/z-live/av"
 	"github.com/LeeZXin/z-live/flv"
 	"github.com/LeeZXin/z-live/rtmp"
+	"github.com/LeeZXin/z-live/timeshift"
+	"github.com/LeeZXin/z-live/vod"
 	"github.com/LeeZXin/zsf-utils/quit"
 	"github.com/LeeZXin/zsf-utils/threadutil"
 	"github.com/LeeZXin/zsf/logger"
 	"github.com/gin-gonic/gin"
 	"net/http"
+	"nhooyr.io/websocket"
 	"os"
 	"path"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -101,29 +106,158 @@ func handleFlvRequest(c *gin.Context) {
 		c.String(http.StatusBadRequest, "invalid path")
 		return
 	}
+	// 点播录制的文件
+	if name, ok := strings.CutPrefix(u, "/"+vod.App()+"/"); ok {
+		handleVodRequest(c, name)
+		return
+	}
 	key, err := parseFlv(u)
 	if err != nil {
 		c.String(http.StatusBadRequest, err.Error())
 		return
 	}
+	// 时移 从直播延迟offset秒处开始播放
+	if offset, _ := strconv.Atoi(c.Query("offset")); offset > 0 {
+		handleTimeshiftRequest(c, key, time.Duration(offset)*time.Second)
+		return
+	}
 	pub, ok := rtmp.FindPublisher(key)
 	if !ok {
 		c.String(http.StatusNotFound, "invalid path")
 		return
 	}
+	// 可选参数only=audio|video zeroTs=1 start=gop|keyframe
+	opts := flv.ParseOptions(c.Request.URL.Query())
+	// websocket-flv 同一地址升级为websocket
+	if strings.EqualFold(c.GetHeader("Upgrade"), "websocket") {
+		handleWsFlvRequest(c, pub, opts)
+		return
+	}
 	writer := c.Writer
 	writer.Header().Set("Access-Control-Allow-Origin", "*")
 	writer.Header().Set("Content-Type", "video/x-flv")
 	writer.Header().Set("Transfer-Encoding", "chunked")
 	writer.WriteHeader(http.StatusOK)
-	httpWriter, err := flv.NewHttpWriter(writer)
+	httpWriter, err := flv.NewHttpWriter(writer, opts)
 	if err != nil {
 		c.String(http.StatusInternalServerError, "init failed")
+		return
 	}
-	pub.Register(httpWriter)
+	registerFlvWriter(pub, httpWriter, opts)
 	httpWriter.Wait()
 }
 
+// registerFlvWriter 从最新关键帧开始时不发送gop缓存 推流已经结束时关闭writer
+func registerFlvWriter(pub rtmp.RegisterAction, writer rtmp.PacketWriter, opts flv.Options) {
+	var ok bool
+	if opts.FromKeyFrame {
+		ok = pub.RegisterFromKeyFrame(writer)
+	} else {
+		ok = pub.Register(writer)
+	}
+	if !ok {
+		writer.Close()
+	}
+}
+
+// handleWsFlvRequest websocket-flv 每个tag一个binary帧
+func handleWsFlvRequest(c *gin.Context, pub rtmp.RegisterAction, opts flv.Options) {
+	conn, err := websocket.Accept(c.Writer, c.Request, &websocket.AcceptOptions{
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return
+	}
+	wsWriter, err := flv.NewWsWriter(conn, opts)
+	if err != nil {
+		conn.Close(websocket.StatusInternalError, "init failed")
+		return
+	}
+	// 不接收客户端数据 对端关闭时结束
+	ctx := conn.CloseRead(context.Background())
+	go func() {
+		<-ctx.Done()
+		wsWriter.Close()
+	}()
+	registerFlvWriter(pub, wsWriter, opts)
+	wsWriter.Wait()
+}
+
+// handleVodRequest 点播 可选参数start开始时间 duration播放时长 单位秒
+func handleVodRequest(c *gin.Context, name string) {
+	filePath, ok := vod.FilePath(name)
+	if !ok {
+		c.String(http.StatusBadRequest, "invalid path")
+		return
+	}
+	start, _ := strconv.ParseFloat(c.Query("start"), 64)
+	duration, _ := strconv.ParseFloat(c.Query("duration"), 64)
+	writer := c.Writer
+	muxer := flv.NewMuxer(writer)
+	player, err := vod.NewPlayer(filePath, &vodResponseWriter{
+		muxer:   muxer,
+		flusher: writer,
+	}, int64(start*1000), int64(duration*1000))
+	if err != nil {
+		c.String(http.StatusNotFound, "invalid path")
+		return
+	}
+	writer.Header().Set("Access-Control-Allow-Origin", "*")
+	writer.Header().Set("Content-Type", "video/x-flv")
+	writer.Header().Set("Transfer-Encoding", "chunked")
+	writer.WriteHeader(http.StatusOK)
+	if err = muxer.WriteHeader(); err != nil {
+		player.Close()
+		return
+	}
+	go func() {
+		<-c.Request.Context().Done()
+		player.Close()
+	}()
+	if err = player.Run(); err != nil {
+		logger.Logger.Error(err)
+	}
+}
+
+// handleTimeshiftRequest 从时移缓存播放
+func handleTimeshiftRequest(c *gin.Context, key string, offset time.Duration) {
+	buffer, ok := timeshift.Find(key)
+	if !ok || buffer.Status().Packets == 0 {
+		c.String(http.StatusNotFound, "invalid path")
+		return
+	}
+	writer := c.Writer
+	writer.Header().Set("Access-Control-Allow-Origin", "*")
+	writer.Header().Set("Content-Type", "video/x-flv")
+	writer.Header().Set("Transfer-Encoding", "chunked")
+	writer.WriteHeader(http.StatusOK)
+	muxer := flv.NewMuxer(writer)
+	if err := muxer.WriteHeader(); err != nil {
+		return
+	}
+	err := buffer.Play(c.Request.Context(), offset, &vodResponseWriter{
+		muxer:   muxer,
+		flusher: writer,
+	})
+	if err != nil && !errors.Is(err, context.Canceled) {
+		logger.Logger.Error(err)
+	}
+}
+
+// vodResponseWriter 点播、时移已经按实际时间发送 直接写入response
+type vodResponseWriter struct {
+	muxer   *flv.Muxer
+	flusher http.Flusher
+}
+
+func (w *vodResponseWriter) WritePacket(p *av.Packet) error {
+	if err := w.muxer.WritePacket(p); err != nil {
+		return err
+	}
+	w.flusher.Flush()
+	return nil
+}
+
 func openHttpFlvHtml(url string) ([]byte, error) {
 	file, err := os.ReadFile("./resources/http-flv.html")
 	if err != nil {
@@ -4,12 +4,15 @@ import (
 	"context"
 	"errors"
 	"github.com/LeeZXin/z-live/hls"
+	"github.com/LeeZXin/z-live/rtmp"
+	"github.com/LeeZXin/z-live/timeshift"
 	"github.com/LeeZXin/zsf-utils/quit"
 	"github.com/LeeZXin/zsf-utils/threadutil"
 	"github.com/LeeZXin/zsf/logger"
 	"github.com/gin-gonic/gin"
 	"net/http"
 	"path"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -18,6 +21,16 @@ import (
 const (
 	m3u8Suffix = ".m3u8"
 	tsSuffix   = ".ts"
+	vttSuffix  = ".vtt"
+
+	masterM3u8   = "master.m3u8"
+	subtitleM3u8 = "subtitles.m3u8"
+
+	statViewersPath  = "/stat/viewers"
+	statSessionsPath = "/stat/sessions"
+
+	// timeshiftParam 时移延迟秒数
+	timeshiftParam = "offset"
 )
 
 var crossDomainXml = []byte(
@@ -91,6 +104,14 @@ func handleHlsRequest(c *gin.Context) {
 		c.Data(http.StatusOK, "application/octet-stream", hls.EncryptAesKey)
 		return
 	}
+	switch c.Request.URL.Path {
+	case statViewersPath:
+		handleViewerStat(c)
+		return
+	case statSessionsPath:
+		handleSessionStat(c)
+		return
+	}
 	switch path.Ext(c.Request.URL.Path) {
 	case m3u8Suffix:
 		filePath, key, err := parseM3u8(c.Request.URL.Path)
@@ -98,44 +119,170 @@ func handleHlsRequest(c *gin.Context) {
 			c.String(http.StatusBadRequest, err.Error())
 			return
 		}
-		if hls.SaveFileFlag {
-			c.Header("Access-Control-Allow-Origin", "*")
-			c.Header("Cache-Control", "no-audioCache")
-			c.Data(http.StatusOK, "application/x-mpegURL", hls.GetFileContent(filePath))
-		} else {
-			writer, ok := hls.FindStreamWriter(key)
+		// 时移 重定向到延迟offset秒的流 例如/live/demo@60/demo@60.m3u8
+		if offset, _ := strconv.Atoi(c.Query(timeshiftParam)); offset > 0 {
+			buffer, ok := timeshift.Find(key)
 			if !ok {
 				c.String(http.StatusNotFound, "not found")
 				return
 			}
-			c.Header("Access-Control-Allow-Origin", "*")
-			c.Header("Cache-Control", "no-audioCache")
-			c.Data(http.StatusOK, "application/x-mpegURL", writer.GetM3u8Body())
+			app, name, _ := strings.Cut(key, "/")
+			offset = int(buffer.NormalizeOffset(time.Duration(offset)*time.Second) / time.Second)
+			shiftName := timeshift.ShiftName(name, offset)
+			query := c.Request.URL.Query()
+			query.Del(timeshiftParam)
+			target := "/" + app + "/" + shiftName + "/" + strings.Replace(path.Base(filePath), name, shiftName, 1)
+			if len(query) > 0 {
+				target += "?" + query.Encode()
+			}
+			c.Redirect(http.StatusFound, target)
+			return
 		}
-	case tsSuffix:
-		filePath, key, err := parseTs(c.Request.RequestURI)
+		writer, ok := findOrStartStreamWriter(key)
+		if !ok && !hls.SaveFileFlag {
+			c.String(http.StatusNotFound, "not found")
+			return
+		}
+		if ok {
+			writer.Touch()
+		}
+		sessionId := getSessionId(c, key)
+		if sessionId == "" {
+			// 注入sid后重定向 之后的m3u8、ts请求都会带上sid
+			query := c.Request.URL.Query()
+			query.Set(hls.SessionParam, hls.NewSessionId())
+			c.Redirect(http.StatusFound, c.Request.URL.Path+"?"+query.Encode())
+			return
+		}
+		var body []byte
+		if hls.SaveFileFlag {
+			body = hls.GetFileContent(filePath)
+		} else {
+			switch path.Base(filePath) {
+			case masterM3u8:
+				body = writer.GetMasterM3u8Body()
+			case subtitleM3u8:
+				body = writer.GetSubtitleM3u8Body()
+			default:
+				body = writer.GetM3u8Body()
+			}
+		}
+		if hls.SessionMode == hls.ParamSessionMode {
+			body = hls.InjectSessionId(body, sessionId)
+		}
+		hls.TouchSession(sessionId, key, c.ClientIP(), c.Request.UserAgent(), len(body), false)
+		c.Header("Access-Control-Allow-Origin", "*")
+		c.Header("Cache-Control", "no-audioCache")
+		c.Data(http.StatusOK, "application/x-mpegURL", body)
+	case tsSuffix, vttSuffix:
+		filePath, key, err := parseTs(c.Request.URL.Path)
 		if err != nil {
 			c.String(http.StatusBadRequest, err.Error())
 			return
 		}
+		var body []byte
 		if hls.SaveFileFlag {
-			c.Header("Access-Control-Allow-Origin", "*")
-			c.Header("Cache-Control", "no-audioCache")
-			c.Data(http.StatusOK, "application/x-mpegURL", hls.GetFileContent(filePath))
+			body = hls.GetFileContent(filePath)
 		} else {
 			writer, ok := hls.FindStreamWriter(key)
 			if !ok {
 				c.String(http.StatusNotFound, "not found")
 				return
 			}
-			c.Header("Access-Control-Allow-Origin", "*")
-			c.Data(http.StatusOK, "video/mp2ts", writer.GetTsBody(c.Request.RequestURI))
+			if path.Ext(filePath) == vttSuffix {
+				body = writer.GetVttBody(c.Request.URL.Path)
+			} else {
+				body = writer.GetTsBody(c.Request.URL.Path)
+			}
+		}
+		hls.TouchSession(getSessionId(c, key), key, c.ClientIP(), c.Request.UserAgent(), len(body), true)
+		c.Header("Access-Control-Allow-Origin", "*")
+		if path.Ext(filePath) == vttSuffix {
+			c.Data(http.StatusOK, "text/vtt", body)
+		} else {
+			c.Data(http.StatusOK, "video/mp2ts", body)
 		}
 	default:
 		c.String(http.StatusBadRequest, "invalid request")
 	}
 }
 
+// getSessionId 获取观众会话id
+func getSessionId(c *gin.Context, key string) string {
+	if hls.SessionMode == hls.FingerprintSessionMode {
+		return hls.FingerprintSessionId(key, c.ClientIP(), c.Request.UserAgent())
+	}
+	return c.Query(hls.SessionParam)
+}
+
+// handleViewerStat 各推流的观看人数
+func handleViewerStat(c *gin.Context) {
+	stats := rtmp.GetStreamStats()
+	for i := range stats {
+		stats[i].Viewers[hls.ViewerType] = hls.ViewerCount(stats[i].Key)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data": stats,
+	})
+}
+
+// handleSessionStat 单个流的hls观看会话
+func handleSessionStat(c *gin.Context) {
+	key, b := c.GetQuery("key")
+	if !b {
+		c.String(http.StatusBadRequest, "invalid arguments")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data": hls.ListSessions(key),
+	})
+}
+
+// findOrStartStreamWriter 获取hls writer 懒加载模式下没有则从推流端创建
+func findOrStartStreamWriter(key string) (*hls.StreamWriter, bool) {
+	writer, ok := hls.FindStreamWriter(key)
+	if ok {
+		return writer, true
+	}
+	app, name, _ := strings.Cut(key, "/")
+	// 时移流从时移缓存创建 空闲超时后关闭
+	if baseName, offset, ok := timeshift.ParseShiftName(name); ok {
+		buffer, ok := timeshift.Find(app + "/" + baseName)
+		// 只接受取整后的延迟 避免任意延迟都创建writer
+		if !ok || buffer.Status().Packets == 0 || buffer.NormalizeOffset(offset) != offset {
+			return nil, false
+		}
+		writer, isNew := hls.LoadOrNewLazyStreamWriter(app, name)
+		if isNew {
+			go func() {
+				// writer空闲关闭后播放随之结束
+				err := buffer.Play(writer.Context(), offset, writer)
+				if err != nil && !errors.Is(err, context.Canceled) {
+					logger.Logger.Errorf("timeshift play %s failed: %v", key, err)
+				}
+				writer.Close()
+			}()
+		}
+		return writer, true
+	}
+	if !hls.IsLazyApp(app) {
+		return nil, false
+	}
+	pub, ok := rtmp.FindPublisher(key)
+	if !ok {
+		return nil, false
+	}
+	writer, isNew := hls.LoadOrNewLazyStreamWriter(app, name)
+	if isNew {
+		// 注册后先收到gop缓存 可以很快生成第一个分片
+		if !pub.Register(writer) {
+			writer.Close()
+			return nil, false
+		}
+	}
+	return writer, true
+}
+
 func parseM3u8(pathStr string) (string, string, error) {
 	pathStr = strings.TrimLeft(pathStr, "/")
 	paths := strings.Split(pathStr, "/")
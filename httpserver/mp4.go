@@ -3,6 +3,8 @@ package httpserver
 import (
 	"context"
 	"errors"
+	"github.com/LeeZXin/z-live/fmp4"
+	"github.com/LeeZXin/z-live/rtmp"
 	"github.com/LeeZXin/zsf-utils/quit"
 	"github.com/LeeZXin/zsf-utils/threadutil"
 	"github.com/LeeZXin/zsf/logger"
@@ -21,6 +23,7 @@ const (
 
 /*
 Mp4Server mp4服务端，可扩展控制mp4格式视频播放鉴权等控制
+/live/demo.mp4有推流时输出fmp4直播 否则作为文件播放
 */
 type Mp4Server struct {
 	addr   string
@@ -77,6 +80,12 @@ func handleMp4Request(c *gin.Context) {
 		c.String(http.StatusBadRequest, "invalid path")
 		return
 	}
+	if key, err := parseMp4(u); err == nil {
+		if pub, ok := rtmp.FindPublisher(key); ok {
+			handleFmp4Live(c, pub)
+			return
+		}
+	}
 	videoFilePath := strings.TrimLeft(u, "/")
 	videoFile, err := os.Open(videoFilePath)
 	if err != nil {
@@ -89,3 +98,31 @@ func handleMp4Request(c *gin.Context) {
 	c.Status(http.StatusOK)
 	http.ServeContent(c.Writer, c.Request, "", time.Now(), videoFile)
 }
+
+// handleFmp4Live fmp4直播 fragment=frame时按帧分片 默认按gop分片
+func handleFmp4Live(c *gin.Context, pub rtmp.RegisterAction) {
+	writer := c.Writer
+	writer.Header().Set("Access-Control-Allow-Origin", "*")
+	writer.Header().Set("Content-Type", "video/mp4")
+	writer.Header().Set("Transfer-Encoding", "chunked")
+	writer.WriteHeader(http.StatusOK)
+	httpWriter := fmp4.NewHttpWriter(writer, c.Query("fragment") == "frame")
+	go func() {
+		<-c.Request.Context().Done()
+		httpWriter.Close()
+	}()
+	if !pub.Register(httpWriter) {
+		httpWriter.Close()
+	}
+	defer pub.Deregister(httpWriter)
+	httpWriter.Wait()
+}
+
+func parseMp4(pathStr string) (string, error) {
+	pathStr = strings.TrimSuffix(strings.TrimLeft(pathStr, "/"), mp4Suffix)
+	paths := strings.Split(pathStr, "/")
+	if len(paths) != 2 {
+		return "", errors.New("invalid path")
+	}
+	return pathStr, nil
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"github.com/LeeZXin/z-live/flv"
+	"github.com/LeeZXin/z-live/p2p"
 	"github.com/LeeZXin/z-live/rtmp"
 	"github.com/LeeZXin/z-live/sfu"
 	"github.com/LeeZXin/zsf-utils/listutil"
@@ -68,11 +69,14 @@ func NewSfuServer(addr string) *SfuServer {
 		writer.Header().Set("Content-Type", "video/x-flv")
 		writer.Header().Set("Transfer-Encoding", "chunked")
 		writer.WriteHeader(http.StatusOK)
-		httpWriter, err := flv.NewHttpWriter(writer)
+		httpWriter, err := flv.NewHttpWriter(writer, flv.Options{})
 		if err != nil {
 			c.String(http.StatusInternalServerError, "init failed")
+			return
+		}
+		if !pub.Register(httpWriter) {
+			httpWriter.Close()
 		}
-		pub.Register(httpWriter)
 		httpWriter.Wait()
 	})
 	// 创建data-channel的信令
@@ -100,6 +104,16 @@ func NewSfuServer(addr string) *SfuServer {
 	}, ws.Config{
 		MsgQueueSize: 8,
 	}))
+	// 单peerConnection观看房间所有成员 服务端发送offer 需要参数room user
+	engine.Any("/signal-subscribe", ws.RegisterWebsocketService(sfu.NewSubscribeSignalService, ws.Config{
+		MsgQueueSize: 8,
+	}))
+	// webrtc观看rtmp推流 需要参数app name
+	engine.Any("/signal-rtmp", ws.RegisterWebsocketService(func() ws.Service {
+		return sfu.NewSignalService(sfu.NewPlayRtmpTrackService())
+	}, ws.Config{
+		MsgQueueSize: 8,
+	}))
 	// 将浏览器实时音视频保存在服务器 html页面
 	engine.GET("/video.html", func(c *gin.Context) {
 		openHtml("./resources/video.html", c)
@@ -135,7 +149,7 @@ func NewSfuServer(addr string) *SfuServer {
 		openHtml("./resources/flv.js", c)
 	})
 	// 获取房间成员名单
-	// 浏览器通过定时获取成员名单来创建多个<video></video>
+	// room.html改为通过信令的房间事件创建<video></video> 保留给其他客户端
 	engine.GET("/getMemberList", func(c *gin.Context) {
 		roomId, b := c.GetQuery("room")
 		if !b {
@@ -159,6 +173,25 @@ func NewSfuServer(addr string) *SfuServer {
 			"data": userIdList,
 		})
 	})
+	// 获取有时效的turn账号 配置sfu.turn.token后需要鉴权
+	engine.GET("/turn/credential", func(c *gin.Context) {
+		if !sfu.Authorize(c.Request, "turn") {
+			c.String(http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		credential, err := p2p.GenerateTurnCredential()
+		if err != nil {
+			c.String(http.StatusNotFound, err.Error())
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"data": credential,
+		})
+	})
+	// whip推流
+	registerHttpSession(engine, whipKind, whipServices)
+	// whep拉流
+	registerHttpSession(engine, whepKind, whepServices)
 	ret.engine = engine
 	return ret
 }
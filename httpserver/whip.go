@@ -0,0 +1,141 @@
+package httpserver
+
+import (
+	"errors"
+	"github.com/LeeZXin/z-live/sfu"
+	"github.com/LeeZXin/zsf/logger"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+)
+
+const (
+	whipKind = "whip"
+	whepKind = "whep"
+
+	sdpContentType     = "application/sdp"
+	sdpFragContentType = "application/trickle-ice-sdpfrag"
+)
+
+// whipServices whip推流后交给哪个service处理 /whip/{service}
+var whipServices = map[string]func() sfu.RTPService{
+	// 保存为webm
+	"video": sfu.NewSaveToWebmTrackService,
+	// 保存为ivf和ogg
+	"ivf": sfu.NewSaveIvfOggTrackService,
+	// 加入房间 需要参数room user
+	"room": sfu.NewJoinRoomTrackService,
+	// 转为rtmp推流 需要参数app name 可用http-flv、hls观看
+	"rtmp": sfu.NewBridgeToRtmpTrackService,
+}
+
+// whepServices whep拉流的service /whep/{service}
+var whepServices = map[string]func() sfu.RTPService{
+	// 观看房间成员 需要参数room user
+	"room": sfu.NewRoomForwardTrackService,
+	// 观看rtmp推流 需要参数app name 只有h264视频
+	"rtmp": sfu.NewPlayRtmpTrackService,
+}
+
+// registerHttpSession POST /{kind}/{service}创建 PATCH、DELETE /{kind}/{service}/{id}
+func registerHttpSession(engine *gin.Engine, kind string, services map[string]func() sfu.RTPService) {
+	engine.OPTIONS("/"+kind+"/*path", handleHttpSessionOptions)
+	engine.POST("/"+kind+"/:service", func(c *gin.Context) {
+		newService, ok := services[c.Param("service")]
+		if !ok {
+			c.String(http.StatusNotFound, "invalid service")
+			return
+		}
+		handleHttpSessionOffer(c, kind, c.Param("service"), newService())
+	})
+	engine.PATCH("/"+kind+"/:service/:id", func(c *gin.Context) {
+		handleHttpSessionPatch(c, kind)
+	})
+	engine.DELETE("/"+kind+"/:service/:id", func(c *gin.Context) {
+		handleHttpSessionDelete(c, kind)
+	})
+}
+
+// handleHttpSessionOffer body为offer 返回201和answer Location为资源地址
+func handleHttpSessionOffer(c *gin.Context, kind, serviceName string, service sfu.RTPService) {
+	c.Header("Access-Control-Allow-Origin", "*")
+	c.Header("Access-Control-Expose-Headers", "Location")
+	if !sfu.Authorize(c.Request, kind) {
+		c.String(http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	if c.ContentType() != sdpContentType {
+		c.String(http.StatusUnsupportedMediaType, "invalid content type")
+		return
+	}
+	offer, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.String(http.StatusBadRequest, "invalid body")
+		return
+	}
+	session, answer, err := sfu.NewHttpSession(kind, serviceName, service, c.Request, string(offer))
+	if err != nil {
+		logger.Logger.Error(err)
+		if errors.Is(err, sfu.ErrInvalidOffer) {
+			c.String(http.StatusBadRequest, err.Error())
+		} else {
+			c.String(http.StatusForbidden, err.Error())
+		}
+		return
+	}
+	c.Header("Location", c.Request.URL.Path+"/"+session.Id())
+	c.Data(http.StatusCreated, sdpContentType, []byte(answer))
+}
+
+// handleHttpSessionPatch trickle ice 添加客户端候选
+func handleHttpSessionPatch(c *gin.Context, kind string) {
+	c.Header("Access-Control-Allow-Origin", "*")
+	if !sfu.Authorize(c.Request, kind) {
+		c.String(http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	session, ok := sfu.FindHttpSession(kind, c.Param("service"), c.Param("id"))
+	if !ok {
+		c.String(http.StatusNotFound, "not found")
+		return
+	}
+	if c.ContentType() != sdpFragContentType {
+		c.String(http.StatusUnsupportedMediaType, "invalid content type")
+		return
+	}
+	frag, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.String(http.StatusBadRequest, "invalid body")
+		return
+	}
+	if err = session.AddCandidates(string(frag)); err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// handleHttpSessionDelete 结束推流或拉流
+func handleHttpSessionDelete(c *gin.Context, kind string) {
+	c.Header("Access-Control-Allow-Origin", "*")
+	if !sfu.Authorize(c.Request, kind) {
+		c.String(http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	session, ok := sfu.FindHttpSession(kind, c.Param("service"), c.Param("id"))
+	if !ok {
+		c.String(http.StatusNotFound, "not found")
+		return
+	}
+	session.Close()
+	c.Status(http.StatusOK)
+}
+
+// handleHttpSessionOptions 跨域预检
+func handleHttpSessionOptions(c *gin.Context) {
+	c.Header("Access-Control-Allow-Origin", "*")
+	c.Header("Access-Control-Allow-Methods", "POST, PATCH, DELETE, OPTIONS")
+	c.Header("Access-Control-Allow-Headers", "Authorization, Content-Type, If-Match")
+	c.Header("Access-Control-Expose-Headers", "Location")
+	c.Status(http.StatusNoContent)
+}
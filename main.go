@@ -1,13 +1,20 @@
 package main
 
 import (
+	"github.com/LeeZXin/z-live/channel"
+	"github.com/LeeZXin/z-live/cli"
 	"github.com/LeeZXin/z-live/httpserver"
 	"github.com/LeeZXin/z-live/p2p"
 	"github.com/LeeZXin/z-live/rtmp"
 	"github.com/LeeZXin/zsf/zsf"
+	"os"
 )
 
 func main() {
+	// 离线工具 例如 z-live probe -i a.flv
+	if len(os.Args) > 1 && cli.IsCommand(os.Args[1]) {
+		os.Exit(cli.Run(os.Args[1:]))
+	}
 	startRtmp()
 	startFlv()
 	/*
@@ -18,6 +25,8 @@ func main() {
 		startTurn()
 		startP2pSignal()*/
 	startSfu()
+	startApi()
+	startChannel()
 	zsf.Run()
 }
 
@@ -47,7 +56,16 @@ func startSfu() {
 }
 
 func startTurn() {
-	p2p.StartTurnServer(":1940", ":1941", "z-live", "127.0.0.1")
+	p2p.StartTurnServer(":1940", ":1941", p2p.TurnRealm(), "127.0.0.1")
+}
+
+func startApi() {
+	server := httpserver.NewApiServer(":1943")
+	server.ListenAndServe()
+}
+
+func startChannel() {
+	channel.StartFromConfig()
 }
 
 func startP2pSignal() {
@@ -1,13 +1,86 @@
 package p2p
 
 import (
+	"errors"
 	"github.com/LeeZXin/zsf-utils/quit"
 	"github.com/LeeZXin/zsf/logger"
+	"github.com/LeeZXin/zsf/property/static"
 	"github.com/pion/logging"
 	"github.com/pion/turn/v3"
 	"net"
+	"strings"
+	"time"
 )
 
+/*
+turn.secret为空时任意账号都可以使用turn
+不为空时只接受有时效的账号 用户名为过期时间戳 密码为base64(hmac-sha1(secret, 用户名))
+*/
+
+const (
+	defaultTurnRealm = "z-live"
+	// defaultTurnTtl 账号默认有效期 秒
+	defaultTurnTtl = 86400
+)
+
+var (
+	ErrTurnSecretEmpty = errors.New("turn secret is empty")
+)
+
+// TurnCredential 有时效的turn账号
+type TurnCredential struct {
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	Realm    string   `json:"realm"`
+	Ttl      int      `json:"ttl"`
+	Urls     []string `json:"urls"`
+}
+
+// TurnRealm turn.realm 默认z-live
+func TurnRealm() string {
+	if realm := static.GetString("turn.realm"); realm != "" {
+		return realm
+	}
+	return defaultTurnRealm
+}
+
+// GenerateTurnCredential 按turn.secret生成账号 有效期turn.ttl秒
+func GenerateTurnCredential() (TurnCredential, error) {
+	secret := static.GetString("turn.secret")
+	if secret == "" {
+		return TurnCredential{}, ErrTurnSecretEmpty
+	}
+	ttl := static.GetInt("turn.ttl")
+	if ttl <= 0 {
+		ttl = defaultTurnTtl
+	}
+	username, password, err := turn.GenerateLongTermCredentials(secret, time.Duration(ttl)*time.Second)
+	if err != nil {
+		return TurnCredential{}, err
+	}
+	urls := make([]string, 0, 2)
+	for _, url := range strings.Split(static.GetString("turn.urls"), ",") {
+		if url = strings.TrimSpace(url); url != "" {
+			urls = append(urls, url)
+		}
+	}
+	return TurnCredential{
+		Username: username,
+		Password: password,
+		Realm:    TurnRealm(),
+		Ttl:      ttl,
+		Urls:     urls,
+	}, nil
+}
+
+// newAuthHandler 配置了turn.secret时校验有时效的账号
+func newAuthHandler() turn.AuthHandler {
+	if secret := static.GetString("turn.secret"); secret != "" {
+		return turn.NewLongTermAuthHandler(secret, &loggerWrapper{})
+	}
+	return optimisticAuthHandler
+}
+
 func optimisticAuthHandler(username string, realm string, _ net.Addr) (key []byte, ok bool) {
 	return turn.GenerateAuthKey(username, realm, "U_HAPPY_IS_OK"), true
 }
@@ -27,7 +100,7 @@ func (*loggerWrapper) Trace(msg string) {
 }
 
 func (*loggerWrapper) Tracef(format string, args ...interface{}) {
-	logger.Logger.Tracef(format, args)
+	logger.Logger.Tracef(format, args...)
 }
 
 func (*loggerWrapper) Debug(msg string) {
@@ -35,7 +108,7 @@ func (*loggerWrapper) Debug(msg string) {
 }
 
 func (*loggerWrapper) Debugf(format string, args ...interface{}) {
-	logger.Logger.Debugf(format, args)
+	logger.Logger.Debugf(format, args...)
 }
 
 func (*loggerWrapper) Info(msg string) {
@@ -43,7 +116,7 @@ func (*loggerWrapper) Info(msg string) {
 }
 
 func (*loggerWrapper) Infof(format string, args ...interface{}) {
-	logger.Logger.Debugf(format, args)
+	logger.Logger.Debugf(format, args...)
 }
 
 func (*loggerWrapper) Warn(msg string) {
@@ -51,7 +124,7 @@ func (*loggerWrapper) Warn(msg string) {
 }
 
 func (*loggerWrapper) Warnf(format string, args ...interface{}) {
-	logger.Logger.Warnf(format, args)
+	logger.Logger.Warnf(format, args...)
 }
 
 func (*loggerWrapper) Error(msg string) {
@@ -59,7 +132,7 @@ func (*loggerWrapper) Error(msg string) {
 }
 
 func (*loggerWrapper) Errorf(format string, args ...interface{}) {
-	logger.Logger.Errorf(format, args)
+	logger.Logger.Errorf(format, args...)
 }
 
 func StartTurnServer(udpAddr, tcpAddr, realm, turnIp string) {
@@ -73,7 +146,7 @@ func StartTurnServer(udpAddr, tcpAddr, realm, turnIp string) {
 	}
 	server, err := turn.NewServer(turn.ServerConfig{
 		Realm:         realm,
-		AuthHandler:   optimisticAuthHandler,
+		AuthHandler:   newAuthHandler(),
 		LoggerFactory: &loggerFactoryImpl{},
 		PacketConnConfigs: []turn.PacketConnConfig{
 			{
@@ -105,3 +105,27 @@ func (p *Parser) Parse(b []byte, packetType uint8) error {
 	}
 	return nil
 }
+
+// AudioSpecificConfig aac sequence header中的配置
+type AudioSpecificConfig struct {
+	ObjectType int
+	SampleRate int
+	Channels   int
+}
+
+// ParseAudioSpecificConfig 解析aac sequence header
+func ParseAudioSpecificConfig(b []byte) (AudioSpecificConfig, error) {
+	if len(b) < 2 {
+		return AudioSpecificConfig{}, specificBufInvalid
+	}
+	rateIndex := int((b[0]&0x07)<<1 | b[1]>>7)
+	rate := 44100
+	if rateIndex < len(aacRates) {
+		rate = aacRates[rateIndex]
+	}
+	return AudioSpecificConfig{
+		ObjectType: int(b[0] >> 3),
+		SampleRate: rate,
+		Channels:   int((b[1] >> 3) & 0x0f),
+	}, nil
+}
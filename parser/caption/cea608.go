@@ -0,0 +1,237 @@
+package caption
+
+import "strings"
+
+const (
+	modePopOn = iota
+	modeRollUp
+	modePaintOn
+)
+
+const (
+	maxRows = 15
+)
+
+var (
+	// basicChars 与ascii不同的字符
+	basicChars = map[byte]rune{
+		0x2a: 'á',
+		0x5c: 'é',
+		0x5e: 'í',
+		0x5f: 'ó',
+		0x60: 'ú',
+		0x7b: 'ç',
+		0x7c: '÷',
+		0x7d: 'Ñ',
+		0x7e: 'ñ',
+		0x7f: '█',
+	}
+	// specialChars 0x11 0x30-0x3f
+	specialChars = []rune("®°½¿™¢£♪à èâêîôû")
+	// extendedChars1 0x12 0x20-0x3f
+	extendedChars1 = []rune("ÁÉÓÚÜü‘¡*'—©℠•“”ÀÂÇÈÊËëÎÏïÔÙùÛ«»")
+	// extendedChars2 0x13 0x20-0x3f
+	extendedChars2 = []rune("ÃãÍÌìÒòÕõ{}\\^_|~ÄäÖöß¥¤│ÅåØø┌┐└┘")
+)
+
+// memory 字幕缓存 按行存储
+type memory struct {
+	rows []string
+}
+
+func (m *memory) write(r rune) {
+	if len(m.rows) == 0 {
+		m.rows = append(m.rows, "")
+	}
+	m.rows[len(m.rows)-1] += string(r)
+}
+
+func (m *memory) backspace() {
+	if len(m.rows) == 0 {
+		return
+	}
+	row := []rune(m.rows[len(m.rows)-1])
+	if len(row) > 0 {
+		m.rows[len(m.rows)-1] = string(row[:len(row)-1])
+	}
+}
+
+func (m *memory) newRow() {
+	if len(m.rows) > 0 && strings.TrimSpace(m.rows[len(m.rows)-1]) == "" {
+		return
+	}
+	m.rows = append(m.rows, "")
+	if len(m.rows) > maxRows {
+		m.rows = m.rows[len(m.rows)-maxRows:]
+	}
+}
+
+// rollUp 滚动字幕只保留最后n行
+func (m *memory) rollUp(n int) {
+	m.newRow()
+	// 加上正在写入的一行
+	if len(m.rows) > n+1 {
+		m.rows = m.rows[len(m.rows)-n-1:]
+	}
+}
+
+func (m *memory) clear() {
+	m.rows = m.rows[:0]
+}
+
+func (m *memory) text() string {
+	lines := make([]string, 0, len(m.rows))
+	for _, row := range m.rows {
+		row = strings.TrimSpace(row)
+		if row != "" {
+			lines = append(lines, row)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// cea608Decoder 只解析field1 CC1
+type cea608Decoder struct {
+	mode         int
+	rollRows     int
+	channel      int
+	lastCtrl     [2]byte
+	displayed    *memory
+	nonDisplayed *memory
+	screen       *screen
+}
+
+func newCea608Decoder() *cea608Decoder {
+	return &cea608Decoder{
+		mode:         modePopOn,
+		channel:      1,
+		displayed:    &memory{},
+		nonDisplayed: &memory{},
+		screen:       &screen{},
+	}
+}
+
+// decode 返回是否为CC1数据
+func (d *cea608Decoder) decode(b1, b2 byte, ts int64) bool {
+	// 去掉奇偶校验位
+	b1 &= 0x7f
+	b2 &= 0x7f
+	if b1 == 0 && b2 == 0 {
+		return false
+	}
+	if b1 >= 0x10 && b1 <= 0x1f {
+		// 控制码通常会重复发送两次
+		if d.lastCtrl[0] == b1 && d.lastCtrl[1] == b2 {
+			d.lastCtrl = [2]byte{}
+			return d.channel == 1
+		}
+		d.lastCtrl = [2]byte{b1, b2}
+		if b1&0x08 == 0 {
+			d.channel = 1
+		} else {
+			d.channel = 2
+		}
+		if d.channel != 1 {
+			return false
+		}
+		d.control(b1&^0x08, b2, ts)
+		return true
+	}
+	d.lastCtrl = [2]byte{}
+	if d.channel != 1 {
+		return false
+	}
+	if b1 >= 0x20 {
+		d.target().write(basicChar(b1))
+	}
+	if b2 >= 0x20 {
+		d.target().write(basicChar(b2))
+	}
+	return true
+}
+
+// target 当前写入的缓存
+func (d *cea608Decoder) target() *memory {
+	if d.mode == modePopOn {
+		return d.nonDisplayed
+	}
+	return d.displayed
+}
+
+func (d *cea608Decoder) control(b1, b2 byte, ts int64) {
+	switch {
+	case b1 == 0x14 && b2 >= 0x20 && b2 <= 0x2f:
+		d.miscControl(b2, ts)
+	case b1 == 0x17 && b2 >= 0x21 && b2 <= 0x23:
+		// tab offset
+	case b1 == 0x11 && b2 >= 0x30 && b2 <= 0x3f:
+		d.target().write(specialChars[b2-0x30])
+	case b1 == 0x11 && b2 >= 0x20 && b2 <= 0x2f:
+		// mid-row 样式控制 显示为空格
+		d.target().write(' ')
+	case b1 == 0x12 && b2 >= 0x20 && b2 <= 0x3f:
+		d.target().backspace()
+		d.target().write(extendedChars1[b2-0x20])
+	case b1 == 0x13 && b2 >= 0x20 && b2 <= 0x3f:
+		d.target().backspace()
+		d.target().write(extendedChars2[b2-0x20])
+	case b2 >= 0x40 && b2 <= 0x7f:
+		// preamble address code 换行
+		if d.mode != modeRollUp {
+			d.target().newRow()
+		}
+	}
+	if d.mode == modePaintOn {
+		d.screen.display(d.displayed.text(), ts)
+	}
+}
+
+func (d *cea608Decoder) miscControl(b2 byte, ts int64) {
+	switch b2 {
+	case 0x20:
+		// RCL resume caption loading
+		d.mode = modePopOn
+	case 0x21:
+		// BS backspace
+		d.target().backspace()
+	case 0x25, 0x26, 0x27:
+		// RU2 RU3 RU4
+		if d.mode != modeRollUp {
+			d.displayed.clear()
+			d.nonDisplayed.clear()
+			d.screen.display("", ts)
+		}
+		d.mode = modeRollUp
+		d.rollRows = int(b2-0x25) + 2
+	case 0x29:
+		// RDC resume direct captioning
+		d.mode = modePaintOn
+	case 0x2c:
+		// EDM erase displayed memory
+		d.displayed.clear()
+		d.screen.display("", ts)
+	case 0x2d:
+		// CR carriage return
+		if d.mode == modeRollUp {
+			d.displayed.rollUp(d.rollRows)
+			d.screen.display(d.displayed.text(), ts)
+		} else {
+			d.target().newRow()
+		}
+	case 0x2e:
+		// ENM erase non-displayed memory
+		d.nonDisplayed.clear()
+	case 0x2f:
+		// EOC end of caption 交换显示和非显示缓存
+		d.displayed, d.nonDisplayed = d.nonDisplayed, d.displayed
+		d.mode = modePopOn
+		d.screen.display(d.displayed.text(), ts)
+	}
+}
+
+func basicChar(b byte) rune {
+	if r, ok := basicChars[b]; ok {
+		return r
+	}
+	return rune(b)
+}
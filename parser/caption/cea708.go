@@ -0,0 +1,144 @@
+package caption
+
+import "strings"
+
+const (
+	dtvccService = 1
+)
+
+var (
+	// c1ParamLen 0x80-0x9f命令参数长度
+	c1ParamLen = [32]int{
+		0, 0, 0, 0, 0, 0, 0, 0, // CW0-CW7
+		1, 1, 1, 1, 1, 1, 0, 0, // CLW DSW HDW TGW DLW DLY DLC RST
+		2, 3, 2, 0, 0, 0, 0, 4, // SPA SPC SPL reserved SWA
+		6, 6, 6, 6, 6, 6, 6, 6, // DF0-DF7
+	}
+)
+
+// cea708Decoder 只解析service1 只取文本 不处理窗口样式
+type cea708Decoder struct {
+	packet  []byte
+	started bool
+	text    strings.Builder
+	screen  *screen
+}
+
+func newCea708Decoder() *cea708Decoder {
+	return &cea708Decoder{
+		packet: make([]byte, 0, 128),
+		screen: &screen{},
+	}
+}
+
+func (d *cea708Decoder) push(start, valid bool, b1, b2 byte, ts int64) {
+	if start {
+		d.parsePacket(ts)
+		d.packet = d.packet[:0]
+		d.started = valid
+	}
+	if !valid || !d.started {
+		return
+	}
+	d.packet = append(d.packet, b1, b2)
+	// 收到完整的packet立即解析 不等下一个packet开始
+	if len(d.packet) >= d.packetSize() {
+		d.parsePacket(ts)
+		d.packet = d.packet[:0]
+		d.started = false
+	}
+}
+
+// packetSize packet_size_code为0时是128字节
+func (d *cea708Decoder) packetSize() int {
+	size := int(d.packet[0] & 0x3f)
+	if size == 0 {
+		return 128
+	}
+	return size * 2
+}
+
+// parsePacket 解析DTVCC packet
+func (d *cea708Decoder) parsePacket(ts int64) {
+	if len(d.packet) == 0 {
+		return
+	}
+	size := d.packetSize()
+	if size > len(d.packet) {
+		size = len(d.packet)
+	}
+	data := d.packet[1:size]
+	for len(data) > 0 {
+		serviceNumber := int(data[0] >> 5)
+		blockSize := int(data[0] & 0x1f)
+		data = data[1:]
+		if serviceNumber == 7 && len(data) > 0 {
+			serviceNumber = int(data[0] & 0x3f)
+			data = data[1:]
+		}
+		if serviceNumber == 0 || blockSize == 0 {
+			return
+		}
+		if blockSize > len(data) {
+			blockSize = len(data)
+		}
+		if serviceNumber == dtvccService {
+			d.parseServiceBlock(data[:blockSize], ts)
+		}
+		data = data[blockSize:]
+	}
+}
+
+func (d *cea708Decoder) parseServiceBlock(b []byte, ts int64) {
+	for i := 0; i < len(b); i++ {
+		c := b[i]
+		switch {
+		case c == 0x03:
+			// ETX
+			d.screen.display(d.text.String(), ts)
+		case c == 0x08:
+			// BS
+			s := []rune(d.text.String())
+			if len(s) > 0 {
+				d.text.Reset()
+				d.text.WriteString(string(s[:len(s)-1]))
+			}
+		case c == 0x0c:
+			// FF 清屏
+			d.text.Reset()
+			d.screen.display("", ts)
+		case c == 0x0d || c == 0x0e:
+			// CR HCR
+			d.text.WriteByte('\n')
+		case c == 0x10:
+			// EXT1 扩展字符集 跳过
+			i++
+		case c >= 0x11 && c <= 0x17:
+			i++
+		case c >= 0x18 && c <= 0x1f:
+			i += 2
+		case c == 0x7f:
+			d.text.WriteRune('♪')
+		case c >= 0x20 && c < 0x7f:
+			d.text.WriteByte(c)
+		case c >= 0x80 && c <= 0x9f:
+			d.command(c, ts)
+			i += c1ParamLen[c-0x80]
+		case c >= 0xa0:
+			// G1 latin-1
+			d.text.WriteRune(rune(c))
+		}
+	}
+}
+
+func (d *cea708Decoder) command(c byte, ts int64) {
+	switch c {
+	case 0x89:
+		// DSW display windows
+		d.screen.display(d.text.String(), ts)
+	case 0x88, 0x8a, 0x8c, 0x8f:
+		// CLW HDW DLW RST
+		d.screen.display("", ts)
+		d.text.Reset()
+	}
+}
@@ -0,0 +1,118 @@
+package caption
+
+import "strings"
+
+/*
+cea-608/708 字幕解码
+只解析CC1和708 service1 输出纯文本字幕
+*/
+const (
+	ccTypeNTSCField1 = 0
+	ccTypeNTSCField2 = 1
+	ccTypeDTVCCData  = 2
+	ccTypeDTVCCStart = 3
+)
+
+// Cue 单条字幕 时间单位毫秒
+type Cue struct {
+	Start int64
+	End   int64
+	Text  string
+}
+
+// screen 当前屏幕展示的字幕
+type screen struct {
+	showing bool
+	start   int64
+	text    string
+	cues    []Cue
+}
+
+// display 屏幕内容发生变化
+func (s *screen) display(text string, ts int64) {
+	text = strings.TrimSpace(text)
+	if s.showing && s.text == text {
+		return
+	}
+	if s.showing && s.text != "" && ts > s.start {
+		s.cues = append(s.cues, Cue{
+			Start: s.start,
+			End:   ts,
+			Text:  s.text,
+		})
+	}
+	s.showing = true
+	s.start = ts
+	s.text = text
+}
+
+// pending 正在展示还没结束的字幕
+func (s *screen) pending(ts int64) (Cue, bool) {
+	if !s.showing || s.text == "" || ts <= s.start {
+		return Cue{}, false
+	}
+	return Cue{
+		Start: s.start,
+		End:   ts,
+		Text:  s.text,
+	}, true
+}
+
+func (s *screen) popCues() []Cue {
+	ret := s.cues
+	s.cues = nil
+	return ret
+}
+
+// Decoder 解析sei中的cc_data
+// 同时存在608和708时 优先使用608
+type Decoder struct {
+	cea608 *cea608Decoder
+	cea708 *cea708Decoder
+	has608 bool
+}
+
+func NewDecoder() *Decoder {
+	return &Decoder{
+		cea608: newCea608Decoder(),
+		cea708: newCea708Decoder(),
+	}
+}
+
+// Decode ccData为三字节一组的cc_data ts为该帧pts
+func (d *Decoder) Decode(ccData []byte, ts int64) {
+	for i := 0; i+2 < len(ccData); i += 3 {
+		ccValid := ccData[i]&0x04 != 0
+		ccType := ccData[i] & 0x03
+		switch ccType {
+		case ccTypeNTSCField1:
+			if !ccValid {
+				continue
+			}
+			if d.cea608.decode(ccData[i+1], ccData[i+2], ts) {
+				d.has608 = true
+			}
+		case ccTypeNTSCField2:
+		case ccTypeDTVCCStart, ccTypeDTVCCData:
+			d.cea708.push(ccType == ccTypeDTVCCStart, ccValid, ccData[i+1], ccData[i+2], ts)
+		}
+	}
+}
+
+// PopCues 获取已经结束的字幕
+func (d *Decoder) PopCues() []Cue {
+	ret := d.cea608.screen.popCues()
+	cues708 := d.cea708.screen.popCues()
+	if !d.has608 {
+		ret = append(ret, cues708...)
+	}
+	return ret
+}
+
+// Pending 获取还在展示中的字幕 结束时间为ts
+func (d *Decoder) Pending(ts int64) (Cue, bool) {
+	if d.has608 {
+		return d.cea608.screen.pending(ts)
+	}
+	return d.cea708.screen.pending(ts)
+}
@@ -0,0 +1,230 @@
+package caption
+
+import (
+	"reflect"
+	"testing"
+)
+
+// ccFrame 一帧的cc_data和pts
+type ccFrame struct {
+	ts     int64
+	ccData []byte
+}
+
+// withParity 加上608的奇校验位
+func withParity(b byte) byte {
+	ones := 0
+	for i := 0; i < 7; i++ {
+		ones += int(b >> i & 1)
+	}
+	if ones%2 == 0 {
+		return b | 0x80
+	}
+	return b
+}
+
+// cc608 field1 CC1 每两个字节一组
+func cc608(pairs ...byte) []byte {
+	ret := make([]byte, 0, len(pairs)/2*3)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		ret = append(ret, 0xfc, withParity(pairs[i]), withParity(pairs[i+1]))
+	}
+	return ret
+}
+
+// cc608Text 文本按两个字符一组 奇数补0
+func cc608Text(text string) []byte {
+	b := []byte(text)
+	if len(b)%2 == 1 {
+		b = append(b, 0)
+	}
+	return cc608(b...)
+}
+
+// cc708 DTVCC packet 第一组为start 不足两字节补0
+func cc708(packet ...byte) []byte {
+	if len(packet)%2 == 1 {
+		packet = append(packet, 0)
+	}
+	ret := make([]byte, 0, len(packet)/2*3)
+	for i := 0; i < len(packet); i += 2 {
+		header := byte(0xfe)
+		if i == 0 {
+			header = 0xff
+		}
+		ret = append(ret, header, packet[i], packet[i+1])
+	}
+	return ret
+}
+
+// dtvccPacket service1的一个service block
+func dtvccPacket(seq byte, block ...byte) []byte {
+	size := 2 + len(block)
+	if size%2 == 1 {
+		size++
+	}
+	ret := []byte{seq<<6 | byte(size/2), 1<<5 | byte(len(block))}
+	return append(ret, block...)
+}
+
+func concat(bs ...[]byte) []byte {
+	var ret []byte
+	for _, b := range bs {
+		ret = append(ret, b...)
+	}
+	return ret
+}
+
+func TestDecoder(t *testing.T) {
+	var (
+		rcl = cc608(0x14, 0x20, 0x14, 0x20)
+		enm = cc608(0x14, 0x2e, 0x14, 0x2e)
+		eoc = cc608(0x14, 0x2f, 0x14, 0x2f)
+		edm = cc608(0x14, 0x2c, 0x14, 0x2c)
+		ru2 = cc608(0x14, 0x25, 0x14, 0x25)
+		cr  = cc608(0x14, 0x2d, 0x14, 0x2d)
+		rdc = cc608(0x14, 0x29, 0x14, 0x29)
+		// row 15 column 0
+		pac = cc608(0x14, 0x70, 0x14, 0x70)
+	)
+	tests := []struct {
+		name      string
+		frames    []ccFrame
+		pendingTs int64
+		cues      []Cue
+		pending   *Cue
+	}{
+		{
+			name: "608 pop-on",
+			frames: []ccFrame{
+				{ts: 0, ccData: concat(rcl, enm, pac)},
+				{ts: 33, ccData: cc608Text("HELLO")},
+				{ts: 1000, ccData: eoc},
+				{ts: 3000, ccData: edm},
+			},
+			pendingTs: 4000,
+			cues:      []Cue{{Start: 1000, End: 3000, Text: "HELLO"}},
+		},
+		{
+			name: "608 pop-on replaced by next caption",
+			frames: []ccFrame{
+				{ts: 0, ccData: concat(rcl, enm, pac, cc608Text("ONE"))},
+				{ts: 1000, ccData: eoc},
+				{ts: 1500, ccData: concat(rcl, enm, pac, cc608Text("TWO"))},
+				{ts: 2000, ccData: eoc},
+			},
+			pendingTs: 2500,
+			cues:      []Cue{{Start: 1000, End: 2000, Text: "ONE"}},
+			pending:   &Cue{Start: 2000, End: 2500, Text: "TWO"},
+		},
+		{
+			name: "608 special and extended chars",
+			frames: []ccFrame{
+				// ♪ 然后E被扩展字符É替换
+				{ts: 0, ccData: concat(rcl, enm, pac, cc608(0x11, 0x37, 0x11, 0x37), cc608Text(" CAFE"), cc608(0x12, 0x21, 0x12, 0x21))},
+				{ts: 500, ccData: eoc},
+			},
+			pendingTs: 1500,
+			pending:   &Cue{Start: 500, End: 1500, Text: "♪ CAFÉ"},
+		},
+		{
+			name: "608 roll-up keeps two rows",
+			frames: []ccFrame{
+				{ts: 0, ccData: ru2},
+				{ts: 100, ccData: cc608Text("ONE")},
+				{ts: 1000, ccData: cr},
+				{ts: 1100, ccData: cc608Text("TWO")},
+				{ts: 2000, ccData: cr},
+				{ts: 2100, ccData: cc608Text("THREE")},
+				{ts: 3000, ccData: cr},
+			},
+			pendingTs: 4000,
+			cues: []Cue{
+				{Start: 1000, End: 2000, Text: "ONE"},
+				{Start: 2000, End: 3000, Text: "ONE\nTWO"},
+			},
+			pending: &Cue{Start: 3000, End: 4000, Text: "TWO\nTHREE"},
+		},
+		{
+			name: "608 paint-on shows every change",
+			frames: []ccFrame{
+				{ts: 0, ccData: concat(rdc, pac)},
+				{ts: 100, ccData: cc608Text("HI")},
+				{ts: 200, ccData: cc608(0x14, 0x21, 0x14, 0x21)},
+			},
+			pendingTs: 1000,
+			// 收到控制码时刷新屏幕 退格后只剩H
+			pending: &Cue{Start: 200, End: 1000, Text: "H"},
+		},
+		{
+			name: "608 CC2 ignored",
+			frames: []ccFrame{
+				{ts: 0, ccData: cc608(0x1c, 0x20, 0x1c, 0x20, 0x1c, 0x2e, 0x1c, 0x2e)},
+				{ts: 100, ccData: cc608Text("CC2")},
+				{ts: 1000, ccData: cc608(0x1c, 0x2f, 0x1c, 0x2f)},
+			},
+			pendingTs: 2000,
+		},
+		{
+			name: "708 text until clear",
+			frames: []ccFrame{
+				// ETX显示 FF清屏
+				{ts: 1000, ccData: cc708(dtvccPacket(0, 'H', 'I', 0x03)...)},
+				{ts: 3000, ccData: cc708(dtvccPacket(1, 0x0c)...)},
+			},
+			pendingTs: 4000,
+			cues:      []Cue{{Start: 1000, End: 3000, Text: "HI"}},
+		},
+		{
+			name: "708 display window and delete window",
+			frames: []ccFrame{
+				// DSW带1字节参数 DLW带1字节参数
+				{ts: 0, ccData: cc708(dtvccPacket(0, 'A', 'B', 0x0d, 'C', 0x89, 0x01)...)},
+				{ts: 2000, ccData: cc708(dtvccPacket(1, 0x8c, 0x01)...)},
+			},
+			pendingTs: 3000,
+			cues:      []Cue{{Start: 0, End: 2000, Text: "AB\nC"}},
+		},
+		{
+			name: "708 other service ignored",
+			frames: []ccFrame{
+				{ts: 0, ccData: cc708(0x02, 2<<5|2, 'N', 'O')},
+				{ts: 500, ccData: cc708(0x42, 2<<5|1, 0x03)},
+			},
+			pendingTs: 1000,
+		},
+		{
+			name: "608 preferred over 708",
+			frames: []ccFrame{
+				{ts: 0, ccData: concat(rcl, enm, pac, cc608Text("608"), cc708(dtvccPacket(0, '7', '0', '8', 0x03)...))},
+				{ts: 1000, ccData: eoc},
+				{ts: 2000, ccData: concat(edm, cc708(dtvccPacket(1, 0x0c)...))},
+			},
+			pendingTs: 3000,
+			cues:      []Cue{{Start: 1000, End: 2000, Text: "608"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewDecoder()
+			var cues []Cue
+			for _, f := range tt.frames {
+				d.Decode(f.ccData, f.ts)
+				cues = append(cues, d.PopCues()...)
+			}
+			if len(cues) != len(tt.cues) || (len(cues) > 0 && !reflect.DeepEqual(cues, tt.cues)) {
+				t.Fatalf("cues = %#v, want %#v", cues, tt.cues)
+			}
+			pending, ok := d.Pending(tt.pendingTs)
+			if tt.pending == nil {
+				if ok {
+					t.Fatalf("unexpected pending cue %#v", pending)
+				}
+				return
+			}
+			if !ok || pending != *tt.pending {
+				t.Fatalf("pending = %#v %v, want %#v", pending, ok, *tt.pending)
+			}
+		})
+	}
+}
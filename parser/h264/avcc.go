@@ -0,0 +1,64 @@
+package h264
+
+// AVCDecoderConfigurationRecord avc sequence header
+type AVCDecoderConfigurationRecord struct {
+	Profile              byte
+	ProfileCompatibility byte
+	Level                byte
+	NaluLen              int
+	SPS                  [][]byte
+	PPS                  [][]byte
+}
+
+// ParseAVCDecoderConfigurationRecord 解析avc sequence header
+func ParseAVCDecoderConfigurationRecord(b []byte) (*AVCDecoderConfigurationRecord, error) {
+	if len(b) < 7 {
+		return nil, decDataNil
+	}
+	ret := &AVCDecoderConfigurationRecord{
+		Profile:              b[1],
+		ProfileCompatibility: b[2],
+		Level:                b[3],
+		NaluLen:              int(b[4]&0x03) + 1,
+	}
+	spsNum := int(b[5] & 0x1f)
+	index := 6
+	for i := 0; i < spsNum; i++ {
+		if index+2 > len(b) {
+			return nil, spsDataError
+		}
+		n := int(b[index])<<8 | int(b[index+1])
+		index += 2
+		if n <= 0 || index+n > len(b) {
+			return nil, spsDataError
+		}
+		ret.SPS = append(ret.SPS, b[index:index+n])
+		index += n
+	}
+	if index >= len(b) {
+		return nil, ppsHeaderError
+	}
+	ppsNum := int(b[index])
+	index++
+	for i := 0; i < ppsNum; i++ {
+		if index+2 > len(b) {
+			return nil, ppsDataError
+		}
+		n := int(b[index])<<8 | int(b[index+1])
+		index += 2
+		if n <= 0 || index+n > len(b) {
+			return nil, ppsDataError
+		}
+		ret.PPS = append(ret.PPS, b[index:index+n])
+		index += n
+	}
+	return ret, nil
+}
+
+// SPSInfo 解析第一个sps 可获取分辨率
+func (r *AVCDecoderConfigurationRecord) SPSInfo() (*SPS, error) {
+	if len(r.SPS) == 0 {
+		return nil, spsDataError
+	}
+	return ParseSPSNALUnit(r.SPS[0], false)
+}
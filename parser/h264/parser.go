@@ -45,6 +45,7 @@ type Parser struct {
 	pps          *bytes.Buffer
 	w            io.Writer
 	spsInfo      *SPS
+	ccData       []byte
 }
 
 type sequenceHeader struct {
@@ -142,6 +143,7 @@ func (p *Parser) getAnnexbH264(src []byte) error {
 		return videoDataInvalid
 	}
 	p.pps.Reset()
+	p.ccData = p.ccData[:0]
 	_, err := p.w.Write(naluAud)
 	if err != nil {
 		return err
@@ -159,6 +161,9 @@ func (p *Parser) getAnnexbH264(src []byte) error {
 		dataSize -= naluBytesLen
 		if dataSize >= nalLen && len(src[index:]) >= nalLen && nalLen > 0 {
 			nalType := src[index] & 0x1f
+			if nalType == nalu_type_sei {
+				p.parseCCData(src[index : index+nalLen])
+			}
 			switch nalType {
 			case nalu_type_aud:
 			case nalu_type_idr:
@@ -208,6 +213,19 @@ func (p *Parser) getAnnexbH264(src []byte) error {
 	return nil
 }
 
+// parseCCData 从sei中提取字幕数据
+func (p *Parser) parseCCData(nalu []byte) {
+	messages, _ := ParseSEINALUnit(nalu)
+	for i := range messages {
+		p.ccData = append(p.ccData, messages[i].CCData()...)
+	}
+}
+
+// CCData 最近一次解析的视频帧携带的cc_data
+func (p *Parser) CCData() []byte {
+	return p.ccData
+}
+
 func (p *Parser) Parse(b []byte, isSeq bool) error {
 	if isSeq {
 		return p.parseSpecificInfo(b)
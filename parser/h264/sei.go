@@ -0,0 +1,117 @@
+package h264
+
+import (
+	"bytes"
+	"fmt"
+)
+
+const (
+	seiTypeUserDataRegistered = 4
+
+	t35CountryCodeUS  = 0xb5
+	t35ProviderATSC   = 0x0031
+	atscUserDataCC    = 0x03
+	ccDataTripleBytes = 3
+)
+
+var (
+	seiDataError = fmt.Errorf("sei data error")
+
+	atscIdentifier = []byte("GA94")
+)
+
+// SEIMessage sei单条消息
+type SEIMessage struct {
+	PayloadType int
+	Payload     []byte
+}
+
+// ParseSEINALUnit 解析sei nalu 包含nalu header
+func ParseSEINALUnit(data []byte) ([]SEIMessage, error) {
+	if len(data) < 2 || data[0]&0x1f != nalu_type_sei {
+		return nil, seiDataError
+	}
+	rbsp := unescapeRBSP(data[1:])
+	ret := make([]SEIMessage, 0, 2)
+	index := 0
+	// 末尾剩下rbsp_trailing_bits
+	for len(rbsp)-index > 1 {
+		payloadType := 0
+		for index < len(rbsp) && rbsp[index] == 0xff {
+			payloadType += 0xff
+			index++
+		}
+		if index >= len(rbsp) {
+			return ret, seiDataError
+		}
+		payloadType += int(rbsp[index])
+		index++
+		payloadSize := 0
+		for index < len(rbsp) && rbsp[index] == 0xff {
+			payloadSize += 0xff
+			index++
+		}
+		if index >= len(rbsp) {
+			return ret, seiDataError
+		}
+		payloadSize += int(rbsp[index])
+		index++
+		if len(rbsp)-index < payloadSize {
+			return ret, seiDataError
+		}
+		ret = append(ret, SEIMessage{
+			PayloadType: payloadType,
+			Payload:     rbsp[index : index+payloadSize],
+		})
+		index += payloadSize
+	}
+	return ret, nil
+}
+
+// CCData 获取ATSC A/53 user_data里的cc_data
+// 每三个字节为一组 cc_valid/cc_type cc_data_1 cc_data_2
+func (m *SEIMessage) CCData() []byte {
+	if m.PayloadType != seiTypeUserDataRegistered {
+		return nil
+	}
+	b := m.Payload
+	// country_code(1) provider_code(2) user_identifier(4) user_data_type_code(1) cc_count(1) em_data(1)
+	if len(b) < 10 || b[0] != t35CountryCodeUS {
+		return nil
+	}
+	if int(b[1])<<8|int(b[2]) != t35ProviderATSC {
+		return nil
+	}
+	if !bytes.Equal(b[3:7], atscIdentifier) || b[7] != atscUserDataCC {
+		return nil
+	}
+	// process_cc_data_flag
+	if b[8]&0x40 == 0 {
+		return nil
+	}
+	ccCount := int(b[8] & 0x1f)
+	data := b[10:]
+	if len(data) < ccCount*ccDataTripleBytes {
+		ccCount = len(data) / ccDataTripleBytes
+	}
+	return data[:ccCount*ccDataTripleBytes]
+}
+
+// unescapeRBSP 去掉防竞争字节0x03
+func unescapeRBSP(src []byte) []byte {
+	ret := make([]byte, 0, len(src))
+	zeroCount := 0
+	for _, b := range src {
+		if zeroCount == 2 && b == startCodeEmulationPreventionByte {
+			zeroCount = 0
+			continue
+		}
+		if b == 0 {
+			zeroCount++
+		} else {
+			zeroCount = 0
+		}
+		ret = append(ret, b)
+	}
+	return ret
+}
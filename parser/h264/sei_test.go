@@ -0,0 +1,193 @@
+package h264
+
+import (
+	"bytes"
+	"testing"
+)
+
+// atscPayload ATSC A/53 user_data_registered_itu_t_t35 不包含sei头
+func atscPayload(flags byte, ccData ...byte) []byte {
+	ret := []byte{t35CountryCodeUS, 0x00, 0x31, 'G', 'A', '9', '4', atscUserDataCC, flags, 0xff}
+	ret = append(ret, ccData...)
+	// marker_bits
+	return append(ret, 0xff)
+}
+
+// seiNALUnit 单条sei消息 加上rbsp_trailing_bits
+func seiNALUnit(payloadType int, payload []byte) []byte {
+	ret := []byte{nalu_type_sei}
+	for ; payloadType >= 0xff; payloadType -= 0xff {
+		ret = append(ret, 0xff)
+	}
+	ret = append(ret, byte(payloadType))
+	size := len(payload)
+	for ; size >= 0xff; size -= 0xff {
+		ret = append(ret, 0xff)
+	}
+	ret = append(ret, byte(size))
+	ret = append(ret, payload...)
+	return append(ret, 0x80)
+}
+
+func TestParseSEINALUnit(t *testing.T) {
+	long := bytes.Repeat([]byte{0x11}, 300)
+	tests := []struct {
+		name     string
+		data     []byte
+		messages []SEIMessage
+		wantErr  bool
+	}{
+		{
+			name:     "caption",
+			data:     seiNALUnit(4, atscPayload(0x41, 0xfc, 0x94, 0x20)),
+			messages: []SEIMessage{{PayloadType: 4, Payload: atscPayload(0x41, 0xfc, 0x94, 0x20)}},
+		},
+		{
+			name:     "large type and size",
+			data:     seiNALUnit(256, long),
+			messages: []SEIMessage{{PayloadType: 256, Payload: long}},
+		},
+		{
+			name: "multiple messages",
+			// recovery point和user data unregistered
+			data: append([]byte{nalu_type_sei, 6, 2, 0x84, 0x10}, seiNALUnit(5, []byte("0123456789abcdefX"))[1:]...),
+			messages: []SEIMessage{
+				{PayloadType: 6, Payload: []byte{0x84, 0x10}},
+				{PayloadType: 5, Payload: []byte("0123456789abcdefX")},
+			},
+		},
+		{
+			name:     "emulation prevention removed",
+			data:     []byte{nalu_type_sei, 5, 4, 0x00, 0x00, 0x03, 0x01, 0x02, 0x80},
+			messages: []SEIMessage{{PayloadType: 5, Payload: []byte{0x00, 0x00, 0x01, 0x02}}},
+		},
+		{
+			name:    "not sei",
+			data:    []byte{0x65, 0x88, 0x80},
+			wantErr: true,
+		},
+		{
+			name:    "payload truncated",
+			data:    []byte{nalu_type_sei, 4, 10, 0xb5, 0x00, 0x80},
+			wantErr: true,
+		},
+		{
+			name:    "size missing",
+			data:    []byte{nalu_type_sei, 0xff, 0xff},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			messages, err := ParseSEINALUnit(tt.data)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("want error, got %v", messages)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(messages) != len(tt.messages) {
+				t.Fatalf("messages = %v, want %v", messages, tt.messages)
+			}
+			for i := range messages {
+				if messages[i].PayloadType != tt.messages[i].PayloadType || !bytes.Equal(messages[i].Payload, tt.messages[i].Payload) {
+					t.Fatalf("message %d = %v, want %v", i, messages[i], tt.messages[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSEIMessageCCData(t *testing.T) {
+	// CC1 RCL 和 "HI"
+	ccData := []byte{0xfc, 0x94, 0x20, 0xfc, 0xc8, 0x49}
+	tests := []struct {
+		name    string
+		message SEIMessage
+		want    []byte
+	}{
+		{
+			name:    "atsc cc_data",
+			message: SEIMessage{PayloadType: 4, Payload: atscPayload(0x42, ccData...)},
+			want:    ccData,
+		},
+		{
+			name:    "cc_count larger than data",
+			message: SEIMessage{PayloadType: 4, Payload: atscPayload(0x45, ccData...)[:10+len(ccData)]},
+			want:    ccData,
+		},
+		{
+			name:    "process_cc_data_flag not set",
+			message: SEIMessage{PayloadType: 4, Payload: atscPayload(0x02, ccData...)},
+		},
+		{
+			name:    "not user data registered",
+			message: SEIMessage{PayloadType: 5, Payload: atscPayload(0x42, ccData...)},
+		},
+		{
+			name: "other country",
+			message: SEIMessage{PayloadType: 4, Payload: func() []byte {
+				b := atscPayload(0x42, ccData...)
+				b[0] = 0x26
+				return b
+			}()},
+		},
+		{
+			name: "not GA94",
+			message: SEIMessage{PayloadType: 4, Payload: func() []byte {
+				b := atscPayload(0x42, ccData...)
+				copy(b[3:7], "DTG1")
+				return b
+			}()},
+		},
+		{
+			name:    "too short",
+			message: SEIMessage{PayloadType: 4, Payload: []byte{t35CountryCodeUS, 0x00, 0x31}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.message.CCData(); !bytes.Equal(got, tt.want) {
+				t.Fatalf("CCData() = %x, want %x", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestSEICaptionRoundTrip 从sei nalu取出cc_data
+func TestSEICaptionRoundTrip(t *testing.T) {
+	// 第二组cc_data中的00 00 01需要防竞争字节
+	ccData := []byte{0xfc, 0x94, 0x2c, 0xf9, 0x00, 0x00, 0x01, 0x80, 0x80}
+	payload := atscPayload(0x43, ccData...)
+	raw := seiNALUnit(4, payload)
+	escaped := make([]byte, 0, len(raw)+1)
+	zeros := 0
+	for _, b := range raw {
+		if zeros == 2 && b <= 0x03 {
+			escaped = append(escaped, startCodeEmulationPreventionByte)
+			zeros = 0
+		}
+		escaped = append(escaped, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	if len(escaped) == len(raw) {
+		t.Fatal("test data should contain emulation prevention bytes")
+	}
+	messages, err := ParseSEINALUnit(escaped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 {
+		t.Fatalf("messages = %v", messages)
+	}
+	if got := messages[0].CCData(); !bytes.Equal(got, ccData) {
+		t.Fatalf("CCData() = %x, want %x", got, ccData)
+	}
+}
@@ -36,6 +36,14 @@ func (c *CodecParser) SampleRate() (int, error) {
 	return c.mp3.SampleRate(), nil
 }
 
+// CCData 最近一次解析的h264帧中的cea-608/708字幕数据
+func (c *CodecParser) CCData() []byte {
+	if c.h264 == nil {
+		return nil
+	}
+	return c.h264.CCData()
+}
+
 func (c *CodecParser) Parse(p *av.Packet) error {
 	if p.IsVideo {
 		f, ok := p.Header.(av.VideoPacketHeader)
@@ -0,0 +1,105 @@
+package record
+
+import (
+	"github.com/LeeZXin/zsf/property/static"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	FlvFormat  = "flv"
+	TsFormat   = "ts"
+	Fmp4Format = "fmp4"
+
+	defaultDir              = "./record"
+	defaultFileTemplate     = "{app}/{name}/{name}_{time}_{index}"
+	defaultManifestTemplate = "{app}/{name}/{name}_{time}"
+)
+
+// Config 录制配置 可按app配置record.apps.{app}.xxx 没有则使用record.xxx
+type Config struct {
+	Enable           bool
+	Dir              string
+	FileTemplate     string
+	ManifestTemplate string
+	Format           string
+	// RotateDuration 单个文件最大时长 0不切割
+	RotateDuration time.Duration
+	// RotateSize 单个文件最大字节数 0不切割
+	RotateSize  int64
+	CallbackUrl string
+}
+
+// GetConfig 获取app的录制配置
+func GetConfig(app string) Config {
+	ret := Config{
+		Enable:           getString(app, "enable") == "true",
+		Dir:              getString(app, "dir"),
+		FileTemplate:     getString(app, "filename"),
+		ManifestTemplate: getString(app, "manifest"),
+		Format:           strings.ToLower(getString(app, "format")),
+		RotateDuration:   time.Duration(getInt(app, "rotateDuration")) * time.Second,
+		RotateSize:       int64(getInt(app, "rotateSize")) * 1024 * 1024,
+		CallbackUrl:      getString(app, "callbackUrl"),
+	}
+	if ret.Dir == "" {
+		ret.Dir = defaultDir
+	}
+	if ret.FileTemplate == "" {
+		ret.FileTemplate = defaultFileTemplate
+	}
+	if ret.ManifestTemplate == "" {
+		ret.ManifestTemplate = defaultManifestTemplate
+	}
+	switch ret.Format {
+	case TsFormat, Fmp4Format:
+	default:
+		ret.Format = FlvFormat
+	}
+	return ret
+}
+
+func getString(app, field string) string {
+	ret := static.GetString("record.apps." + app + "." + field)
+	if ret == "" {
+		ret = static.GetString("record." + field)
+	}
+	return ret
+}
+
+func getInt(app, field string) int {
+	ret := static.GetInt("record.apps." + app + "." + field)
+	if ret == 0 {
+		ret = static.GetInt("record." + field)
+	}
+	return ret
+}
+
+func fileExt(format string) string {
+	switch format {
+	case TsFormat:
+		return ".ts"
+	case Fmp4Format:
+		return ".mp4"
+	default:
+		return ".flv"
+	}
+}
+
+var (
+	pathReplacer = strings.NewReplacer("/", "_", "\\", "_", "..", "_")
+)
+
+// expandTemplate 替换文件名模板中的变量
+// {app} {name} {session} {time} {unix} {index}
+func expandTemplate(tpl, app, name, sessionId string, t time.Time, index int) string {
+	return strings.NewReplacer(
+		"{app}", pathReplacer.Replace(app),
+		"{name}", pathReplacer.Replace(name),
+		"{session}", sessionId,
+		"{time}", t.Format("20060102150405"),
+		"{unix}", strconv.FormatInt(t.UnixMilli(), 10),
+		"{index}", strconv.Itoa(index),
+	).Replace(tpl)
+}
@@ -0,0 +1,92 @@
+package record
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/LeeZXin/zsf/logger"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FileInfo 单个录制文件
+type FileInfo struct {
+	App            string    `json:"app"`
+	Name           string    `json:"name"`
+	SessionId      string    `json:"sessionId"`
+	Index          int       `json:"index"`
+	Format         string    `json:"format"`
+	Path           string    `json:"path"`
+	Size           int64     `json:"size"`
+	Duration       int64     `json:"duration"`
+	FirstTimestamp uint32    `json:"firstTimestamp"`
+	LastTimestamp  uint32    `json:"lastTimestamp"`
+	StartTime      time.Time `json:"startTime"`
+	EndTime        time.Time `json:"endTime"`
+}
+
+// Manifest 一次录制的所有文件
+type Manifest struct {
+	App       string     `json:"app"`
+	Name      string     `json:"name"`
+	SessionId string     `json:"sessionId"`
+	Format    string     `json:"format"`
+	StartTime time.Time  `json:"startTime"`
+	EndTime   time.Time  `json:"endTime"`
+	Finished  bool       `json:"finished"`
+	Files     []FileInfo `json:"files"`
+}
+
+func (m *Manifest) save(path string) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0644)
+}
+
+var (
+	callbackMu = sync.RWMutex{}
+	callbacks  = make([]func(FileInfo), 0)
+
+	httpClient = &http.Client{
+		Timeout: 3 * time.Second,
+	}
+)
+
+// RegisterCompleteCallback 注册文件录制完成回调
+func RegisterCompleteCallback(fn func(FileInfo)) {
+	if fn == nil {
+		return
+	}
+	callbackMu.Lock()
+	defer callbackMu.Unlock()
+	callbacks = append(callbacks, fn)
+}
+
+// notifyComplete 执行回调 配置了callbackUrl则post文件信息
+func notifyComplete(info FileInfo, callbackUrl string) {
+	callbackMu.RLock()
+	fns := callbacks
+	callbackMu.RUnlock()
+	for _, fn := range fns {
+		fn(info)
+	}
+	if callbackUrl == "" {
+		return
+	}
+	go func() {
+		b, _ := json.Marshal(info)
+		resp, err := httpClient.Post(callbackUrl, "application/json;charset=utf-8", bytes.NewReader(b))
+		if err != nil {
+			logger.Logger.Errorf("record callback %s err: %v", callbackUrl, err)
+			return
+		}
+		resp.Body.Close()
+	}()
+}
@@ -0,0 +1,158 @@
+package record
+
+import (
+	"bytes"
+	"github.com/LeeZXin/z-live/av"
+	"github.com/LeeZXin/z-live/flv"
+	"github.com/LeeZXin/z-live/fmp4"
+	"github.com/LeeZXin/z-live/hls/ts"
+	"github.com/LeeZXin/z-live/parser"
+	"io"
+)
+
+// fileMuxer 将带flv tag头的packet写入文件
+type fileMuxer interface {
+	WritePacket(*av.Packet) error
+	Close() error
+}
+
+func newFileMuxer(format string, w io.Writer) (fileMuxer, error) {
+	switch format {
+	case TsFormat:
+		return newTsFileMuxer(w), nil
+	case Fmp4Format:
+		return fmp4.NewMuxer(w), nil
+	default:
+		m := flv.NewFileMuxer(w)
+		if err := m.WriteHeader(); err != nil {
+			return nil, err
+		}
+		return &flvFileMuxer{Muxer: m}, nil
+	}
+}
+
+// fileFinalizer 文件关闭后需要再处理 返回新的文件大小
+type fileFinalizer interface {
+	Finalize(path string) (int64, error)
+}
+
+// flvFileMuxer 文件关闭后重写onMetaData
+type flvFileMuxer struct {
+	*flv.Muxer
+}
+
+func (*flvFileMuxer) Close() error {
+	return nil
+}
+
+const (
+	// tsTableInterval 纯音频时pat pmt的间隔 单位毫秒
+	tsTableInterval = 1000
+)
+
+// tsFileMuxer h264转annexb aac转adts后写入ts
+type tsFileMuxer struct {
+	muxer    *ts.Muxer
+	parser   *parser.CodecParser
+	buf      *bytes.Buffer
+	hasVideo bool
+	hasAudio bool
+	// tableChanged 音视频流变化 需要重写pmt
+	tableChanged bool
+	hasTable     bool
+	lastTableTs  uint32
+}
+
+func newTsFileMuxer(w io.Writer) *tsFileMuxer {
+	buf := bytes.NewBuffer(nil)
+	return &tsFileMuxer{
+		muxer:  ts.NewMuxer(w),
+		parser: parser.NewCodecParser(buf),
+		buf:    buf,
+	}
+}
+
+func (m *tsFileMuxer) WritePacket(p *av.Packet) error {
+	if p.IsMetadata {
+		return nil
+	}
+	p = p.Copy()
+	err := flv.Demux(p)
+	if err == flv.ErrAvcEndSEQ {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	isKeyFrame := false
+	if p.IsVideo {
+		vh := p.Header.(av.VideoPacketHeader)
+		if vh.CodecID() != av.VIDEO_H264 {
+			return nil
+		}
+		if vh.IsSeq() {
+			if !m.hasVideo {
+				m.hasVideo = true
+				m.tableChanged = true
+			}
+			return m.parser.Parse(p)
+		}
+		isKeyFrame = vh.IsKeyFrame()
+	} else {
+		ah := p.Header.(av.AudioPacketHeader)
+		if ah.SoundFormat() != av.SOUND_AAC {
+			return nil
+		}
+		if ah.AACPacketType() == av.AAC_SEQHDR {
+			if !m.hasAudio {
+				m.hasAudio = true
+				m.tableChanged = true
+			}
+			return m.parser.Parse(p)
+		}
+	}
+	m.buf.Reset()
+	if err = m.parser.Parse(p); err != nil {
+		return err
+	}
+	p.Data = m.buf.Bytes()
+	if m.needTable(p.Timestamp, isKeyFrame) {
+		if err = m.muxer.WritePAT(); err != nil {
+			return err
+		}
+		if err = m.muxer.WritePMTStreams(av.SOUND_AAC, m.hasAudio, m.hasVideo); err != nil {
+			return err
+		}
+		m.hasTable = true
+		m.tableChanged = false
+		m.lastTableTs = p.Timestamp
+	}
+	return m.muxer.WritePacket(p)
+}
+
+// needTable 每个关键帧前写pat pmt 方便随机播放 纯音频时按间隔写
+func (m *tsFileMuxer) needTable(ts uint32, isKeyFrame bool) bool {
+	if !m.hasTable || m.tableChanged || isKeyFrame {
+		return true
+	}
+	if m.hasVideo {
+		return false
+	}
+	return ts < m.lastTableTs || ts-m.lastTableTs >= tsTableInterval
+}
+
+func (*tsFileMuxer) Close() error {
+	return nil
+}
+
+// countWriter 统计写入的字节数
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.n += int64(n)
+	return n, err
+}
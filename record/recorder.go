@@ -0,0 +1,354 @@
+package record
+
+import (
+	"context"
+	"github.com/LeeZXin/z-live/amf"
+	"github.com/LeeZXin/z-live/av"
+	"github.com/LeeZXin/zsf-utils/quit"
+	"github.com/LeeZXin/zsf-utils/threadutil"
+	"github.com/LeeZXin/zsf/logger"
+	"github.com/google/uuid"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxQueueNum = 1024
+)
+
+/*
+Recorder 录制
+按时长或大小在关键帧处切割文件 每个文件都以metadata和sequence header开头
+每次录制生成一个manifest 每个文件写完后回调
+*/
+type Recorder struct {
+	app          string
+	name         string
+	config       Config
+	manifest     *Manifest
+	manifestPath string
+	current      *segment
+	metadata     *av.Packet
+	videoSeq     *av.Packet
+	audioSeq     *av.Packet
+	packetQueue  chan *av.Packet
+	ctx          context.Context
+	cancelFn     context.CancelFunc
+	closeOnce    sync.Once
+	doneCh       chan struct{}
+	// dropping 队列满后丢弃视频帧直到下一个关键帧 只在推流协程中访问
+	dropping bool
+	// mu 保护manifest和current的文件信息 用于查询状态
+	mu sync.RWMutex
+}
+
+// segment 正在写的文件
+type segment struct {
+	file    *os.File
+	counter *countWriter
+	muxer   fileMuxer
+	info    FileInfo
+	// baseTs 文件内时间戳从0开始
+	baseTs uint32
+}
+
+func NewRecorder(app, name string, config Config) *Recorder {
+	ctx, cancelFn := context.WithCancel(context.Background())
+	now := time.Now()
+	sessionId := strings.ReplaceAll(uuid.NewString(), "-", "")
+	ret := &Recorder{
+		app:    app,
+		name:   name,
+		config: config,
+		manifest: &Manifest{
+			App:       app,
+			Name:      name,
+			SessionId: sessionId,
+			Format:    config.Format,
+			StartTime: now,
+			Files:     make([]FileInfo, 0),
+		},
+		manifestPath: filepath.Join(config.Dir, expandTemplate(config.ManifestTemplate, app, name, sessionId, now, 0)+".json"),
+		packetQueue:  make(chan *av.Packet, maxQueueNum),
+		ctx:          ctx,
+		cancelFn:     cancelFn,
+		closeOnce:    sync.Once{},
+		doneCh:       make(chan struct{}),
+		mu:           sync.RWMutex{},
+	}
+	quit.AddShutdownHook(func() {
+		ret.Close()
+		ret.Wait()
+	})
+	go ret.muxPacket()
+	return ret
+}
+
+// WritePacket 不阻塞推流 队列满时丢弃 之后的视频帧丢到下一个关键帧 保证文件可以解码
+func (r *Recorder) WritePacket(p *av.Packet) error {
+	if err := r.ctx.Err(); err != nil {
+		return err
+	}
+	if r.dropping && p.IsVideo && !isVideoSeq(p) && !isVideoKeyFrame(p) {
+		return nil
+	}
+	return threadutil.RunSafe(func() {
+		select {
+		case r.packetQueue <- p.Copy():
+			if p.IsVideo {
+				r.dropping = false
+			}
+		default:
+			if !r.dropping {
+				logger.Logger.Errorf("record %s queue is full, drop until next keyframe", r.Key())
+			}
+			r.dropping = true
+		}
+	})
+}
+
+func (r *Recorder) Close() {
+	r.closeOnce.Do(func() {
+		r.cancelFn()
+		close(r.packetQueue)
+		deregisterRecorder(r)
+	})
+}
+
+// Wait 等待文件和manifest写完
+func (r *Recorder) Wait() {
+	<-r.doneCh
+}
+
+// Key 录制的流
+func (r *Recorder) Key() string {
+	return r.app + "/" + r.name
+}
+
+// Status 录制状态
+func (r *Recorder) Status() Status {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	ret := Status{
+		Key:          r.Key(),
+		SessionId:    r.manifest.SessionId,
+		Format:       r.manifest.Format,
+		ManifestPath: r.manifestPath,
+		StartTime:    r.manifest.StartTime,
+		Recording:    !r.manifest.Finished && r.ctx.Err() == nil,
+		Finishing:    !r.manifest.Finished && r.ctx.Err() != nil,
+		Files:        append([]FileInfo(nil), r.manifest.Files...),
+	}
+	if r.current != nil {
+		current := r.current.info
+		ret.Current = &current
+	}
+	return ret
+}
+
+func (r *Recorder) muxPacket() {
+	defer func() {
+		r.closeSegment()
+		r.mu.Lock()
+		r.manifest.EndTime = time.Now()
+		r.manifest.Finished = true
+		err := r.manifest.save(r.manifestPath)
+		r.mu.Unlock()
+		if err != nil {
+			logger.Logger.Error(err)
+		}
+		close(r.doneCh)
+	}()
+	for p := range r.packetQueue {
+		if err := r.handle(p); err != nil {
+			logger.Logger.Errorf("record %s/%s err: %v", r.app, r.name, err)
+			r.Close()
+			// 取出剩余的包 防止阻塞
+			for range r.packetQueue {
+			}
+			return
+		}
+	}
+}
+
+func (r *Recorder) handle(p *av.Packet) error {
+	isHeader := true
+	switch {
+	case p.IsMetadata:
+		if amf.ScriptDataName(p.Data) != amf.OnTextData {
+			r.metadata = p
+		}
+	case isVideoSeq(p):
+		r.videoSeq = p
+	case isAudioSeq(p):
+		r.audioSeq = p
+	default:
+		isHeader = false
+	}
+	if isHeader {
+		if r.current != nil {
+			return r.write(p)
+		}
+		return nil
+	}
+	isKeyFrame := isVideoKeyFrame(p)
+	if r.current != nil && r.shouldRotate(p) && (isKeyFrame || r.videoSeq == nil) {
+		r.closeSegment()
+	}
+	if r.current == nil {
+		// 有视频时从关键帧开始
+		if r.videoSeq != nil && !isKeyFrame {
+			return nil
+		}
+		if err := r.openSegment(p.Timestamp); err != nil {
+			return err
+		}
+	}
+	return r.write(p)
+}
+
+func (r *Recorder) write(p *av.Packet) error {
+	err := r.current.write(p)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	info := &r.current.info
+	if !p.IsMetadata && p.Timestamp > info.LastTimestamp {
+		info.LastTimestamp = p.Timestamp
+	}
+	info.Size = r.current.counter.n
+	info.Duration = int64(info.LastTimestamp - info.FirstTimestamp)
+	return err
+}
+
+func (r *Recorder) shouldRotate(p *av.Packet) bool {
+	first := r.current.info.FirstTimestamp
+	if r.config.RotateDuration > 0 && p.Timestamp > first &&
+		time.Duration(p.Timestamp-first)*time.Millisecond >= r.config.RotateDuration {
+		return true
+	}
+	return r.config.RotateSize > 0 && r.current.counter.n >= r.config.RotateSize
+}
+
+func (r *Recorder) openSegment(timestamp uint32) error {
+	now := time.Now()
+	index := len(r.manifest.Files)
+	path := filepath.Join(r.config.Dir,
+		expandTemplate(r.config.FileTemplate, r.app, r.name, r.manifest.SessionId, now, index)+fileExt(r.config.Format))
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	counter := &countWriter{w: file}
+	muxer, err := newFileMuxer(r.config.Format, counter)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	seg := &segment{
+		file:    file,
+		counter: counter,
+		muxer:   muxer,
+		baseTs:  timestamp,
+		info: FileInfo{
+			App:            r.app,
+			Name:           r.name,
+			SessionId:      r.manifest.SessionId,
+			Index:          index,
+			Format:         r.config.Format,
+			Path:           path,
+			FirstTimestamp: timestamp,
+			LastTimestamp:  timestamp,
+			StartTime:      now,
+		},
+	}
+	r.mu.Lock()
+	r.current = seg
+	r.mu.Unlock()
+	// 每个文件都先写metadata和sequence header
+	for _, h := range []*av.Packet{r.metadata, r.videoSeq, r.audioSeq} {
+		if h == nil {
+			continue
+		}
+		c := *h
+		c.Timestamp = timestamp
+		if err = r.write(&c); err != nil {
+			return err
+		}
+	}
+	logger.Logger.Infof("record %s/%s start file: %s", r.app, r.name, path)
+	return nil
+}
+
+func (r *Recorder) closeSegment() {
+	seg := r.current
+	if seg == nil {
+		return
+	}
+	if err := seg.muxer.Close(); err != nil {
+		logger.Logger.Error(err)
+	}
+	seg.file.Close()
+	info := seg.info
+	info.Size = seg.counter.n
+	if f, ok := seg.muxer.(fileFinalizer); ok {
+		size, err := f.Finalize(info.Path)
+		if err != nil {
+			logger.Logger.Error(err)
+		} else {
+			info.Size = size
+		}
+	}
+	info.EndTime = time.Now()
+	r.mu.Lock()
+	r.current = nil
+	r.manifest.Files = append(r.manifest.Files, info)
+	err := r.manifest.save(r.manifestPath)
+	r.mu.Unlock()
+	if err != nil {
+		logger.Logger.Error(err)
+	}
+	logger.Logger.Infof("record %s/%s finish file: %s size: %d duration: %dms",
+		r.app, r.name, info.Path, info.Size, info.Duration)
+	notifyComplete(info, r.config.CallbackUrl)
+}
+
+// write 写入文件 时间戳减去文件的起始时间戳
+func (s *segment) write(p *av.Packet) error {
+	c := *p
+	if c.Timestamp > s.baseTs {
+		c.Timestamp -= s.baseTs
+	} else {
+		c.Timestamp = 0
+	}
+	return s.muxer.WritePacket(&c)
+}
+
+func isVideoSeq(p *av.Packet) bool {
+	if !p.IsVideo {
+		return false
+	}
+	vh, ok := p.Header.(av.VideoPacketHeader)
+	return ok && vh.IsSeq()
+}
+
+func isAudioSeq(p *av.Packet) bool {
+	if !p.IsAudio {
+		return false
+	}
+	ah, ok := p.Header.(av.AudioPacketHeader)
+	return ok && ah.SoundFormat() == av.SOUND_AAC && ah.AACPacketType() == av.AAC_SEQHDR
+}
+
+func isVideoKeyFrame(p *av.Packet) bool {
+	if !p.IsVideo {
+		return false
+	}
+	vh, ok := p.Header.(av.VideoPacketHeader)
+	return ok && vh.IsKeyFrame() && !vh.IsSeq()
+}
@@ -0,0 +1,93 @@
+package record
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrRecording    = errors.New("stream is recording")
+	ErrNotRecording = errors.New("stream is not recording")
+)
+
+/*
+正在录制的流
+每个流同时只有一个录制
+*/
+var (
+	rmu         = sync.RWMutex{}
+	recorderMap = make(map[string]*Recorder, 8)
+)
+
+// Status 录制状态
+type Status struct {
+	Key          string    `json:"key"`
+	SessionId    string    `json:"sessionId"`
+	Format       string    `json:"format"`
+	ManifestPath string    `json:"manifestPath"`
+	StartTime    time.Time `json:"startTime"`
+	Recording    bool      `json:"recording"`
+	// Finishing 已经停止 文件还在写
+	Finishing bool       `json:"finishing"`
+	Current   *FileInfo  `json:"current,omitempty"`
+	Files     []FileInfo `json:"files"`
+}
+
+// Start 开始录制 需要将返回的recorder注册到推流端
+func Start(app, name string, config Config) (*Recorder, error) {
+	key := app + "/" + name
+	rmu.Lock()
+	defer rmu.Unlock()
+	if _, ok := recorderMap[key]; ok {
+		return nil, ErrRecording
+	}
+	ret := NewRecorder(app, name, config)
+	recorderMap[key] = ret
+	return ret, nil
+}
+
+// Stop 停止录制 不等待文件写完 需要时调用Wait
+func Stop(key string) (*Recorder, error) {
+	rmu.Lock()
+	recorder, ok := recorderMap[key]
+	delete(recorderMap, key)
+	rmu.Unlock()
+	if !ok {
+		return nil, ErrNotRecording
+	}
+	recorder.Close()
+	return recorder, nil
+}
+
+// Find 获取正在录制的recorder
+func Find(key string) (*Recorder, bool) {
+	rmu.RLock()
+	defer rmu.RUnlock()
+	ret, ok := recorderMap[key]
+	return ret, ok
+}
+
+// List 所有正在录制的状态
+func List() []Status {
+	rmu.RLock()
+	recorders := make([]*Recorder, 0, len(recorderMap))
+	for _, recorder := range recorderMap {
+		recorders = append(recorders, recorder)
+	}
+	rmu.RUnlock()
+	ret := make([]Status, 0, len(recorders))
+	for _, recorder := range recorders {
+		ret = append(ret, recorder.Status())
+	}
+	return ret
+}
+
+// deregisterRecorder 录制结束 只移除自己
+func deregisterRecorder(recorder *Recorder) {
+	rmu.Lock()
+	defer rmu.Unlock()
+	if recorderMap[recorder.Key()] == recorder {
+		delete(recorderMap, recorder.Key())
+	}
+}
@@ -118,6 +118,9 @@ func (c *chunkStream) writeHeader(conn *netConn) error {
 
 // writeChunk 将chunk流写到conn中
 func (c *chunkStream) writeChunk(conn *netConn) error {
+	// 点播时命令响应和音视频在不同协程写入
+	conn.writeLock.Lock()
+	defer conn.writeLock.Unlock()
 	if c.typeId == idSetChunkSize {
 		conn.chunkSize = binary.BigEndian.Uint32(c.data)
 	}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"github.com/LeeZXin/z-live/amf"
 	"github.com/LeeZXin/zsf/logger"
+	"sync"
 )
 
 var (
@@ -28,6 +29,16 @@ type connectCmd struct {
 type publishCmd struct {
 	PubName string `json:"pubName"`
 	PubType string `json:"pubType"`
+	// Start play的开始时间 单位毫秒 -2直播或点播 -1只播直播 >=0点播开始位置
+	Start float64 `json:"start"`
+	// Duration play的播放时长 单位毫秒 -1播放到结束
+	Duration float64 `json:"duration"`
+}
+
+// vodController 点播的拖动和暂停
+type vodController interface {
+	Seek(uint32) error
+	Pause(bool) error
 }
 
 type cmdHandler struct {
@@ -38,8 +49,12 @@ type cmdHandler struct {
 
 	cntCmd *connectCmd
 	pubCmd *publishCmd
+	// vod 点播时不为空
+	vod vodController
 
 	buf *bytes.Buffer
+	// msgLock 点播时播放结束的通知和命令响应在不同协程
+	msgLock sync.Mutex
 }
 
 func (c *cmdHandler) connect(vs []any) error {
@@ -115,6 +130,8 @@ func (c *cmdHandler) connectResp(cur *chunkStream) error {
 }
 
 func (c *cmdHandler) writeMsg(csid, streamId uint32, args ...any) error {
+	c.msgLock.Lock()
+	defer c.msgLock.Unlock()
 	c.buf.Reset()
 	for _, v := range args {
 		if _, err := c.conn.amfCodec.Encode(c.buf, v, amf.AMF0); err != nil {
@@ -161,7 +178,10 @@ func (c *cmdHandler) createStreamResp(cur *chunkStream) error {
 }
 
 func (c *cmdHandler) publishOrPlay(vs []any) error {
-	cmd := &publishCmd{}
+	cmd := &publishCmd{
+		Start:    -2,
+		Duration: -1,
+	}
 	for k, v := range vs {
 		switch v.(type) {
 		case string:
@@ -173,8 +193,16 @@ func (c *cmdHandler) publishOrPlay(vs []any) error {
 				cmd.PubType = v.(string)
 			}
 		case float64:
-			id := int(v.(float64))
-			c.transactionId = id
+			switch k {
+			case 0:
+				c.transactionId = int(v.(float64))
+			case 3:
+				// play的开始时间
+				cmd.Start = v.(float64)
+			case 4:
+				// play的播放时长
+				cmd.Duration = v.(float64)
+			}
 		case amf.Object:
 		}
 	}
@@ -198,6 +226,17 @@ func (c *cmdHandler) setBegin() error {
 	return ret.writeChunk(c.conn)
 }
 
+func (c *cmdHandler) setEOF() error {
+	ret := userControlMsg(streamEOF, 4)
+	for i := 0; i < 4; i++ {
+		ret.data[2+i] = byte(1 >> uint32((3-i)*8) & 0xff)
+	}
+	if err := ret.writeChunk(c.conn); err != nil {
+		return err
+	}
+	return c.conn.Flush()
+}
+
 func (c *cmdHandler) setRecorded() error {
 	ret := userControlMsg(streamIsRecorded, 4)
 	for i := 0; i < 4; i++ {
@@ -243,3 +282,47 @@ func (c *cmdHandler) playResp(cur *chunkStream) error {
 	}
 	return c.conn.Flush()
 }
+
+// seek 点播拖动 seek(transactionId, null, ms)
+func (c *cmdHandler) seek(vs []any, cur *chunkStream) error {
+	if c.vod == nil || len(vs) < 3 {
+		return nil
+	}
+	ms, ok := vs[2].(float64)
+	if !ok || ms < 0 {
+		return nil
+	}
+	if err := c.vod.Seek(uint32(ms)); err != nil {
+		return err
+	}
+	if err := c.setBegin(); err != nil {
+		return err
+	}
+	return c.onStatus(cur, "NetStream.Seek.Notify", "Seeking.")
+}
+
+// pause 点播暂停 pause(transactionId, null, pause, ms)
+func (c *cmdHandler) pause(vs []any, cur *chunkStream) error {
+	if c.vod == nil || len(vs) < 3 {
+		return nil
+	}
+	pause, ok := vs[2].(bool)
+	if !ok {
+		return nil
+	}
+	if err := c.vod.Pause(pause); err != nil {
+		return err
+	}
+	if pause {
+		return c.onStatus(cur, "NetStream.Pause.Notify", "Paused.")
+	}
+	return c.onStatus(cur, "NetStream.Unpause.Notify", "Unpaused.")
+}
+
+func (c *cmdHandler) onStatus(cur *chunkStream, code, description string) error {
+	event := make(amf.Object)
+	event["level"] = "status"
+	event["code"] = code
+	event["description"] = description
+	return c.writeMsg(cur.csid, cur.streamId, "onStatus", 0, nil, event)
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/LeeZXin/zsf/logger"
 	"io"
 	"net"
+	"sync"
 )
 
 const (
@@ -39,6 +40,8 @@ var (
 	cmdFCUnpublish   = "FCUnpublish"
 	cmdDeleteStream  = "deleteStream"
 	cmdPlay          = "play"
+	cmdSeek          = "seek"
+	cmdPause         = "pause"
 )
 
 // netConn rtmp单个conn
@@ -57,6 +60,7 @@ type netConn struct {
 	cs                  *chunkStream
 	cmdHandler          *cmdHandler
 	chunks              map[uint32]*chunkStream
+	writeLock           sync.Mutex
 }
 
 func newNetConn(conn net.Conn, bufSize int) *netConn {
@@ -88,6 +92,8 @@ func (c *netConn) Write(p []byte) (int, error) {
 }
 
 func (c *netConn) Flush() error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
 	return c.buf.Flush()
 }
 
@@ -249,6 +255,14 @@ func handleCmdMsg(c *netConn) error {
 			if err = handler.releaseStream(vs); err != nil {
 				return err
 			}
+		case cmdSeek:
+			if err = handler.seek(vs[1:], cs); err != nil {
+				return err
+			}
+		case cmdPause:
+			if err = handler.pause(vs[1:], cs); err != nil {
+				return err
+			}
 		case cmdFCUnpublish:
 		case cmdDeleteStream:
 		default:
@@ -0,0 +1,483 @@
+package rtmp
+
+import (
+	"context"
+	"errors"
+	"github.com/LeeZXin/z-live/amf"
+	"github.com/LeeZXin/z-live/av"
+	"github.com/LeeZXin/zsf/logger"
+	"github.com/LeeZXin/zsf/property/static"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	srcNone = iota
+	srcPrimary
+	srcBackup
+	srcSlate
+	srcNum
+)
+
+const (
+	defaultStallTimeout   = 3000 * time.Millisecond
+	failoverCheckInterval = 200 * time.Millisecond
+	// switchGap 切换输入源时和之前最后一帧的时间间隔 单位毫秒
+	switchGap = 40
+)
+
+/*
+主备推流
+failover.{app}.{name}.backup配置了备用流key时 主推流不直接注册 而是作为failoverSource的输入
+主推流断开或者超过failover.stallTimeout毫秒没有数据时 在备用流的下一个关键帧切换到备用流 主推流恢复后再切换回来
+主备都不可用时 如果配置了垫片slate.file 循环播放垫片直到推流恢复或者超过slate.timeout
+超时后断开拉流端 配置slate.freeze时主推流仍然连接则停止垫片等待恢复
+切换时重新发送sequence header 时间戳保持递增 拉流端不用重新连接
+*/
+var (
+	fmu         = sync.Mutex{}
+	failoverMap = make(map[string]*failoverSource, 8)
+)
+
+// getFailoverBackup 推流配置的备用流key
+func getFailoverBackup(app, name string) string {
+	ret := static.GetString("failover." + app + "." + name + ".backup")
+	if ret == app+"/"+name {
+		return ""
+	}
+	return ret
+}
+
+func getStallTimeout() time.Duration {
+	ret := static.GetInt("failover.stallTimeout")
+	if ret <= 0 {
+		return defaultStallTimeout
+	}
+	return time.Duration(ret) * time.Millisecond
+}
+
+// publishWithFailover 主推流 阻塞直到推流断开
+func publishWithFailover(app, name, backupKey string, slate slateConfig, conn *netConn) {
+	key := app + "/" + name
+	for {
+		fmu.Lock()
+		source, ok := failoverMap[key]
+		// 输出已经关闭但还没从map移除 直接移除后重新创建 不等Close 避免空转
+		if ok && source.ctx.Err() != nil {
+			delete(failoverMap, key)
+			ok = false
+		}
+		if !ok {
+			source = newFailoverSource(key, backupKey, slate)
+			failoverMap[key] = source
+			publisher := newStreamPublisher(source)
+			registerPublisher(key, publisher)
+			go servePublisher(app, name, publisher)
+		}
+		fmu.Unlock()
+		// 输出已经结束 重新创建
+		if source.attachPrimary(conn) {
+			return
+		}
+	}
+}
+
+type failoverPacket struct {
+	src     int
+	session int64
+	writer  *failoverBackupWriter
+	slate   *slatePlayer
+	p       *av.Packet
+}
+
+// sourceState 输入源状态
+type sourceState struct {
+	lastRecv time.Time
+	metadata *av.Packet
+	videoSeq *av.Packet
+	audioSeq *av.Packet
+}
+
+func (s *sourceState) reset() {
+	s.lastRecv = time.Now()
+	s.metadata = nil
+	s.videoSeq = nil
+	s.audioSeq = nil
+}
+
+// saveHeader 保存metadata和sequence header 返回是否是header
+func (s *sourceState) saveHeader(p *av.Packet) bool {
+	if p.IsMetadata {
+		if amf.ScriptDataName(p.Data) != amf.OnTextData {
+			s.metadata = p
+		}
+		return true
+	}
+	if p.IsVideo {
+		vh, ok := p.Header.(av.VideoPacketHeader)
+		if ok && vh.IsSeq() {
+			s.videoSeq = p
+			return true
+		}
+		return false
+	}
+	ah, ok := p.Header.(av.AudioPacketHeader)
+	if ok && ah.SoundFormat() == av.SOUND_AAC && ah.AACPacketType() == av.AAC_SEQHDR {
+		s.audioSeq = p
+		return true
+	}
+	return false
+}
+
+// isSwitchPoint 有视频时在关键帧切换 纯音频任意帧都可以
+func (s *sourceState) isSwitchPoint(p *av.Packet) bool {
+	if s.videoSeq != nil {
+		return isKeyFrame(p)
+	}
+	return p.IsAudio
+}
+
+func (s *sourceState) headers() []*av.Packet {
+	ret := make([]*av.Packet, 0, 3)
+	for _, p := range []*av.Packet{s.metadata, s.videoSeq, s.audioSeq} {
+		if p != nil {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
+// failoverSource 从主推流和备用流中选择一路输出
+type failoverSource struct {
+	key          string
+	backupKey    string
+	slateConfig  slateConfig
+	stallTimeout time.Duration
+	inputCh      chan failoverPacket
+	ticker       *time.Ticker
+
+	// 以下只在ReadPacket协程中访问
+	states       [srcNum]sourceState
+	active       int
+	pending      int
+	seenSession  int64
+	backupWriter *failoverBackupWriter
+	offset       int64
+	lastOut      uint32
+	lastOutTime  time.Time
+	hasOut       bool
+	out          []*av.Packet
+	slate        *slatePlayer
+	// downSince 主备都不可用的开始时间
+	downSince time.Time
+
+	// 主推流连接
+	mu          sync.Mutex
+	session     int64
+	attached    bool
+	primaryConn *netConn
+
+	ctx       context.Context
+	cancelFn  context.CancelFunc
+	closeOnce sync.Once
+}
+
+func newFailoverSource(key, backupKey string, slate slateConfig) *failoverSource {
+	ctx, cancelFn := context.WithCancel(context.Background())
+	return &failoverSource{
+		key:          key,
+		backupKey:    backupKey,
+		slateConfig:  slate,
+		stallTimeout: getStallTimeout(),
+		inputCh:      make(chan failoverPacket, maxQueueNum),
+		ticker:       time.NewTicker(failoverCheckInterval),
+		pending:      srcPrimary,
+		ctx:          ctx,
+		cancelFn:     cancelFn,
+		closeOnce:    sync.Once{},
+	}
+}
+
+// attachPrimary 读取主推流 输出已经结束返回false
+func (s *failoverSource) attachPrimary(conn *netConn) bool {
+	s.mu.Lock()
+	if s.ctx.Err() != nil {
+		s.mu.Unlock()
+		return false
+	}
+	// 新的主推流替换旧的
+	if s.primaryConn != nil {
+		s.primaryConn.Close()
+	}
+	s.session++
+	session := s.session
+	s.attached = true
+	s.primaryConn = conn
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		if s.session == session {
+			s.attached = false
+			s.primaryConn = nil
+		}
+		s.mu.Unlock()
+	}()
+	source := &connSource{conn: conn}
+	for {
+		var p av.Packet
+		if err := source.ReadPacket(&p); err != nil {
+			if errors.Is(err, errInvalidPacket) {
+				continue
+			}
+			return true
+		}
+		select {
+		case <-s.ctx.Done():
+			return true
+		case s.inputCh <- failoverPacket{src: srcPrimary, session: session, p: &p}:
+		}
+	}
+}
+
+// primaryStatus 主推流的session和是否连接
+func (s *failoverSource) primaryStatus() (int64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.session, s.attached
+}
+
+// syncPrimary 主推流重连后重置状态
+func (s *failoverSource) syncPrimary(session int64) {
+	if session == s.seenSession {
+		return
+	}
+	s.seenSession = session
+	s.states[srcPrimary].reset()
+	if s.active == srcPrimary {
+		s.active = srcNone
+	}
+}
+
+func (s *failoverSource) ReadPacket(p *av.Packet) error {
+	for {
+		if len(s.out) > 0 {
+			*p = *s.out[0]
+			s.out[0] = nil
+			s.out = s.out[1:]
+			return nil
+		}
+		select {
+		case <-s.ctx.Done():
+			return io.EOF
+		case in := <-s.inputCh:
+			s.handle(in)
+		case <-s.ticker.C:
+			if !s.check() {
+				return io.EOF
+			}
+		}
+	}
+}
+
+func (s *failoverSource) handle(in failoverPacket) {
+	if in.src == srcPrimary {
+		session, _ := s.primaryStatus()
+		// 旧连接的数据
+		if in.session != session {
+			return
+		}
+		s.syncPrimary(session)
+	} else if in.src == srcBackup && in.writer != s.backupWriter {
+		return
+	} else if in.src == srcSlate && in.slate != s.slate {
+		return
+	}
+	state := &s.states[in.src]
+	state.lastRecv = time.Now()
+	if state.saveHeader(in.p) {
+		if in.src == s.active {
+			s.emit(in.p)
+		}
+		return
+	}
+	if in.src == s.active {
+		s.emit(in.p)
+		return
+	}
+	if in.src == s.pending && state.isSwitchPoint(in.p) {
+		s.switchTo(in.src, in.p)
+	}
+}
+
+// check 检查主备状态 没有可用的输入源时返回false
+func (s *failoverSource) check() bool {
+	session, attached := s.primaryStatus()
+	s.syncPrimary(session)
+	if s.backupWriter != nil && s.backupWriter.ctx.Err() != nil {
+		s.backupWriter = nil
+		if s.active == srcBackup {
+			s.active = srcNone
+		}
+	}
+	if s.backupWriter == nil && s.backupKey != "" {
+		s.registerBackup()
+	}
+	now := time.Now()
+	primaryOk := attached && now.Sub(s.states[srcPrimary].lastRecv) <= s.stallTimeout
+	backupOk := s.backupWriter != nil && now.Sub(s.states[srcBackup].lastRecv) <= s.stallTimeout
+	if primaryOk || backupOk {
+		s.downSince = time.Time{}
+	} else if s.downSince.IsZero() {
+		s.downSince = now
+	}
+	switch {
+	case primaryOk:
+		s.setDesired(srcPrimary)
+	case backupOk:
+		s.setDesired(srcBackup)
+	case s.slateConfig.file != "" && now.Sub(s.downSince) < s.slateConfig.timeout:
+		s.startSlate()
+		s.setDesired(srcSlate)
+	case !attached:
+		return false
+	case s.slateConfig.file != "" && !s.slateConfig.freeze:
+		// 垫片超时 主推流仍然卡住 断开拉流端
+		logger.Logger.Infof("stream %s slate timeout, disconnect", s.key)
+		return false
+	default:
+		// 主推流卡住且没有备用流 等待恢复 垫片超时后画面停在最后一帧
+		if s.active == srcSlate {
+			s.active = srcNone
+		}
+		s.pending = srcPrimary
+	}
+	// 已经切换到其他输入源或者垫片超时 停止垫片
+	if s.slate != nil && s.active != srcSlate && s.pending != srcSlate {
+		s.slate.stop()
+		s.slate = nil
+	}
+	return true
+}
+
+func (s *failoverSource) startSlate() {
+	if s.slate != nil {
+		return
+	}
+	s.states[srcSlate].reset()
+	s.slate = newSlatePlayer(s.slateConfig.file, s)
+	go s.slate.run()
+}
+
+func (s *failoverSource) setDesired(src int) {
+	if s.active == src {
+		s.pending = srcNone
+	} else {
+		s.pending = src
+	}
+}
+
+// registerBackup 备用流在推流时注册
+func (s *failoverSource) registerBackup() {
+	publisher, ok := FindPublisher(s.backupKey)
+	if !ok {
+		return
+	}
+	ctx, cancelFn := context.WithCancel(s.ctx)
+	s.backupWriter = &failoverBackupWriter{
+		source:    s,
+		publisher: publisher,
+		ctx:       ctx,
+		cancelFn:  cancelFn,
+	}
+	s.states[srcBackup].reset()
+	publisher.Register(s.backupWriter)
+}
+
+// switchTo 在关键帧切换输入源 先发送新输入源的header
+func (s *failoverSource) switchTo(src int, p *av.Packet) {
+	logger.Logger.Infof("stream %s switch source from %d to %d", s.key, s.active, src)
+	s.active = src
+	s.pending = srcNone
+	// 时间戳接着之前输出的 加上卡住的时间
+	if s.hasOut {
+		gap := time.Since(s.lastOutTime).Milliseconds()
+		if gap < switchGap {
+			gap = switchGap
+		}
+		s.offset = int64(s.lastOut) + gap - int64(p.Timestamp)
+	}
+	for _, h := range s.states[src].headers() {
+		header := *h
+		header.Timestamp = p.Timestamp
+		s.emit(&header)
+	}
+	s.emit(p)
+}
+
+func (s *failoverSource) emit(p *av.Packet) {
+	ret := *p
+	ts := int64(p.Timestamp) + s.offset
+	if ts < 0 {
+		ts = 0
+	}
+	ret.Timestamp = uint32(ts)
+	if !s.hasOut || ret.Timestamp > s.lastOut {
+		s.lastOut = ret.Timestamp
+		s.lastOutTime = time.Now()
+	}
+	s.hasOut = true
+	s.out = append(s.out, &ret)
+}
+
+func (s *failoverSource) Close() error {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		s.cancelFn()
+		if s.primaryConn != nil {
+			s.primaryConn.Close()
+		}
+		s.mu.Unlock()
+		s.ticker.Stop()
+		fmu.Lock()
+		if failoverMap[s.key] == s {
+			delete(failoverMap, s.key)
+		}
+		fmu.Unlock()
+		if s.backupWriter != nil {
+			s.backupWriter.publisher.Deregister(s.backupWriter)
+		}
+	})
+	return nil
+}
+
+// failoverBackupWriter 注册到备用流 转发给failoverSource
+type failoverBackupWriter struct {
+	source    *failoverSource
+	publisher RegisterAction
+	ctx       context.Context
+	cancelFn  context.CancelFunc
+}
+
+func (w *failoverBackupWriter) WritePacket(p *av.Packet) error {
+	select {
+	case <-w.ctx.Done():
+		return w.ctx.Err()
+	case w.source.inputCh <- failoverPacket{src: srcBackup, writer: w, p: p}:
+		return nil
+	}
+}
+
+// Close 备用流断开
+func (w *failoverBackupWriter) Close() {
+	w.cancelFn()
+}
+
+// isKeyFrame 视频关键帧 不包含sequence header
+func isKeyFrame(p *av.Packet) bool {
+	if !p.IsVideo {
+		return false
+	}
+	vh, ok := p.Header.(av.VideoPacketHeader)
+	return ok && vh.IsKeyFrame() && !vh.IsSeq()
+}
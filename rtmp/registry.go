@@ -1,9 +1,14 @@
 package rtmp
 
 import (
+	"errors"
 	"sync"
 )
 
+var (
+	ErrPublisherExists = errors.New("stream is publishing")
+)
+
 /*
 注册推流reader
 用于分发给拉流的writer
@@ -20,11 +25,24 @@ func registerPublisher(key string, reader *streamPublisher) {
 	publisherMap[key] = reader
 }
 
-// deregisterPublisher 注销
-func deregisterPublisher(key string) {
+// registerPublisherIfAbsent 没有推流时才注册
+func registerPublisherIfAbsent(key string, reader *streamPublisher) bool {
+	pmu.Lock()
+	defer pmu.Unlock()
+	if _, ok := publisherMap[key]; ok {
+		return false
+	}
+	publisherMap[key] = reader
+	return true
+}
+
+// deregisterPublisher 注销 只移除自己
+func deregisterPublisher(key string, reader *streamPublisher) {
 	pmu.Lock()
 	defer pmu.Unlock()
-	delete(publisherMap, key)
+	if publisherMap[key] == reader {
+		delete(publisherMap, key)
+	}
 }
 
 func closeAllPublisher() {
@@ -35,6 +53,26 @@ func closeAllPublisher() {
 	}
 }
 
+// StreamStat 单个推流的拉流端数量
+type StreamStat struct {
+	Key     string         `json:"key"`
+	Viewers map[string]int `json:"viewers"`
+}
+
+// GetStreamStats 获取所有推流的观看人数
+func GetStreamStats() []StreamStat {
+	pmu.RLock()
+	defer pmu.RUnlock()
+	ret := make([]StreamStat, 0, len(publisherMap))
+	for key, publisher := range publisherMap {
+		ret = append(ret, StreamStat{
+			Key:     key,
+			Viewers: publisher.registry.viewerCounts(),
+		})
+	}
+	return ret
+}
+
 // FindPublisher 匹配
 func FindPublisher(key string) (RegisterAction, bool) {
 	pmu.RLock()
@@ -46,18 +84,21 @@ func FindPublisher(key string) (RegisterAction, bool) {
 type packetWriterWrapper struct {
 	PacketWriter
 	sendCacheOnce sync.Once
+	// skipGop 不发送gop缓存 从下一个关键帧开始
+	skipGop bool
 }
 
-func newPacketWriterWrapper(writer PacketWriter) *packetWriterWrapper {
+func newPacketWriterWrapper(writer PacketWriter, skipGop bool) *packetWriterWrapper {
 	return &packetWriterWrapper{
 		PacketWriter:  writer,
 		sendCacheOnce: sync.Once{},
+		skipGop:       skipGop,
 	}
 }
 
 func (w *packetWriterWrapper) writeCache(cache *streamCache) (err error) {
 	w.sendCacheOnce.Do(func() {
-		err = cache.send(w.PacketWriter)
+		err = cache.send(w.PacketWriter, !w.skipGop)
 	})
 	return
 }
@@ -96,6 +137,16 @@ func (r *writerRegistryHolder) deregister(index int) {
 	delete(r.members, index)
 }
 
+func (r *writerRegistryHolder) deregisterWriter(writer PacketWriter) {
+	r.Lock()
+	defer r.Unlock()
+	for k, v := range r.members {
+		if v.PacketWriter == writer {
+			delete(r.members, k)
+		}
+	}
+}
+
 func (r *writerRegistryHolder) getMembers() map[int]*packetWriterWrapper {
 	r.RLock()
 	defer r.RUnlock()
@@ -109,6 +160,21 @@ func (r *writerRegistryHolder) getMembers() map[int]*packetWriterWrapper {
 	return ret
 }
 
+// viewerCounts 按拉流类型统计数量
+func (r *writerRegistryHolder) viewerCounts() map[string]int {
+	r.RLock()
+	defer r.RUnlock()
+	ret := make(map[string]int, 4)
+	for _, v := range r.members {
+		viewer, ok := v.PacketWriter.(ViewerWriter)
+		if !ok || viewer.ViewerType() == "" {
+			continue
+		}
+		ret[viewer.ViewerType()]++
+	}
+	return ret
+}
+
 func (r *writerRegistryHolder) closeAll() {
 	r.Lock()
 	defer r.Unlock()
@@ -4,16 +4,19 @@ import (
 	"context"
 	"crypto/tls"
 	"errors"
-	"fmt"
 	"github.com/LeeZXin/z-live/flv"
 	"github.com/LeeZXin/z-live/hls"
+	"github.com/LeeZXin/z-live/record"
+	"github.com/LeeZXin/z-live/timeshift"
+	"github.com/LeeZXin/z-live/vod"
 	"github.com/LeeZXin/zsf-utils/quit"
-	"github.com/LeeZXin/zsf-utils/strutil"
 	"github.com/LeeZXin/zsf-utils/threadutil"
 	"github.com/LeeZXin/zsf/logger"
 	"github.com/LeeZXin/zsf/property/static"
 	"io"
 	"net"
+	"net/url"
+	"strings"
 	"sync"
 	"time"
 )
@@ -147,25 +150,38 @@ func (r *TcpServer) handleConn(conn *netConn) {
 	key := app + "/" + name
 	// 推流
 	if conn.isPublisher {
-		publisher := newStreamPublisher(conn)
-		defer publisher.close()
-		registerPublisher(key, publisher)
-		defer deregisterPublisher(key)
-		// 将整个视频文件保存到本地
-		flvFileWriter, err := flv.NewFileWriter(fmt.Sprintf("./%s_%s_%d.flv", name, strutil.RandomStr(5), time.Now().UnixMilli()))
-		if err == nil {
-			publisher.Register(flvFileWriter)
+		// 配置了备用流或者垫片 作为主推流
+		backupKey := getFailoverBackup(app, name)
+		slate := getSlateConfig(app)
+		if backupKey != "" || slate.file != "" {
+			publishWithFailover(app, name, backupKey, slate, conn)
+			return
 		}
-		// 可以用hls播放
-		hlsWriter := hls.NewStreamWriter(app, name)
-		publisher.Register(hlsWriter)
-		publisher.start()
+		publisher := newStreamPublisher(&connSource{conn: conn})
+		// 已经有推流(例如虚拟直播频道)时拒绝 不覆盖
+		if !registerPublisherIfAbsent(key, publisher) {
+			logger.Logger.Errorf("rtmp publish %s refused: %v", key, ErrPublisherExists)
+			conn.Close()
+			return
+		}
+		servePublisher(app, name, publisher)
+	} else if vodName, ok := vod.ParseName(app, name); ok {
+		// 点播录制的文件
+		handleVod(conn, vodName)
 	} else {
-		publisher, ok := FindPublisher(key)
+		// 拉流参数和http-flv相同 例如demo?only=audio&zeroTs=1
+		name, query, _ := strings.Cut(name, "?")
+		values, _ := url.ParseQuery(query)
+		opts := flv.ParseOptions(values)
+		publisher, ok := FindPublisher(app + "/" + name)
 		if ok {
 			// 拉流
-			writer := newStreamWriter(conn)
-			publisher.Register(writer)
+			writer := newStreamWriter(conn, opts)
+			if opts.FromKeyFrame {
+				publisher.RegisterFromKeyFrame(writer)
+			} else {
+				publisher.Register(writer)
+			}
 			writer.Start()
 		} else {
 			conn.Close()
@@ -173,6 +189,54 @@ func (r *TcpServer) handleConn(conn *netConn) {
 	}
 }
 
+// servePublisher 开始录制和hls 阻塞分发直到推流结束
+func servePublisher(app, name string, publisher *streamPublisher) {
+	key := app + "/" + name
+	defer publisher.close()
+	defer deregisterPublisher(key, publisher)
+	// 按配置录制到本地
+	if recordConfig := record.GetConfig(app); recordConfig.Enable {
+		if recorder, err := record.Start(app, name, recordConfig); err == nil {
+			publisher.Register(recorder)
+		}
+	}
+	// 时移缓存 用于延迟播放和导出片段
+	if timeshiftConfig := timeshift.GetConfig(app); timeshiftConfig.Enable {
+		publisher.Register(timeshift.Start(app, name, timeshiftConfig))
+	}
+	// 可以用hls播放 懒加载模式下首次请求m3u8时才创建
+	if !hls.IsLazyApp(app) {
+		hlsWriter := hls.NewStreamWriter(app, name)
+		publisher.Register(hlsWriter)
+	}
+	publisher.start()
+}
+
+// Publish 非rtmp的推流 例如虚拟直播 和rtmp推流一样可以用http-flv、rtmp、hls播放
+// 阻塞直到source结束 key已经有推流时返回ErrPublisherExists
+func Publish(app, name string, source PacketSource) error {
+	done, err := StartPublish(app, name, source)
+	if err != nil {
+		return err
+	}
+	<-done
+	return nil
+}
+
+// StartPublish 同步注册推流 注册成功后在后台分发 返回的channel在推流结束时关闭
+func StartPublish(app, name string, source PacketSource) (<-chan struct{}, error) {
+	publisher := newStreamPublisher(source)
+	if !registerPublisherIfAbsent(app+"/"+name, publisher) {
+		return nil, ErrPublisherExists
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		servePublisher(app, name, publisher)
+	}()
+	return done, nil
+}
+
 // readAndHandleUserCtrlMsg 读chunkStream并处理控制命令
 func readAndHandleUserCtrlMsg(conn *netConn) error {
 	err := readChunkStream(conn)
@@ -0,0 +1,128 @@
+package rtmp
+
+import (
+	"context"
+	"github.com/LeeZXin/z-live/flv"
+	"github.com/LeeZXin/zsf/logger"
+	"github.com/LeeZXin/zsf/property/static"
+	"time"
+)
+
+const (
+	defaultSlateTimeout = 60 * time.Second
+)
+
+// slateConfig 推流断开时播放的垫片 可按app配置slate.apps.{app}.xxx 没有则使用slate.xxx
+type slateConfig struct {
+	// file h264+aac的flv文件 为空不开启
+	file string
+	// timeout 推流断开多久后停止垫片并断开拉流端
+	timeout time.Duration
+	// freeze 超时后主推流仍然连接时 停止垫片等待主推流恢复 而不是断开
+	freeze bool
+}
+
+func getSlateConfig(app string) slateConfig {
+	ret := slateConfig{
+		file: static.GetString("slate.apps." + app + ".file"),
+	}
+	if ret.file == "" {
+		ret.file = static.GetString("slate.file")
+	}
+	timeout := static.GetInt("slate.apps." + app + ".timeout")
+	if timeout == 0 {
+		timeout = static.GetInt("slate.timeout")
+	}
+	freeze := static.GetString("slate.apps." + app + ".freeze")
+	if freeze == "" {
+		freeze = static.GetString("slate.freeze")
+	}
+	ret.freeze = freeze == "true"
+	if timeout > 0 {
+		ret.timeout = time.Duration(timeout) * time.Second
+	} else {
+		ret.timeout = defaultSlateTimeout
+	}
+	return ret
+}
+
+// slatePlayer 按实际时间循环读取垫片文件 时间戳在循环间连续
+type slatePlayer struct {
+	path     string
+	source   *failoverSource
+	ctx      context.Context
+	cancelFn context.CancelFunc
+}
+
+func newSlatePlayer(path string, source *failoverSource) *slatePlayer {
+	ctx, cancelFn := context.WithCancel(source.ctx)
+	return &slatePlayer{
+		path:     path,
+		source:   source,
+		ctx:      ctx,
+		cancelFn: cancelFn,
+	}
+}
+
+func (p *slatePlayer) run() {
+	var (
+		offset, lastTs uint32
+		baseTime       = time.Now()
+	)
+	for p.ctx.Err() == nil {
+		reader, err := flv.Open(p.path)
+		if err != nil {
+			logger.Logger.Errorf("open slate %s failed: %v", p.path, err)
+			return
+		}
+		count := 0
+		var firstTs uint32
+		for {
+			pkt, err := reader.ReadPacket()
+			if err != nil {
+				break
+			}
+			if pkt.IsMetadata {
+				continue
+			}
+			if count == 0 {
+				firstTs = pkt.Timestamp
+			}
+			count++
+			ts := offset
+			if pkt.Timestamp > firstTs {
+				ts += pkt.Timestamp - firstTs
+			}
+			pkt.Timestamp = ts
+			if ts > lastTs {
+				lastTs = ts
+			}
+			wait := time.Until(baseTime.Add(time.Duration(ts) * time.Millisecond))
+			if wait > 0 {
+				timer := time.NewTimer(wait)
+				select {
+				case <-p.ctx.Done():
+				case <-timer.C:
+				}
+				timer.Stop()
+			}
+			select {
+			case <-p.ctx.Done():
+			case p.source.inputCh <- failoverPacket{src: srcSlate, slate: p, p: pkt}:
+			}
+			if p.ctx.Err() != nil {
+				break
+			}
+		}
+		reader.Close()
+		if count == 0 {
+			logger.Logger.Errorf("slate %s has no packet", p.path)
+			return
+		}
+		offset = lastTs + switchGap
+	}
+}
+
+func (p *slatePlayer) stop() {
+	p.cancelFn()
+}
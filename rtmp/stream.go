@@ -3,6 +3,8 @@ package rtmp
 import (
 	"context"
 	"errors"
+	"fmt"
+	"github.com/LeeZXin/z-live/amf"
 	"github.com/LeeZXin/z-live/av"
 	"github.com/LeeZXin/z-live/flv"
 	"github.com/LeeZXin/zsf-utils/executor"
@@ -13,6 +15,8 @@ import (
 
 const (
 	maxQueueNum = 1024
+
+	rtmpViewerType = "rtmp"
 )
 
 // streamWriter 获取rtmp推流，并转发写入到其他writer
@@ -21,6 +25,7 @@ type streamWriter struct {
 	conn          *netConn
 	packetQueue   chan *av.Packet
 	lastTimestamp uint32
+	filter        *flv.PacketFilter
 
 	ctx      context.Context
 	cancelFn context.CancelFunc
@@ -28,10 +33,11 @@ type streamWriter struct {
 	closeOnce sync.Once
 }
 
-func newStreamWriter(conn *netConn) *streamWriter {
+func newStreamWriter(conn *netConn, opts flv.Options) *streamWriter {
 	ctx, cancelFunc := context.WithCancel(context.Background())
 	return &streamWriter{
 		conn:        conn,
+		filter:      flv.NewPacketFilter(opts),
 		packetQueue: make(chan *av.Packet, maxQueueNum),
 		ctx:         ctx,
 		cancelFn:    cancelFunc,
@@ -89,6 +95,10 @@ func (v *streamWriter) SendPacket() {
 			if !ok {
 				return
 			}
+			p, ok = v.filter.Filter(p)
+			if !ok {
+				continue
+			}
 			cs.data = p.Data
 			cs.length = uint32(len(p.Data))
 			cs.streamId = p.StreamId
@@ -112,6 +122,10 @@ func (v *streamWriter) SendPacket() {
 	}
 }
 
+func (v *streamWriter) ViewerType() string {
+	return rtmpViewerType
+}
+
 func (v *streamWriter) Close() {
 	v.closeOnce.Do(func() {
 		v.cancelFn()
@@ -121,11 +135,26 @@ func (v *streamWriter) Close() {
 }
 
 type RegisterAction interface {
-	Register(PacketWriter)
+	// Register 推流已经结束时返回false
+	Register(PacketWriter) bool
+	// RegisterFromKeyFrame 只发送metadata和sequence header缓存 不发送gop缓存
+	RegisterFromKeyFrame(PacketWriter) bool
+	Deregister(PacketWriter)
+}
+
+var (
+	// errInvalidPacket 单个packet解析失败 可以继续读取
+	errInvalidPacket = errors.New("invalid packet")
+)
+
+// PacketSource 推流的数据来源 rtmp推流或者虚拟直播等 ReadPacket阻塞直到有数据 结束返回io.EOF
+type PacketSource interface {
+	ReadPacket(*av.Packet) error
+	Close() error
 }
 
 type streamPublisher struct {
-	conn           *netConn
+	source         PacketSource
 	cache          *streamCache
 	registry       *writerRegistryHolder
 	writeExecutors *executor.Executor
@@ -134,25 +163,44 @@ type streamPublisher struct {
 	closed bool
 }
 
-func newStreamPublisher(conn *netConn) *streamPublisher {
+func newStreamPublisher(source PacketSource) *streamPublisher {
 	return &streamPublisher{
 		registry: newWriterRegistryHolder(),
-		conn:     conn,
+		source:   source,
 		cache:    newStreamCache(),
 		RWMutex:  sync.RWMutex{},
 	}
 }
 
-func (v *streamPublisher) Register(writer PacketWriter) {
+func (v *streamPublisher) Register(writer PacketWriter) bool {
 	if writer == nil {
-		return
+		return false
 	}
 	v.Lock()
 	defer v.Unlock()
 	if v.closed {
-		return
+		return false
 	}
-	v.registry.register(newPacketWriterWrapper(writer))
+	v.registry.register(newPacketWriterWrapper(writer, false))
+	return true
+}
+
+func (v *streamPublisher) RegisterFromKeyFrame(writer PacketWriter) bool {
+	if writer == nil {
+		return false
+	}
+	v.Lock()
+	defer v.Unlock()
+	if v.closed {
+		return false
+	}
+	v.registry.register(newPacketWriterWrapper(writer, true))
+	return true
+}
+
+// Deregister 移除writer 不关闭
+func (v *streamPublisher) Deregister(writer PacketWriter) {
+	v.registry.deregisterWriter(writer)
 }
 
 func (v *streamPublisher) start() {
@@ -162,7 +210,7 @@ func (v *streamPublisher) start() {
 		}
 		var p av.Packet
 		packet := &p
-		err := v.read(packet)
+		err := v.source.ReadPacket(packet)
 		if errors.Is(err, io.EOF) {
 			return
 		}
@@ -191,12 +239,17 @@ func (v *streamPublisher) isClosed() bool {
 	return v.closed
 }
 
-func (v *streamPublisher) read(p *av.Packet) error {
+// connSource rtmp推流
+type connSource struct {
+	conn *netConn
+}
+
+func (s *connSource) ReadPacket(p *av.Packet) error {
 	for {
-		if err := readAndHandleUserCtrlMsg(v.conn); err != nil {
+		if err := readAndHandleUserCtrlMsg(s.conn); err != nil {
 			return err
 		}
-		cs := v.conn.cs
+		cs := s.conn.cs
 		if cs.typeId == av.TAG_AUDIO ||
 			cs.typeId == av.TAG_VIDEO ||
 			cs.typeId == av.TAG_SCRIPTDATAAMF0 ||
@@ -204,7 +257,7 @@ func (v *streamPublisher) read(p *av.Packet) error {
 			break
 		}
 	}
-	cs := v.conn.cs
+	cs := s.conn.cs
 	p.IsAudio = cs.typeId == av.TAG_AUDIO
 	p.IsVideo = cs.typeId == av.TAG_VIDEO
 	p.IsMetadata = cs.typeId == av.TAG_SCRIPTDATAAMF0 || cs.typeId == av.TAG_SCRIPTDATAAMF3
@@ -212,16 +265,20 @@ func (v *streamPublisher) read(p *av.Packet) error {
 	p.Data = cs.data
 	p.Timestamp = cs.timestamp
 	if err := flv.DemuxH(p); err != nil {
-		return err
+		return fmt.Errorf("%w: %v", errInvalidPacket, err)
 	}
 	return nil
 }
 
+func (s *connSource) Close() error {
+	return s.conn.Close()
+}
+
 func (v *streamPublisher) close() {
 	v.Lock()
 	defer v.Unlock()
 	v.closed = true
-	v.conn.Close()
+	v.source.Close()
 	v.registry.closeAll()
 }
 
@@ -238,7 +295,7 @@ func newStreamCache() *streamCache {
 	}
 }
 
-func (c *streamCache) send(writer PacketWriter) error {
+func (c *streamCache) send(writer PacketWriter, withGop bool) error {
 	if c.metadata != nil {
 		if err := writer.WritePacket(c.metadata); err != nil {
 			return err
@@ -254,6 +311,9 @@ func (c *streamCache) send(writer PacketWriter) error {
 			return err
 		}
 	}
+	if !withGop {
+		return nil
+	}
 	return c.gop.send(writer)
 }
 
@@ -262,7 +322,10 @@ func (c *streamCache) add(p *av.Packet) {
 		return
 	}
 	if p.IsMetadata {
-		c.metadata = p
+		// onTextData等不覆盖onMetaData
+		if amf.ScriptDataName(p.Data) != amf.OnTextData {
+			c.metadata = p
+		}
 		return
 	}
 	if p.IsVideo {
@@ -277,8 +340,8 @@ func (c *streamCache) add(p *av.Packet) {
 	} else {
 		ah, ok := p.Header.(av.AudioPacketHeader)
 		if ok {
-			if ah.SoundFormat() == av.SOUND_AAC &&
-				ah.AACPacketType() == av.AAC_SEQHDR {
+			// aac的sequence header和enhanced rtmp的SequenceStart 例如opus
+			if av.IsAudioSeqHeader(ah) {
 				c.audioSeq = p
 			}
 			return
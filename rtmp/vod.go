@@ -0,0 +1,89 @@
+package rtmp
+
+import (
+	"errors"
+	"github.com/LeeZXin/z-live/av"
+	"github.com/LeeZXin/z-live/vod"
+	"github.com/LeeZXin/zsf/logger"
+	"io"
+)
+
+// vodWriter 点播按实际时间发送 直接写入conn
+type vodWriter struct {
+	conn     *netConn
+	streamId uint32
+	cs       chunkStream
+}
+
+func (w *vodWriter) WritePacket(p *av.Packet) error {
+	w.cs.data = p.Data
+	w.cs.length = uint32(len(p.Data))
+	w.cs.streamId = w.streamId
+	w.cs.timestamp = p.Timestamp
+	if p.IsVideo {
+		w.cs.typeId = av.TAG_VIDEO
+	} else if p.IsMetadata {
+		w.cs.typeId = av.TAG_SCRIPTDATAAMF0
+	} else {
+		w.cs.typeId = av.TAG_AUDIO
+	}
+	if err := w.cs.writeChunk(w.conn); err != nil {
+		return err
+	}
+	return w.conn.Flush()
+}
+
+// handleVod 播放点播目录下的flv文件
+func handleVod(conn *netConn, name string) {
+	handler := conn.cmdHandler
+	// chunkStream会被读协程复用 复制一份用于回复
+	cur := &chunkStream{
+		csid:     conn.cs.csid,
+		streamId: conn.cs.streamId,
+	}
+	filePath, ok := vod.FilePath(name)
+	if !ok {
+		handler.onStatus(cur, "NetStream.Play.StreamNotFound", "Stream not found.")
+		return
+	}
+	var start, duration int64
+	if handler.pubCmd.Start > 0 {
+		start = int64(handler.pubCmd.Start)
+	}
+	if handler.pubCmd.Duration > 0 {
+		duration = int64(handler.pubCmd.Duration)
+	}
+	player, err := vod.NewPlayer(filePath, &vodWriter{
+		conn:     conn,
+		streamId: uint32(handler.streamId),
+	}, start, duration)
+	if err != nil {
+		handler.onStatus(cur, "NetStream.Play.StreamNotFound", "Stream not found.")
+		return
+	}
+	handler.vod = player
+	// 读取seek pause等命令
+	go func() {
+		defer player.Close()
+		for {
+			if err := readAndHandleUserCtrlMsg(conn); err != nil {
+				return
+			}
+			switch conn.cs.typeId {
+			case 17, 20:
+				if err := handleCmdMsg(conn); err != nil {
+					if !errors.Is(err, io.EOF) && !errors.Is(err, vod.ErrClosed) {
+						logger.Logger.Error(err)
+					}
+					return
+				}
+			}
+		}
+	}()
+	if err = player.Run(); err != nil {
+		logger.Logger.Error(err)
+		return
+	}
+	handler.onStatus(cur, "NetStream.Play.Complete", "Playback complete.")
+	handler.setEOF()
+}
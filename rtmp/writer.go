@@ -7,3 +7,8 @@ type PacketWriter interface {
 	WritePacket(*av.Packet) error
 	Close()
 }
+
+// ViewerWriter 拉流端实现 用于统计观看人数
+type ViewerWriter interface {
+	ViewerType() string
+}
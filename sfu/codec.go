@@ -0,0 +1,155 @@
+package sfu
+
+import (
+	"errors"
+	"fmt"
+	"github.com/LeeZXin/z-live/webm"
+	"github.com/LeeZXin/zsf/property/static"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+	"github.com/pion/webrtc/v4/pkg/media/h264writer"
+	"github.com/pion/webrtc/v4/pkg/media/ivfwriter"
+	"strings"
+)
+
+/*
+media engine注册的编解码 按配置顺序注册 越靠前越优先
+sfu.codecs.video 可选h264 vp8 vp9 av1
+sfu.codecs.audio 可选opus
+*/
+
+const (
+	defaultVideoCodecs = "vp8,h264,vp9,av1"
+	defaultAudioCodecs = "opus"
+)
+
+var (
+	ErrUnsupportedCodec = errors.New("unsupported codec")
+)
+
+var (
+	videoRTCPFeedback = []webrtc.RTCPFeedback{
+		{Type: webrtc.TypeRTCPFBGoogREMB},
+		{Type: webrtc.TypeRTCPFBCCM, Parameter: "fir"},
+		{Type: webrtc.TypeRTCPFBNACK},
+		{Type: webrtc.TypeRTCPFBNACK, Parameter: "pli"},
+		{Type: webrtc.TypeRTCPFBTransportCC},
+	}
+	audioRTCPFeedback = []webrtc.RTCPFeedback{
+		{Type: webrtc.TypeRTCPFBTransportCC},
+	}
+
+	// videoCodecs payloadType是固定的 不是pion的默认值 同一个MediaEngine内不重复即可
+	videoCodecs = map[string][]webrtc.RTPCodecParameters{
+		"vp8": {
+			newVideoCodec(webrtc.MimeTypeVP8, "", 96),
+		},
+		// 同时注册baseline、constrained baseline、main、high 以及两种packetization-mode
+		"h264": {
+			newVideoCodec(webrtc.MimeTypeH264, "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f", 106),
+			newVideoCodec(webrtc.MimeTypeH264, "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42001f", 102),
+			newVideoCodec(webrtc.MimeTypeH264, "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=4d001f", 127),
+			newVideoCodec(webrtc.MimeTypeH264, "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=64001f", 112),
+			newVideoCodec(webrtc.MimeTypeH264, "level-asymmetry-allowed=1;packetization-mode=0;profile-level-id=42e01f", 108),
+			newVideoCodec(webrtc.MimeTypeH264, "level-asymmetry-allowed=1;packetization-mode=0;profile-level-id=42001f", 104),
+		},
+		"vp9": {
+			newVideoCodec(webrtc.MimeTypeVP9, "profile-id=0", 98),
+			newVideoCodec(webrtc.MimeTypeVP9, "profile-id=2", 100),
+		},
+		"av1": {
+			newVideoCodec(webrtc.MimeTypeAV1, "", 45),
+		},
+	}
+	audioCodecs = map[string][]webrtc.RTPCodecParameters{
+		"opus": {
+			{
+				RTPCodecCapability: webrtc.RTPCodecCapability{
+					MimeType:     webrtc.MimeTypeOpus,
+					ClockRate:    48000,
+					Channels:     2,
+					SDPFmtpLine:  "minptime=10;useinbandfec=1",
+					RTCPFeedback: audioRTCPFeedback,
+				},
+				PayloadType: 111,
+			},
+		},
+	}
+)
+
+func newVideoCodec(mimeType, fmtp string, payloadType webrtc.PayloadType) webrtc.RTPCodecParameters {
+	return webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:     mimeType,
+			ClockRate:    90000,
+			SDPFmtpLine:  fmtp,
+			RTCPFeedback: videoRTCPFeedback,
+		},
+		PayloadType: payloadType,
+	}
+}
+
+// registerCodecs 按配置注册音视频编解码
+func registerCodecs(m *webrtc.MediaEngine) error {
+	if err := registerCodecList(m, static.GetString("sfu.codecs.video"), defaultVideoCodecs, videoCodecs, webrtc.RTPCodecTypeVideo); err != nil {
+		return err
+	}
+	return registerCodecList(m, static.GetString("sfu.codecs.audio"), defaultAudioCodecs, audioCodecs, webrtc.RTPCodecTypeAudio)
+}
+
+func registerCodecList(m *webrtc.MediaEngine, names, defaultNames string, codecs map[string][]webrtc.RTPCodecParameters, typ webrtc.RTPCodecType) error {
+	if names == "" {
+		names = defaultNames
+	}
+	for _, name := range strings.Split(names, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		list, ok := codecs[name]
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrUnsupportedCodec, name)
+		}
+		for _, codec := range list {
+			if err := m.RegisterCodec(codec, typ); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// newVideoFileWriter 按协商的编解码保存视频 vp8、av1保存为ivf vp9保存为webm h264保存为annexb
+func newVideoFileWriter(fileNameWithoutExt, mimeType string) (media.Writer, error) {
+	switch {
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP9):
+		// ivf writer不支持vp9
+		saver, err := webm.NewVideoSaver(fileNameWithoutExt+".webm", mimeType)
+		if err != nil {
+			return nil, err
+		}
+		return &webmVideoWriter{saver: saver}, nil
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP8):
+		return ivfwriter.New(fileNameWithoutExt+".ivf", ivfwriter.WithCodec(webrtc.MimeTypeVP8))
+	case strings.EqualFold(mimeType, webrtc.MimeTypeAV1):
+		return ivfwriter.New(fileNameWithoutExt+".ivf", ivfwriter.WithCodec(webrtc.MimeTypeAV1))
+	case strings.EqualFold(mimeType, webrtc.MimeTypeH264):
+		return h264writer.New(fileNameWithoutExt + ".h264")
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnsupportedCodec, mimeType)
+}
+
+// webmVideoWriter 只保存视频的webm
+type webmVideoWriter struct {
+	saver *webm.Saver
+}
+
+func (w *webmVideoWriter) WriteRTP(p *rtp.Packet) error {
+	return w.saver.PushVideo(p)
+}
+
+func (w *webmVideoWriter) Close() error {
+	w.saver.Close()
+	return nil
+}
@@ -0,0 +1,21 @@
+package sfu
+
+import (
+	"crypto/subtle"
+	"github.com/LeeZXin/zsf/property/static"
+	"net/http"
+	"strings"
+)
+
+// Authorize whip/whep的bearer token鉴权 配置sfu.{kind}.token为空时不鉴权
+func Authorize(request *http.Request, kind string) bool {
+	token := static.GetString("sfu." + kind + ".token")
+	if token == "" {
+		return true
+	}
+	bearer, ok := strings.CutPrefix(request.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) == 1
+}
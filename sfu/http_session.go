@@ -0,0 +1,171 @@
+package sfu
+
+import (
+	"bufio"
+	"errors"
+	"github.com/LeeZXin/zsf/logger"
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v4"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+whip/whep会话
+通过http交换sdp 不需要websocket信令
+POST offer返回answer PATCH添加候选 DELETE结束
+*/
+
+const (
+	// gatherTimeout 等待收集候选后再返回answer
+	gatherTimeout = 3 * time.Second
+)
+
+var (
+	ErrSessionNotFound = errors.New("session not found")
+	ErrInvalidOffer    = errors.New("invalid offer")
+)
+
+var (
+	hmu            = sync.RWMutex{}
+	httpSessionMap = make(map[string]*HttpSession, 8)
+)
+
+// HttpSession 一个whip推流或者whep拉流
+type HttpSession struct {
+	id string
+	// kind whip或whep serviceName为路由中的service 只能通过创建时的路由修改
+	kind        string
+	serviceName string
+	conn        *webrtc.PeerConnection
+	service     RTPService
+	closeOnce   sync.Once
+}
+
+// NewHttpSession 鉴权后创建peerConnection 返回包含候选的answer
+func NewHttpSession(kind, serviceName string, service RTPService, request *http.Request, offer string) (*HttpSession, string, error) {
+	if offer == "" {
+		return nil, "", ErrInvalidOffer
+	}
+	if err := service.AuthenticateAndInit(request); err != nil {
+		return nil, "", err
+	}
+	conn, err := newPeerConnection(service.IsMediaRecvService())
+	if err != nil {
+		return nil, "", err
+	}
+	ret := &HttpSession{
+		id:          uuid.NewString(),
+		kind:        kind,
+		serviceName: serviceName,
+		conn:        conn,
+		service:     service,
+		closeOnce:   sync.Once{},
+	}
+	conn.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		switch state {
+		case webrtc.PeerConnectionStateConnected:
+			if cs, ok := service.(connectedService); ok {
+				cs.OnConnected()
+			}
+		case webrtc.PeerConnectionStateClosed, webrtc.PeerConnectionStateFailed:
+			ret.Close()
+		}
+	})
+	conn.OnDataChannel(service.OnDataChannel)
+	conn.OnTrack(service.OnTrack)
+	service.OnNewPeerConnection(conn)
+	answer, err := ret.answer(offer)
+	if err != nil {
+		ret.Close()
+		return nil, "", err
+	}
+	hmu.Lock()
+	httpSessionMap[ret.id] = ret
+	hmu.Unlock()
+	return ret, answer, nil
+}
+
+func (s *HttpSession) answer(offer string) (string, error) {
+	if err := s.conn.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  offer,
+	}); err != nil {
+		return "", err
+	}
+	answer, err := s.conn.CreateAnswer(nil)
+	if err != nil {
+		return "", err
+	}
+	gatherDone := webrtc.GatheringCompletePromise(s.conn)
+	if err = s.conn.SetLocalDescription(answer); err != nil {
+		return "", err
+	}
+	select {
+	case <-gatherDone:
+	case <-time.After(gatherTimeout):
+		logger.Logger.Info("gather candidates timeout: ", s.id)
+	}
+	return s.conn.LocalDescription().SDP, nil
+}
+
+// Id 资源id 用于生成Location
+func (s *HttpSession) Id() string {
+	return s.id
+}
+
+// AddCandidates 解析trickle-ice-sdpfrag 添加远端候选
+func (s *HttpSession) AddCandidates(frag string) error {
+	var mid string
+	scanner := bufio.NewScanner(strings.NewReader(frag))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if v, ok := strings.CutPrefix(line, "a=mid:"); ok {
+			mid = v
+			continue
+		}
+		if !strings.HasPrefix(line, "a=candidate:") {
+			continue
+		}
+		candidate := webrtc.ICECandidateInit{
+			Candidate: strings.TrimPrefix(line, "a="),
+		}
+		if mid != "" {
+			m := mid
+			candidate.SDPMid = &m
+		} else {
+			var index uint16
+			candidate.SDPMLineIndex = &index
+		}
+		if err := s.conn.AddICECandidate(candidate); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// Close 关闭连接并移除
+func (s *HttpSession) Close() {
+	s.closeOnce.Do(func() {
+		hmu.Lock()
+		if httpSessionMap[s.id] == s {
+			delete(httpSessionMap, s.id)
+		}
+		hmu.Unlock()
+		s.conn.Close()
+		s.service.OnClose()
+	})
+}
+
+// FindHttpSession 获取会话 kind和service需要和创建时一致
+func FindHttpSession(kind, serviceName, id string) (*HttpSession, bool) {
+	hmu.RLock()
+	defer hmu.RUnlock()
+	ret, ok := httpSessionMap[id]
+	if !ok || ret.kind != kind || ret.serviceName != serviceName {
+		return nil, false
+	}
+	return ret, true
+}
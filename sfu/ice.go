@@ -0,0 +1,116 @@
+package sfu
+
+import (
+	"github.com/LeeZXin/z-live/p2p"
+	"github.com/LeeZXin/zsf/logger"
+	"github.com/LeeZXin/zsf/property/static"
+	"github.com/pion/webrtc/v4"
+	"net"
+	"strings"
+	"sync"
+)
+
+/*
+服务端ice配置 服务器在nat后面时需要配置
+sfu.ice.urls 服务端使用的stun/turn地址 turn地址使用turn.secret生成的账号
+sfu.ice.nat1to1Ips 公网ip 替换host候选的内网ip
+sfu.ice.portMin sfu.ice.portMax udp端口范围
+sfu.ice.udpMuxPort 所有连接共用一个udp端口
+sfu.ice.tcpPort 开启ice-tcp 被动候选
+*/
+
+const (
+	iceTcpReadBufferSize = 8
+)
+
+var (
+	settingOnce   = sync.Once{}
+	settingEngine webrtc.SettingEngine
+	settingErr    error
+)
+
+// getSettingEngine udp、tcp端口复用时所有连接共享监听 只初始化一次
+func getSettingEngine() (webrtc.SettingEngine, error) {
+	settingOnce.Do(func() {
+		settingEngine, settingErr = newSettingEngine()
+	})
+	return settingEngine, settingErr
+}
+
+func newSettingEngine() (webrtc.SettingEngine, error) {
+	ret := webrtc.SettingEngine{}
+	if ips := splitConfig("sfu.ice.nat1to1Ips"); len(ips) > 0 {
+		ret.SetNAT1To1IPs(ips, webrtc.ICECandidateTypeHost)
+	}
+	networkTypes := []webrtc.NetworkType{webrtc.NetworkTypeUDP4, webrtc.NetworkTypeUDP6}
+	if port := static.GetInt("sfu.ice.udpMuxPort"); port > 0 {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+		if err != nil {
+			return ret, err
+		}
+		logger.Logger.Info("listen sfu ice udp mux: ", port)
+		ret.SetICEUDPMux(webrtc.NewICEUDPMux(nil, conn))
+	} else if portMin, portMax := static.GetInt("sfu.ice.portMin"), static.GetInt("sfu.ice.portMax"); portMin > 0 && portMax > 0 {
+		if err := ret.SetEphemeralUDPPortRange(uint16(portMin), uint16(portMax)); err != nil {
+			return ret, err
+		}
+	}
+	if port := static.GetInt("sfu.ice.tcpPort"); port > 0 {
+		listener, err := net.ListenTCP("tcp", &net.TCPAddr{Port: port})
+		if err != nil {
+			return ret, err
+		}
+		logger.Logger.Info("listen sfu ice tcp: ", port)
+		ret.SetICETCPMux(webrtc.NewICETCPMux(nil, listener, iceTcpReadBufferSize))
+		networkTypes = append(networkTypes, webrtc.NetworkTypeTCP4, webrtc.NetworkTypeTCP6)
+	}
+	ret.SetNetworkTypes(networkTypes)
+	return ret, nil
+}
+
+// newICEServers 服务端的ice server turn地址生成有时效的账号
+func newICEServers() []webrtc.ICEServer {
+	urls := splitConfig("sfu.ice.urls")
+	if len(urls) == 0 {
+		return []webrtc.ICEServer{}
+	}
+	stunUrls := make([]string, 0, len(urls))
+	turnUrls := make([]string, 0, len(urls))
+	for _, url := range urls {
+		if strings.HasPrefix(url, "turn:") || strings.HasPrefix(url, "turns:") {
+			turnUrls = append(turnUrls, url)
+		} else {
+			stunUrls = append(stunUrls, url)
+		}
+	}
+	ret := make([]webrtc.ICEServer, 0, 2)
+	if len(stunUrls) > 0 {
+		ret = append(ret, webrtc.ICEServer{
+			URLs: stunUrls,
+		})
+	}
+	if len(turnUrls) > 0 {
+		credential, err := p2p.GenerateTurnCredential()
+		if err != nil {
+			logger.Logger.Error(err)
+			return ret
+		}
+		ret = append(ret, webrtc.ICEServer{
+			URLs:       turnUrls,
+			Username:   credential.Username,
+			Credential: credential.Password,
+		})
+	}
+	return ret
+}
+
+// splitConfig 逗号分隔的配置
+func splitConfig(key string) []string {
+	ret := make([]string, 0, 4)
+	for _, item := range strings.Split(static.GetString(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			ret = append(ret, item)
+		}
+	}
+	return ret
+}
@@ -3,6 +3,7 @@ package sfu
 import (
 	"github.com/LeeZXin/zsf-utils/quit"
 	"github.com/LeeZXin/zsf-utils/taskutil"
+	"github.com/pion/rtcp"
 	"github.com/pion/webrtc/v4"
 	"hash/crc32"
 	"sync"
@@ -70,10 +71,12 @@ func (e *roomEntry) getOrNewRoom(id string) *Room {
 		return room
 	}
 	room = &Room{
-		id:         id,
-		members:    make(map[string]*Member, 8),
-		mu:         sync.RWMutex{},
-		createTime: time.Now(),
+		id:          id,
+		members:     make(map[string]*Member, 8),
+		subscribers: make(map[*RoomSubscriber]struct{}, 8),
+		watchers:    make(map[*RoomWatcher]struct{}, 8),
+		mu:          sync.RWMutex{},
+		createTime:  time.Now(),
 	}
 	e.roomMap[id] = room
 	return room
@@ -91,7 +94,7 @@ func (e *roomEntry) checkRoomMemberIsZero() {
 	e.Lock()
 	defer e.Unlock()
 	for id, room := range e.roomMap {
-		if now.Sub(room.createTime) > 30*time.Second && room.MemberSize() == 0 {
+		if now.Sub(room.createTime) > 30*time.Second && room.MemberSize() == 0 && room.SubscriberSize() == 0 {
 			delete(e.roomMap, id)
 		}
 	}
@@ -109,8 +112,13 @@ func init() {
 
 // Room 多人通讯房间
 type Room struct {
-	id         string
-	members    map[string]*Member
+	id      string
+	members map[string]*Member
+	// subscribers 单peerConnection观看端 成员变化时重新协商
+	subscribers map[*RoomSubscriber]struct{}
+	// watchers 接收房间事件
+	watchers   map[*RoomWatcher]struct{}
+	speaker    activeSpeaker
 	mu         sync.RWMutex
 	createTime time.Time
 }
@@ -146,8 +154,14 @@ func (r *Room) AddMember(member *Member) {
 		return
 	}
 	r.mu.Lock()
-	defer r.mu.Unlock()
+	// 音视频track到达时都会调用 只推送一次
+	isNew := r.members[member.UserId()] != member
 	r.members[member.UserId()] = member
+	r.mu.Unlock()
+	if isNew {
+		r.publish(r.memberJoinedEvent(member))
+	}
+	r.notifySubscribers()
 }
 
 // DelMember 删除成员
@@ -156,22 +170,68 @@ func (r *Room) DelMember(member *Member) {
 		return
 	}
 	r.mu.Lock()
-	defer r.mu.Unlock()
 	member.LeaveRoom()
-	delete(r.members, member.UserId())
+	// 重新加入的成员是新的对象 只移除自己
+	isDel := r.members[member.UserId()] == member
+	if isDel {
+		delete(r.members, member.UserId())
+	}
+	r.mu.Unlock()
+	if isDel {
+		r.publish(newRoomEvent(EventMemberLeft, r, member))
+	}
+	r.notifySubscribers()
+}
+
+// AddSubscriber 添加单peerConnection观看端
+func (r *Room) AddSubscriber(subscriber *RoomSubscriber) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.subscribers[subscriber] = struct{}{}
+}
+
+// DelSubscriber 删除单peerConnection观看端
+func (r *Room) DelSubscriber(subscriber *RoomSubscriber) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.subscribers, subscriber)
+}
+
+// SubscriberSize 单peerConnection观看端数量
+func (r *Room) SubscriberSize() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.subscribers)
+}
+
+// notifySubscribers 成员变化 通知观看端同步track
+func (r *Room) notifySubscribers() {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for subscriber := range r.subscribers {
+		go subscriber.Sync()
+	}
 }
 
 // Member 成员
 type Member struct {
 	conn       *webrtc.PeerConnection
 	audioTrack atomic.Value
-	videoTrack atomic.Value
 	room       atomic.Value
 	userId     string
 
 	listeners []*webrtc.PeerConnection
 	mu        sync.Mutex
 	isDel     bool
+
+	// videoLayers simulcast的视频层 非simulcast只有一个
+	videoLayers []*videoLayer
+	// forwarders 观看端 写时复制 []*layerForwarder
+	forwarders atomic.Value
+
+	audioMuted atomic.Bool
+	videoMuted atomic.Bool
+	audioLevel audioLevel
 }
 
 // NewMember 创建一个成员
@@ -227,11 +287,6 @@ func (m *Member) SetAudioTrack(track *webrtc.TrackLocalStaticRTP) {
 	m.audioTrack.Store(track)
 }
 
-// SetVideoTrack 保存视频track
-func (m *Member) SetVideoTrack(track *webrtc.TrackLocalStaticRTP) {
-	m.videoTrack.Store(track)
-}
-
 // AudioTrack 获取音频track
 func (m *Member) AudioTrack() *webrtc.TrackLocalStaticRTP {
 	val := m.audioTrack.Load()
@@ -241,11 +296,115 @@ func (m *Member) AudioTrack() *webrtc.TrackLocalStaticRTP {
 	return nil
 }
 
-// VideoTrack 获取视频track
-func (m *Member) VideoTrack() *webrtc.TrackLocalStaticRTP {
-	val := m.videoTrack.Load()
+// Tracks 成员的音视频track
+func (m *Member) Tracks() []TrackInfo {
+	ret := make([]TrackInfo, 0, 4)
+	if m.AudioTrack() != nil {
+		ret = append(ret, TrackInfo{
+			Kind:  webrtc.RTPCodecTypeAudio.String(),
+			Muted: m.audioMuted.Load(),
+		})
+	}
+	for _, layer := range m.VideoLayers() {
+		ret = append(ret, TrackInfo{
+			Kind:  webrtc.RTPCodecTypeVideo.String(),
+			Rid:   layer.rid,
+			Muted: m.videoMuted.Load(),
+		})
+	}
+	return ret
+}
+
+// SetMuted 客户端通知静音状态 kind为audio或video
+func (m *Member) SetMuted(kind string, muted bool) error {
+	switch kind {
+	case webrtc.RTPCodecTypeAudio.String():
+		m.audioMuted.Store(muted)
+	case webrtc.RTPCodecTypeVideo.String():
+		m.videoMuted.Store(muted)
+	default:
+		return ErrInvalidMsg
+	}
+	return nil
+}
+
+// UpdateAudioLevel 更新音量 和之前的音量加权平均
+func (m *Member) UpdateAudioLevel(level int) {
+	m.audioLevel.Lock()
+	defer m.audioLevel.Unlock()
+	if time.Since(m.audioLevel.lastUpdate) > speakerLevelTimeout {
+		m.audioLevel.level = level
+	} else {
+		m.audioLevel.level = (m.audioLevel.level*3 + level) / 4
+	}
+	m.audioLevel.lastUpdate = time.Now()
+}
+
+// AudioLevel 最近的音量 静音或长时间没有更新时返回false
+func (m *Member) AudioLevel() (int, bool) {
+	if m.audioMuted.Load() {
+		return 0, false
+	}
+	m.audioLevel.Lock()
+	defer m.audioLevel.Unlock()
+	if time.Since(m.audioLevel.lastUpdate) > speakerLevelTimeout {
+		return 0, false
+	}
+	return m.audioLevel.level, true
+}
+
+// AddVideoLayer 保存视频层
+func (m *Member) AddVideoLayer(layer *videoLayer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.videoLayers = append(m.videoLayers, layer)
+}
+
+// VideoLayers 获取视频层 按码率从低到高
+func (m *Member) VideoLayers() []*videoLayer {
+	m.mu.Lock()
+	ret := append([]*videoLayer(nil), m.videoLayers...)
+	m.mu.Unlock()
+	sortLayers(ret)
+	return ret
+}
+
+// RequestKeyFrame 请求推流端发送该层的关键帧
+func (m *Member) RequestKeyFrame(layer *videoLayer) {
+	m.conn.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(layer.ssrc)}})
+}
+
+// AddForwarder 添加观看端
+func (m *Member) AddForwarder(f *layerForwarder) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.isDel {
+		return false
+	}
+	forwarders := append([]*layerForwarder(nil), m.Forwarders()...)
+	m.forwarders.Store(append(forwarders, f))
+	return true
+}
+
+// RemoveForwarder 移除观看端
+func (m *Member) RemoveForwarder(f *layerForwarder) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	old := m.Forwarders()
+	forwarders := make([]*layerForwarder, 0, len(old))
+	for _, forwarder := range old {
+		if forwarder != f {
+			forwarders = append(forwarders, forwarder)
+		}
+	}
+	m.forwarders.Store(forwarders)
+}
+
+// Forwarders 获取观看端
+func (m *Member) Forwarders() []*layerForwarder {
+	val := m.forwarders.Load()
 	if val != nil {
-		return val.(*webrtc.TrackLocalStaticRTP)
+		return val.([]*layerForwarder)
 	}
 	return nil
 }
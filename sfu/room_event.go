@@ -0,0 +1,222 @@
+package sfu
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/pion/rtp"
+	"sync"
+	"time"
+)
+
+/*
+房间事件 通过信令websocket推送给房间相关的连接
+消息都带version 客户端按msgType区分 sdp和candidate的格式保持不变
+*/
+
+const (
+	// EventVersion 消息格式版本 不兼容的修改需要加一
+	EventVersion = 1
+
+	EventMemberJoined  = "memberJoined"
+	EventMemberLeft    = "memberLeft"
+	EventTrackAdded    = "trackAdded"
+	EventTrackRemoved  = "trackRemoved"
+	EventMute          = "mute"
+	EventActiveSpeaker = "activeSpeaker"
+	EventError         = "error"
+
+	// MuteType 客户端通知静音状态
+	MuteType = "mute"
+
+	// audioLevelURI rtp扩展头 音量
+	audioLevelURI = "urn:ietf:params:rtp-hdrext:ssrc-audio-level"
+	// speakerCheckInterval 计算当前说话人的间隔
+	speakerCheckInterval = 500 * time.Millisecond
+	// speakerLevelTimeout 超过时间没有音量认为停止说话
+	speakerLevelTimeout = time.Second
+	// speakerMinLevel 低于该音量不算说话 音量为127-dBov
+	speakerMinLevel = 60
+)
+
+var (
+	ErrUnsupportedVersion = errors.New("unsupported version")
+	ErrUnknownMsgType     = errors.New("unknown msgType")
+	ErrInvalidMsg         = errors.New("invalid msg")
+	ErrNotInRoom          = errors.New("not in room")
+)
+
+// TrackInfo 成员的track
+type TrackInfo struct {
+	Kind  string `json:"kind"`
+	Rid   string `json:"rid,omitempty"`
+	Muted bool   `json:"muted"`
+}
+
+// RoomEvent 推送给客户端的消息
+type RoomEvent struct {
+	Version  int         `json:"version"`
+	MsgType  string      `json:"msgType"`
+	RoomId   string      `json:"roomId,omitempty"`
+	UserId   string      `json:"userId,omitempty"`
+	StreamId string      `json:"streamId,omitempty"`
+	Tracks   []TrackInfo `json:"tracks,omitempty"`
+	Track    *TrackInfo  `json:"track,omitempty"`
+	// Request 出错的请求msgType
+	Request string `json:"request,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+func newRoomEvent(msgType string, room *Room, member *Member) *RoomEvent {
+	ret := &RoomEvent{
+		Version: EventVersion,
+		MsgType: msgType,
+	}
+	if room != nil {
+		ret.RoomId = room.id
+	}
+	if member != nil {
+		ret.UserId = member.UserId()
+		// track的streamId为userId
+		ret.StreamId = member.UserId()
+	}
+	return ret
+}
+
+// NewErrorEvent 错误回复
+func NewErrorEvent(request string, err error) *RoomEvent {
+	return &RoomEvent{
+		Version: EventVersion,
+		MsgType: EventError,
+		Request: request,
+		Error:   err.Error(),
+	}
+}
+
+func (e *RoomEvent) String() string {
+	ret, _ := json.Marshal(e)
+	return string(ret)
+}
+
+// MuteMsg 客户端静音消息内容
+type MuteMsg struct {
+	Kind  string `json:"kind"`
+	Muted bool   `json:"muted"`
+}
+
+// RoomWatcher 接收房间事件 通常是信令websocket
+type RoomWatcher struct {
+	send func(*RoomEvent)
+}
+
+func NewRoomWatcher(send func(*RoomEvent)) *RoomWatcher {
+	return &RoomWatcher{
+		send: send,
+	}
+}
+
+// AddWatcher 添加并推送当前的成员
+func (r *Room) AddWatcher(watcher *RoomWatcher) {
+	r.mu.Lock()
+	r.watchers[watcher] = struct{}{}
+	members := make([]*Member, 0, len(r.members))
+	for _, member := range r.members {
+		members = append(members, member)
+	}
+	r.mu.Unlock()
+	for _, member := range members {
+		watcher.send(r.memberJoinedEvent(member))
+	}
+}
+
+// DelWatcher 移除
+func (r *Room) DelWatcher(watcher *RoomWatcher) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.watchers, watcher)
+}
+
+// publish 推送事件
+func (r *Room) publish(event *RoomEvent) {
+	r.mu.RLock()
+	watchers := make([]*RoomWatcher, 0, len(r.watchers))
+	for watcher := range r.watchers {
+		watchers = append(watchers, watcher)
+	}
+	r.mu.RUnlock()
+	for _, watcher := range watchers {
+		watcher.send(event)
+	}
+}
+
+func (r *Room) memberJoinedEvent(member *Member) *RoomEvent {
+	ret := newRoomEvent(EventMemberJoined, r, member)
+	ret.Tracks = member.Tracks()
+	return ret
+}
+
+// PublishTrack 成员在房间中时推送track变化
+func (r *Room) PublishTrack(msgType string, member *Member, track TrackInfo) {
+	if r.GetMember(member.UserId()) != member {
+		return
+	}
+	event := newRoomEvent(msgType, r, member)
+	event.Track = &track
+	r.publish(event)
+}
+
+// activeSpeaker 房间当前说话人
+type activeSpeaker struct {
+	sync.Mutex
+	userId    string
+	lastCheck time.Time
+}
+
+// updateActiveSpeaker 收到音量时调用 按间隔选出音量最大的成员
+func (r *Room) updateActiveSpeaker() {
+	now := time.Now()
+	r.speaker.Lock()
+	if now.Sub(r.speaker.lastCheck) < speakerCheckInterval {
+		r.speaker.Unlock()
+		return
+	}
+	r.speaker.lastCheck = now
+	var loudest *Member
+	loudestLevel := speakerMinLevel
+	for _, member := range r.Members() {
+		if level, ok := member.AudioLevel(); ok && level > loudestLevel {
+			loudest = member
+			loudestLevel = level
+		}
+	}
+	// 没有人说话时保持上一个说话人
+	if loudest == nil || loudest.UserId() == r.speaker.userId {
+		r.speaker.Unlock()
+		return
+	}
+	r.speaker.userId = loudest.UserId()
+	r.speaker.Unlock()
+	r.publish(newRoomEvent(EventActiveSpeaker, r, loudest))
+}
+
+// audioLevel 成员的音量 平滑处理
+type audioLevel struct {
+	sync.Mutex
+	level      int
+	lastUpdate time.Time
+}
+
+// readAudioLevel 解析扩展头的音量 转为127-dBov 越大越响
+func readAudioLevel(p *rtp.Packet, extensionId uint8) (int, bool) {
+	if extensionId == 0 {
+		return 0, false
+	}
+	payload := p.GetExtension(extensionId)
+	if payload == nil {
+		return 0, false
+	}
+	var ext rtp.AudioLevelExtension
+	if err := ext.Unmarshal(payload); err != nil {
+		return 0, false
+	}
+	return 127 - int(ext.Level), true
+}
@@ -0,0 +1,384 @@
+package sfu
+
+import (
+	"errors"
+	"github.com/google/uuid"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+simulcast 推流端按rid发送多个分辨率的视频层 非simulcast时只有一个rid为空的层
+每个观看端有自己的track 转发其中一个层
+切换层时等待新层的关键帧 改写sequence number和timestamp 观看端看到的是连续的流
+ssrc由观看端track的绑定统一改写
+*/
+
+const (
+	// layerInactiveTimeout 超过时间没有收到包认为该层已停止 浏览器带宽不足时会停掉高分辨率层
+	layerInactiveTimeout = time.Second
+	// switchCheckPackets 切换后检查乱序包的数量
+	switchCheckPackets = 1000
+
+	// 自动切换 丢包率高于lossStepDown降一层 连续goodReportsStepUp次低于lossStepUp升一层
+	lossStepDown      = 0.1
+	lossStepUp        = 0.02
+	goodReportsStepUp = 3
+
+	// AutoLayer 自动切换层
+	AutoLayer = "auto"
+)
+
+var (
+	ErrNoVideoLayer = errors.New("no video layer")
+)
+
+// videoLayer 推流端的一个视频层
+type videoLayer struct {
+	rid        string
+	ssrc       webrtc.SSRC
+	capability webrtc.RTPCodecCapability
+
+	// bitrate 每秒码率 bit
+	bitrate    atomic.Int64
+	lastPacket atomic.Int64
+
+	// 只在读取goroutine中使用
+	windowStart time.Time
+	windowBytes int64
+}
+
+func newVideoLayer(remote *webrtc.TrackRemote) *videoLayer {
+	return &videoLayer{
+		rid:        remote.RID(),
+		ssrc:       remote.SSRC(),
+		capability: remote.Codec().RTPCodecCapability,
+	}
+}
+
+// onPacket 统计码率
+func (l *videoLayer) onPacket(p *rtp.Packet) {
+	now := time.Now()
+	l.lastPacket.Store(now.UnixNano())
+	if l.windowStart.IsZero() {
+		l.windowStart = now
+	}
+	l.windowBytes += int64(len(p.Payload))
+	if elapsed := now.Sub(l.windowStart); elapsed >= time.Second {
+		l.bitrate.Store(l.windowBytes * 8 * int64(time.Second) / int64(elapsed))
+		l.windowStart = now
+		l.windowBytes = 0
+	}
+}
+
+func (l *videoLayer) isActive() bool {
+	return time.Since(time.Unix(0, l.lastPacket.Load())) < layerInactiveTimeout
+}
+
+// sortLayers 按码率从低到高
+func sortLayers(layers []*videoLayer) {
+	sort.SliceStable(layers, func(i, j int) bool {
+		bi, bj := layers[i].bitrate.Load(), layers[j].bitrate.Load()
+		if bi != bj {
+			return bi < bj
+		}
+		return layers[i].rid < layers[j].rid
+	})
+}
+
+// layerForwarder 观看端的视频转发 选择一个层写入自己的track
+type layerForwarder struct {
+	member *Member
+	track  *webrtc.TrackLocalStaticRTP
+	// fixedRid 观看端指定的层 为空时自动切换
+	fixedRid string
+
+	mu      sync.Mutex
+	current *videoLayer
+	// target 等待关键帧切换的层
+	target *videoLayer
+
+	started      bool
+	seqOffset    uint16
+	tsOffset     uint32
+	lastSeq      uint16
+	lastTs       uint32
+	lastTime     time.Time
+	switchOutSeq uint16
+	sinceSwitch  int
+
+	// estimate 观看端remb带宽 bit
+	estimate    int64
+	goodReports int
+}
+
+// newLayerForwarder layer为rid或auto
+func newLayerForwarder(member *Member, layer string) (*layerForwarder, error) {
+	layers := member.VideoLayers()
+	if len(layers) == 0 {
+		return nil, ErrNoVideoLayer
+	}
+	uid := uuid.NewString()
+	// streamId为成员userId 单peerConnection观看时客户端按streamId区分成员
+	track, err := webrtc.NewTrackLocalStaticRTP(layers[0].capability, uid, member.UserId())
+	if err != nil {
+		return nil, err
+	}
+	ret := &layerForwarder{
+		member: member,
+		track:  track,
+	}
+	if layer != AutoLayer {
+		ret.fixedRid = layer
+	}
+	return ret, nil
+}
+
+// start 选择初始的层 自动切换时从最低的层开始
+func (f *layerForwarder) start() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	layers := f.member.VideoLayers()
+	if len(layers) == 0 {
+		return
+	}
+	if f.fixedRid != "" {
+		for _, layer := range layers {
+			if layer.rid == f.fixedRid {
+				f.switchTo(layer)
+				return
+			}
+		}
+	}
+	active := activeLayers(layers)
+	if len(active) > 0 {
+		f.switchTo(active[0])
+	} else {
+		f.switchTo(layers[0])
+	}
+}
+
+// switchTo 请求目标层的关键帧 收到后切换
+func (f *layerForwarder) switchTo(layer *videoLayer) {
+	if layer == nil || layer == f.target {
+		return
+	}
+	if layer == f.current {
+		f.target = nil
+		return
+	}
+	f.target = layer
+	f.member.RequestKeyFrame(layer)
+}
+
+// writeRTP 推流端每个层的包都会调用 只写入当前层
+func (f *layerForwarder) writeRTP(layer *videoLayer, p *rtp.Packet) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if layer == f.target && isKeyFrameStart(layer.capability.MimeType, p.Payload) {
+		f.current = layer
+		f.target = nil
+		f.rebase(layer, p)
+	}
+	if layer != f.current {
+		return nil
+	}
+	outSeq := p.SequenceNumber - f.seqOffset
+	// 切换前的乱序包和旧层的序号冲突 丢弃
+	if f.sinceSwitch < switchCheckPackets {
+		f.sinceSwitch++
+		if int16(outSeq-f.switchOutSeq) < 0 {
+			return nil
+		}
+	}
+	out := *p
+	// 推流端的扩展头id和观看端协商的不一样 rid等也不需要转发
+	out.Header.Extension = false
+	out.Header.ExtensionProfile = 0
+	out.Header.Extensions = nil
+	out.Header.SequenceNumber = outSeq
+	out.Header.Timestamp = p.Timestamp - f.tsOffset
+	if int16(outSeq-f.lastSeq) > 0 {
+		f.lastSeq = outSeq
+		f.lastTs = out.Header.Timestamp
+		f.lastTime = time.Now()
+	}
+	return f.track.WriteRTP(&out)
+}
+
+// rebase 切换层 新层的序号和时间戳接在上一个包之后
+func (f *layerForwarder) rebase(layer *videoLayer, p *rtp.Packet) {
+	if !f.started {
+		f.started = true
+		f.seqOffset = 0
+		f.tsOffset = 0
+		f.lastSeq = p.SequenceNumber - 1
+	} else {
+		f.seqOffset = p.SequenceNumber - (f.lastSeq + 1)
+		delta := uint32(int64(time.Since(f.lastTime)) * int64(layer.capability.ClockRate) / int64(time.Second))
+		if delta == 0 {
+			delta = 1
+		}
+		f.tsOffset = p.Timestamp - (f.lastTs + delta)
+	}
+	f.switchOutSeq = p.SequenceNumber - f.seqOffset
+	f.sinceSwitch = 0
+}
+
+// readRTCP 读取观看端的rtcp sender为转发track的sender
+func (f *layerForwarder) readRTCP(sender *webrtc.RTPSender) {
+	var ssrc uint32
+	if encodings := sender.GetParameters().Encodings; len(encodings) > 0 {
+		ssrc = uint32(encodings[0].SSRC)
+	}
+	for {
+		packets, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		f.handleRTCP(packets, ssrc)
+	}
+}
+
+// handleRTCP 处理观看端的rtcp 转发关键帧请求 自动切换层
+func (f *layerForwarder) handleRTCP(packets []rtcp.Packet, ssrc uint32) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, p := range packets {
+		switch pkt := p.(type) {
+		case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+			if f.target != nil {
+				f.member.RequestKeyFrame(f.target)
+			} else if f.current != nil {
+				f.member.RequestKeyFrame(f.current)
+			}
+		case *rtcp.ReceiverEstimatedMaximumBitrate:
+			f.estimate = int64(pkt.Bitrate)
+			if f.current != nil && f.current.bitrate.Load() > f.estimate {
+				f.step(-1)
+			}
+		case *rtcp.ReceiverReport:
+			// 同一个连接上还有音频和其他成员的track 只看转发track的丢包
+			for _, report := range pkt.Reports {
+				if report.SSRC == ssrc {
+					f.onLoss(float64(report.FractionLost) / 256)
+				}
+			}
+		}
+	}
+}
+
+func (f *layerForwarder) onLoss(loss float64) {
+	switch {
+	case loss > lossStepDown:
+		f.goodReports = 0
+		f.step(-1)
+	case loss < lossStepUp:
+		f.goodReports++
+		if f.goodReports >= goodReportsStepUp {
+			f.goodReports = 0
+			f.step(1)
+		}
+	default:
+		f.goodReports = 0
+	}
+}
+
+// step 自动切换时升降一层 当前层停止时切到最高的活跃层
+func (f *layerForwarder) step(n int) {
+	if f.fixedRid != "" || f.current == nil {
+		return
+	}
+	layers := activeLayers(f.member.VideoLayers())
+	if len(layers) == 0 {
+		return
+	}
+	index := -1
+	for i, layer := range layers {
+		if layer == f.current {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		f.switchTo(layers[len(layers)-1])
+		return
+	}
+	index += n
+	if index < 0 || index >= len(layers) {
+		return
+	}
+	// 没有带宽估计时不升层
+	if n > 0 && (f.estimate <= 0 || layers[index].bitrate.Load() > f.estimate) {
+		return
+	}
+	f.switchTo(layers[index])
+}
+
+// activeLayers 正在发送的层 按码率从低到高
+func activeLayers(layers []*videoLayer) []*videoLayer {
+	ret := make([]*videoLayer, 0, len(layers))
+	for _, layer := range layers {
+		if layer.isActive() {
+			ret = append(ret, layer)
+		}
+	}
+	return ret
+}
+
+// isKeyFrameStart rtp包是否是关键帧的第一个包
+func isKeyFrameStart(mimeType string, payload []byte) bool {
+	if len(payload) == 0 {
+		return false
+	}
+	switch {
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP8):
+		var p codecs.VP8Packet
+		if _, err := p.Unmarshal(payload); err != nil {
+			return false
+		}
+		return p.S == 1 && p.PID == 0 && len(p.Payload) > 0 && p.Payload[0]&0x01 == 0
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP9):
+		var p codecs.VP9Packet
+		if _, err := p.Unmarshal(payload); err != nil {
+			return false
+		}
+		return p.B && !p.P
+	case strings.EqualFold(mimeType, webrtc.MimeTypeH264):
+		return isH264KeyFrameStart(payload)
+	case strings.EqualFold(mimeType, webrtc.MimeTypeAV1):
+		var p codecs.AV1Packet
+		if _, err := p.Unmarshal(payload); err != nil {
+			return false
+		}
+		return p.N
+	}
+	return false
+}
+
+// isH264KeyFrameStart sps或idr开始的包
+func isH264KeyFrameStart(payload []byte) bool {
+	switch payload[0] & 0x1f {
+	case 5, 7:
+		return true
+	case naluTypeStapA:
+		for offset := 1; offset+2 < len(payload); {
+			size := int(payload[offset])<<8 | int(payload[offset+1])
+			switch payload[offset+2] & 0x1f {
+			case 5, 7:
+				return true
+			}
+			offset += 2 + size
+		}
+	case naluTypeFuA:
+		return len(payload) > 1 && payload[1]&0x80 != 0 && payload[1]&0x1f == 5
+	}
+	return false
+}
@@ -0,0 +1,333 @@
+package sfu
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/LeeZXin/zsf/logger"
+	"github.com/LeeZXin/zsf/ws"
+	"github.com/pion/webrtc/v4"
+	"nhooyr.io/websocket"
+	"sync"
+)
+
+/*
+单peerConnection观看房间
+一个连接接收房间所有成员的音视频 成员进入或离开时服务端通过信令发送offer重新协商
+客户端收到offer后回复answer websocket在观看期间保持连接
+track的streamId为成员userId 客户端按streamId区分成员
+和多peerConnection模式相比 无法跨服务器调度 但客户端只需要一个连接
+*/
+
+var (
+	ErrSubscriberClosed = errors.New("subscriber closed")
+	ErrNotNegotiating   = errors.New("no offer is waiting for answer")
+)
+
+// subscribedMember 已订阅成员的sender
+type subscribedMember struct {
+	member    *Member
+	senders   []*webrtc.RTPSender
+	forwarder *layerForwarder
+}
+
+// RoomSubscriber 单peerConnection观看端
+type RoomSubscriber struct {
+	conn   *webrtc.PeerConnection
+	room   *Room
+	userId string
+	layer  string
+	// sendOffer 通过信令发送offer
+	sendOffer func(webrtc.SessionDescription) error
+
+	mu      sync.Mutex
+	members map[string]*subscribedMember
+	// negotiating 已发送offer 等待answer
+	negotiating bool
+	// pending 等待answer期间成员发生变化 收到answer后再次协商
+	pending bool
+	closed  bool
+}
+
+func newRoomSubscriber(conn *webrtc.PeerConnection, room *Room, userId, layer string, sendOffer func(webrtc.SessionDescription) error) *RoomSubscriber {
+	return &RoomSubscriber{
+		conn:      conn,
+		room:      room,
+		userId:    userId,
+		layer:     layer,
+		sendOffer: sendOffer,
+		mu:        sync.Mutex{},
+		members:   make(map[string]*subscribedMember, 8),
+	}
+}
+
+// Sync 按房间成员添加或移除track 有变化时重新协商
+func (s *RoomSubscriber) Sync() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	changed := false
+	current := make(map[string]*Member, 8)
+	for _, member := range s.room.Members() {
+		if member.UserId() != s.userId {
+			current[member.UserId()] = member
+		}
+	}
+	for userId, subscribed := range s.members {
+		if current[userId] != subscribed.member {
+			s.unsubscribe(subscribed)
+			delete(s.members, userId)
+			changed = true
+		}
+	}
+	for userId, member := range current {
+		if _, ok := s.members[userId]; ok {
+			continue
+		}
+		subscribed, err := s.subscribe(member)
+		if err != nil {
+			logger.Logger.Error(err)
+			continue
+		}
+		s.members[userId] = subscribed
+		changed = true
+	}
+	if changed {
+		s.negotiate()
+	}
+}
+
+func (s *RoomSubscriber) subscribe(member *Member) (*subscribedMember, error) {
+	ret := &subscribedMember{
+		member: member,
+	}
+	audio := member.AudioTrack()
+	if audio == nil {
+		return nil, errors.New("member has no audio")
+	}
+	sender, err := s.conn.AddTrack(audio)
+	if err != nil {
+		return nil, err
+	}
+	ret.senders = append(ret.senders, sender)
+	forwarder, err := newLayerForwarder(member, s.layer)
+	if err != nil {
+		s.unsubscribe(ret)
+		return nil, err
+	}
+	sender, err = s.conn.AddTrack(forwarder.track)
+	if err != nil {
+		s.unsubscribe(ret)
+		return nil, err
+	}
+	ret.senders = append(ret.senders, sender)
+	if !member.AddForwarder(forwarder) {
+		s.unsubscribe(ret)
+		return nil, errors.New("member left")
+	}
+	ret.forwarder = forwarder
+	forwarder.start()
+	go forwarder.readRTCP(sender)
+	return ret, nil
+}
+
+func (s *RoomSubscriber) unsubscribe(subscribed *subscribedMember) {
+	if subscribed.forwarder != nil {
+		subscribed.member.RemoveForwarder(subscribed.forwarder)
+	}
+	for _, sender := range subscribed.senders {
+		if err := s.conn.RemoveTrack(sender); err != nil {
+			logger.Logger.Error(err)
+		}
+	}
+}
+
+// negotiate 发送offer 上一次协商未完成时等待answer后再发送
+func (s *RoomSubscriber) negotiate() {
+	if s.negotiating {
+		s.pending = true
+		return
+	}
+	offer := s.conn.PendingLocalDescription()
+	if offer != nil && s.conn.SignalingState() == webrtc.SignalingStateHaveLocalOffer {
+		// 上一次的offer没有收到有效的answer 不能替换 重新发送 收到answer后再协商之后的变化
+		s.pending = true
+	} else {
+		created, err := s.conn.CreateOffer(nil)
+		if err != nil {
+			logger.Logger.Error(err)
+			return
+		}
+		if err = s.conn.SetLocalDescription(created); err != nil {
+			logger.Logger.Error(err)
+			return
+		}
+		offer = &created
+	}
+	s.negotiating = true
+	if err := s.sendOffer(*offer); err != nil {
+		logger.Logger.Error(err)
+		s.resetNegotiation()
+		// 信令已经断开 无法再协商
+		go s.Close()
+	}
+}
+
+// resetNegotiation 协商失败
+func (s *RoomSubscriber) resetNegotiation() {
+	s.negotiating = false
+	s.pending = false
+}
+
+// OnAnswer 收到客户端的answer
+func (s *RoomSubscriber) OnAnswer(answer webrtc.SessionDescription) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrSubscriberClosed
+	}
+	if !s.negotiating {
+		return ErrNotNegotiating
+	}
+	if err := s.conn.SetRemoteDescription(answer); err != nil {
+		// 重新协商 offer还未完成时重新发送
+		s.resetNegotiation()
+		s.negotiate()
+		return err
+	}
+	s.negotiating = false
+	if s.pending {
+		s.pending = false
+		s.negotiate()
+	}
+	return nil
+}
+
+// Close 移除所有track 退出房间观看
+func (s *RoomSubscriber) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.room.DelSubscriber(s)
+	for _, subscribed := range s.members {
+		if subscribed.forwarder != nil {
+			subscribed.member.RemoveForwarder(subscribed.forwarder)
+		}
+	}
+	s.members = nil
+	s.conn.Close()
+}
+
+// subscribeSignalService 单peerConnection观看的信令 服务端发送offer
+type subscribeSignalService struct {
+	conn       *webrtc.PeerConnection
+	subscriber *RoomSubscriber
+	watcher    *RoomWatcher
+}
+
+// NewSubscribeSignalService 需要参数room user 可选layer
+func NewSubscribeSignalService() ws.Service {
+	return &subscribeSignalService{}
+}
+
+func (s *subscribeSignalService) OnOpen(session *ws.Session) {
+	query := session.Request().URL.Query()
+	room := GetRoom(query.Get("room"))
+	userId := query.Get("user")
+	if room == nil || userId == "" {
+		session.Close(websocket.StatusBadGateway, "authentication failed")
+		return
+	}
+	layer := query.Get("layer")
+	if layer == "" {
+		layer = AutoLayer
+	}
+	peerConnection, err := newPeerConnection(false)
+	if err != nil {
+		logger.Logger.Error(err.Error())
+		session.Close(websocket.StatusAbnormalClosure, "sys err")
+		return
+	}
+	subscriber := newRoomSubscriber(peerConnection, room, userId, layer, func(offer webrtc.SessionDescription) error {
+		outbound, err := encodeWsMsg(OfferType, offer)
+		if err != nil {
+			return err
+		}
+		return session.WriteTextMessage(outbound)
+	})
+	peerConnection.OnICECandidate(func(c *webrtc.ICECandidate) {
+		if c == nil {
+			return
+		}
+		outbound, oerr := encodeWsMsg(CandidateType, c.ToJSON())
+		if oerr != nil {
+			logger.Logger.Error(oerr.Error())
+			return
+		}
+		if err := session.WriteTextMessage(outbound); err != nil {
+			session.Close(websocket.StatusAbnormalClosure, "write err")
+		}
+	})
+	peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		switch state {
+		case webrtc.PeerConnectionStateClosed, webrtc.PeerConnectionStateFailed:
+			session.Close(websocket.StatusNormalClosure, "")
+			subscriber.Close()
+		}
+	})
+	s.conn = peerConnection
+	s.subscriber = subscriber
+	s.watcher = NewRoomWatcher(func(event *RoomEvent) {
+		session.WriteTextMessage(event.String())
+	})
+	room.AddWatcher(s.watcher)
+	room.AddSubscriber(subscriber)
+	subscriber.Sync()
+}
+
+func (s *subscribeSignalService) OnTextMessage(session *ws.Session, text string) {
+	if s.subscriber == nil {
+		return
+	}
+	var msg WsMsg
+	err := json.Unmarshal([]byte(text), &msg)
+	if err != nil {
+		replyError(session, "", ErrInvalidMsg)
+		return
+	}
+	if err = msg.checkVersion(); err != nil {
+		replyError(session, msg.MsgType, err)
+		return
+	}
+	switch {
+	case msg.IsAnswerType():
+		var answer webrtc.SessionDescription
+		if answer, err = msg.GetAnswer(); err == nil {
+			err = s.subscriber.OnAnswer(answer)
+		}
+	case msg.IsCandidateMsg():
+		var candidate webrtc.ICECandidateInit
+		if candidate, err = msg.GetCandidate(); err == nil {
+			err = s.conn.AddICECandidate(candidate)
+		}
+	default:
+		err = ErrUnknownMsgType
+	}
+	if err != nil {
+		replyError(session, msg.MsgType, err)
+	}
+}
+
+func (*subscribeSignalService) OnBinaryMessage(*ws.Session, []byte) {}
+
+// OnClose 观看期间websocket保持连接 断开时结束观看
+func (s *subscribeSignalService) OnClose(*ws.Session) {
+	if s.subscriber != nil {
+		s.subscriber.room.DelWatcher(s.watcher)
+		s.subscriber.Close()
+	}
+}
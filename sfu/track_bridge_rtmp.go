@@ -0,0 +1,363 @@
+package sfu
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/LeeZXin/z-live/av"
+	"github.com/LeeZXin/z-live/flv"
+	"github.com/LeeZXin/z-live/rtmp"
+	"github.com/LeeZXin/zsf/logger"
+	"github.com/LeeZXin/zsf/property/static"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media/samplebuilder"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+浏览器推流h264+opus转为rtmp推流
+注册到rtmp的推流列表 可以用rtmp、http-flv、hls播放
+没有纯go的aac编码 音频按sfu.bridge.audio配置
+opus使用enhanced rtmp的opus封装 为空时丢弃音频
+*/
+
+const (
+	// bridgePLIInterval 浏览器很久才发一个关键帧 定时请求关键帧用于gop缓存和hls切片
+	bridgePLIInterval = 2 * time.Second
+)
+
+var (
+	opusFourCC = []byte("Opus")
+)
+
+// BridgeToRtmpTrackService 浏览器音视频转为rtmp推流 需要参数app name
+type BridgeToRtmpTrackService struct {
+	app       string
+	name      string
+	conn      *webrtc.PeerConnection
+	source    *bridgeSource
+	startTime time.Time
+	withOpus  bool
+
+	ctx      context.Context
+	cancelFn context.CancelFunc
+	rtcpOnce sync.Once
+}
+
+func NewBridgeToRtmpTrackService() RTPService {
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	return &BridgeToRtmpTrackService{
+		ctx:      ctx,
+		cancelFn: cancelFunc,
+		rtcpOnce: sync.Once{},
+		withOpus: static.GetString("sfu.bridge.audio") == "opus",
+	}
+}
+
+func (s *BridgeToRtmpTrackService) IsMediaRecvService() bool {
+	return true
+}
+
+func (s *BridgeToRtmpTrackService) AuthenticateAndInit(request *http.Request) error {
+	app := request.URL.Query().Get("app")
+	name := request.URL.Query().Get("name")
+	if app == "" || name == "" {
+		return errors.New("app or name empty")
+	}
+	if _, ok := rtmp.FindPublisher(app + "/" + name); ok {
+		return rtmp.ErrPublisherExists
+	}
+	s.app = app
+	s.name = name
+	return nil
+}
+
+func (s *BridgeToRtmpTrackService) OnNewPeerConnection(conn *webrtc.PeerConnection) {
+	s.conn = conn
+	// 只协商h264 不需要转码
+	for _, transceiver := range conn.GetTransceivers() {
+		if transceiver.Kind() != webrtc.RTPCodecTypeVideo {
+			continue
+		}
+		if err := transceiver.SetCodecPreferences(videoCodecs["h264"]); err != nil {
+			logger.Logger.Error(err)
+		}
+	}
+	s.startTime = time.Now()
+	s.source = newBridgeSource()
+	go func() {
+		if err := rtmp.Publish(s.app, s.name, s.source); err != nil {
+			logger.Logger.Error(err)
+			conn.Close()
+		}
+	}()
+}
+
+func (s *BridgeToRtmpTrackService) OnDataChannel(*webrtc.DataChannel) {}
+
+func (s *BridgeToRtmpTrackService) OnTrack(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+	mimeType := track.Codec().MimeType
+	switch {
+	case strings.EqualFold(mimeType, webrtc.MimeTypeH264):
+		s.sendPLI(track)
+		s.bridgeVideo(track)
+	case strings.EqualFold(mimeType, webrtc.MimeTypeOpus):
+		if s.withOpus {
+			s.bridgeAudio(track)
+		}
+	default:
+		logger.Logger.Errorf("bridge %s/%s unsupported codec: %s", s.app, s.name, mimeType)
+	}
+}
+
+func (s *BridgeToRtmpTrackService) bridgeVideo(track *webrtc.TrackRemote) {
+	builder := samplebuilder.New(128, &codecs.H264Packet{IsAVC: true}, 90000)
+	clock := newBridgeClock(s.startTime, 90)
+	var converter h264Converter
+	for {
+		p, _, err := track.ReadRTP()
+		if err != nil {
+			return
+		}
+		builder.Push(p)
+		for {
+			sample := builder.Pop()
+			if sample == nil {
+				break
+			}
+			ts := clock.timestamp(sample.PacketTimestamp)
+			for _, data := range converter.convert(sample.Data) {
+				s.source.push(newBridgePacket(true, ts, data))
+			}
+		}
+	}
+}
+
+func (s *BridgeToRtmpTrackService) bridgeAudio(track *webrtc.TrackRemote) {
+	builder := samplebuilder.New(50, &codecs.OpusPacket{}, 48000)
+	clock := newBridgeClock(s.startTime, 48)
+	seqSent := false
+	for {
+		p, _, err := track.ReadRTP()
+		if err != nil {
+			return
+		}
+		builder.Push(p)
+		for {
+			sample := builder.Pop()
+			if sample == nil {
+				break
+			}
+			ts := clock.timestamp(sample.PacketTimestamp)
+			if !seqSent {
+				seqSent = true
+				s.source.push(newBridgePacket(false, ts, opusSeqHeader(int(track.Codec().Channels))))
+			}
+			data := make([]byte, 0, len(sample.Data)+5)
+			data = append(data, av.SOUND_EX_HEADER<<4|av.AUDIO_PACKET_CODED_FRAMES)
+			data = append(data, opusFourCC...)
+			data = append(data, sample.Data...)
+			s.source.push(newBridgePacket(false, ts, data))
+		}
+	}
+}
+
+// sendPLI 定时请求关键帧
+func (s *BridgeToRtmpTrackService) sendPLI(track *webrtc.TrackRemote) {
+	s.rtcpOnce.Do(func() {
+		go func() {
+			ticker := time.NewTicker(bridgePLIInterval)
+			defer ticker.Stop()
+			for {
+				s.conn.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(track.SSRC())}})
+				select {
+				case <-ticker.C:
+				case <-s.ctx.Done():
+					return
+				}
+			}
+		}()
+	})
+}
+
+func (s *BridgeToRtmpTrackService) OnClose() {
+	s.cancelFn()
+	if s.source != nil {
+		s.source.Close()
+	}
+}
+
+// h264Converter avcc格式的access unit转为rtmp视频tag sps、pps变化时重新发送sequence header
+type h264Converter struct {
+	sps      []byte
+	pps      []byte
+	seqDirty bool
+	// started 收到第一个关键帧后开始输出
+	started bool
+}
+
+func (c *h264Converter) convert(au []byte) [][]byte {
+	nalus := make([][]byte, 0, 4)
+	keyFrame := false
+	for len(au) > 4 {
+		size := int(binary.BigEndian.Uint32(au))
+		if size <= 0 || size > len(au)-4 {
+			break
+		}
+		nalu := au[4 : 4+size]
+		au = au[4+size:]
+		switch nalu[0] & 0x1f {
+		case 7:
+			if string(nalu) != string(c.sps) {
+				c.sps = append([]byte(nil), nalu...)
+				c.seqDirty = true
+			}
+		case 8:
+			if string(nalu) != string(c.pps) {
+				c.pps = append([]byte(nil), nalu...)
+				c.seqDirty = true
+			}
+		case 9:
+			// access unit delimiter rtmp不需要
+		case 5:
+			keyFrame = true
+			nalus = append(nalus, nalu)
+		default:
+			nalus = append(nalus, nalu)
+		}
+	}
+	ret := make([][]byte, 0, 2)
+	if c.seqDirty && len(c.sps) >= 4 && len(c.pps) > 0 {
+		c.seqDirty = false
+		ret = append(ret, c.seqHeader())
+	}
+	if keyFrame {
+		c.started = true
+	}
+	if !c.started || len(c.sps) == 0 || len(nalus) == 0 {
+		return ret
+	}
+	frameType := byte(av.FRAME_INTER)
+	if keyFrame {
+		frameType = av.FRAME_KEY
+	}
+	frame := []byte{frameType<<4 | av.VIDEO_H264, av.AVC_NALU, 0, 0, 0}
+	for _, nalu := range nalus {
+		frame = binary.BigEndian.AppendUint32(frame, uint32(len(nalu)))
+		frame = append(frame, nalu...)
+	}
+	return append(ret, frame)
+}
+
+// seqHeader AVCDecoderConfigurationRecord
+func (c *h264Converter) seqHeader() []byte {
+	ret := []byte{av.FRAME_KEY<<4 | av.VIDEO_H264, av.AVC_SEQHDR, 0, 0, 0,
+		1, c.sps[1], c.sps[2], c.sps[3], 0xff, 0xe1}
+	ret = binary.BigEndian.AppendUint16(ret, uint16(len(c.sps)))
+	ret = append(ret, c.sps...)
+	ret = append(ret, 1)
+	ret = binary.BigEndian.AppendUint16(ret, uint16(len(c.pps)))
+	return append(ret, c.pps...)
+}
+
+// opusSeqHeader enhanced rtmp的opus sequence start 内容为OpusHead
+func opusSeqHeader(channels int) []byte {
+	if channels <= 0 {
+		channels = 2
+	}
+	ret := []byte{av.SOUND_EX_HEADER<<4 | av.AUDIO_PACKET_SEQUENCE_START}
+	ret = append(ret, opusFourCC...)
+	ret = append(ret, "OpusHead"...)
+	ret = append(ret, 1, byte(channels))
+	// pre-skip
+	ret = binary.LittleEndian.AppendUint16(ret, 312)
+	ret = binary.LittleEndian.AppendUint32(ret, 48000)
+	// output gain 和 channel mapping family
+	return append(ret, 0, 0, 0)
+}
+
+// bridgeClock rtp时间戳转为毫秒 第一个包按收到的时间对齐音视频
+type bridgeClock struct {
+	startTime time.Time
+	hz        int64
+	started   bool
+	baseMs    int64
+	lastRtp   uint32
+	elapsed   int64
+}
+
+func newBridgeClock(startTime time.Time, hz int64) *bridgeClock {
+	return &bridgeClock{
+		startTime: startTime,
+		hz:        hz,
+	}
+}
+
+func (c *bridgeClock) timestamp(rtpTs uint32) uint32 {
+	if !c.started {
+		c.started = true
+		c.baseMs = time.Since(c.startTime).Milliseconds()
+		c.lastRtp = rtpTs
+	}
+	// 差值按int32处理回绕
+	c.elapsed += int64(int32(rtpTs - c.lastRtp))
+	c.lastRtp = rtpTs
+	ret := c.baseMs + c.elapsed/c.hz
+	if ret < 0 {
+		ret = 0
+	}
+	return uint32(ret)
+}
+
+func newBridgePacket(isVideo bool, ts uint32, data []byte) *av.Packet {
+	return &av.Packet{
+		IsVideo:   isVideo,
+		IsAudio:   !isVideo,
+		Timestamp: ts,
+		Data:      data,
+	}
+}
+
+// bridgeSource rtmp.PacketSource实现 转换后的tag从channel读取
+type bridgeSource struct {
+	packetCh chan *av.Packet
+	ctx      context.Context
+	cancelFn context.CancelFunc
+}
+
+func newBridgeSource() *bridgeSource {
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	return &bridgeSource{
+		packetCh: make(chan *av.Packet, 256),
+		ctx:      ctx,
+		cancelFn: cancelFunc,
+	}
+}
+
+func (s *bridgeSource) push(p *av.Packet) {
+	select {
+	case s.packetCh <- p:
+	case <-s.ctx.Done():
+	}
+}
+
+func (s *bridgeSource) ReadPacket(p *av.Packet) error {
+	select {
+	case <-s.ctx.Done():
+		return io.EOF
+	case pkt := <-s.packetCh:
+		*p = *pkt
+		return flv.DemuxH(p)
+	}
+}
+
+func (s *bridgeSource) Close() error {
+	s.cancelFn()
+	return nil
+}
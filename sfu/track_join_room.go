@@ -9,7 +9,7 @@ import (
 	"github.com/pion/rtcp"
 	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v4"
-	"github.com/pion/webrtc/v4/pkg/media/ivfwriter"
+	"github.com/pion/webrtc/v4/pkg/media"
 	"github.com/pion/webrtc/v4/pkg/media/oggwriter"
 	"net/http"
 	"strings"
@@ -21,6 +21,8 @@ type rtpPacket struct {
 	mimeType string
 	kind     webrtc.RTPCodecType
 	packet   *rtp.Packet
+	// videoFile 收到视频track后创建的文件 由保存协程使用和关闭
+	videoFile media.Writer
 }
 
 const (
@@ -34,8 +36,10 @@ type JoinRoomTrackService struct {
 	userId string
 	member *Member
 
-	oggFile  *oggwriter.OggWriter
-	ivfFile  *ivfwriter.IVFWriter
+	filePrefix string
+	// saveOnce simulcast只保存第一个视频层
+	saveOnce sync.Once
+	saveRid  string
 	rtcpOnce sync.Once
 
 	ctx      context.Context
@@ -46,6 +50,7 @@ type JoinRoomTrackService struct {
 func NewJoinRoomTrackService() RTPService {
 	ctx, cancelFunc := context.WithCancel(context.Background())
 	ret := &JoinRoomTrackService{
+		saveOnce: sync.Once{},
 		rtcpOnce: sync.Once{},
 		ctx:      ctx,
 		cancelFn: cancelFunc,
@@ -86,37 +91,28 @@ func (s *JoinRoomTrackService) AuthenticateAndInit(request *http.Request) error
 		if err != nil {
 			return err
 		}
-		s.oggFile = oggFile
-		ivfFileName := fmt.Sprintf("%s_%d.ivf", userId, now)
-		ivfFile, err := ivfwriter.New(ivfFileName)
-		if err != nil {
-			return err
-		}
-		s.ivfFile = ivfFile
-		go func() {
-			for {
-				select {
-				case p, ok := <-s.saveChan:
-					if !ok {
-						return
-					}
-					if strings.EqualFold(p.mimeType, webrtc.MimeTypeOpus) {
-						s.oggFile.WriteRTP(p.packet)
-					} else if strings.EqualFold(p.mimeType, webrtc.MimeTypeVP8) {
-						s.ivfFile.WriteRTP(p.packet)
-					}
-				}
-			}
-		}()
+		s.filePrefix = fmt.Sprintf("%s_%d", userId, now)
+		go s.save(oggFile)
 	}
 	return nil
 }
 
 func (s *JoinRoomTrackService) OnDataChannel(*webrtc.DataChannel) {}
 
-func (s *JoinRoomTrackService) OnTrack(remote *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
-	if saveToDiskFlag {
-		if webrtc.RTPCodecTypeVideo == remote.Kind() {
+func (s *JoinRoomTrackService) OnTrack(remote *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+	if webrtc.RTPCodecTypeVideo == remote.Kind() {
+		if saveToDiskFlag {
+			// simulcast每个层都会触发 只保存第一个层
+			s.saveOnce.Do(func() {
+				// 按协商的编码保存 在视频packet之前发给保存协程
+				videoFile, err := newVideoFileWriter(s.filePrefix, remote.Codec().MimeType)
+				if err != nil {
+					logger.Logger.Error(err)
+				} else {
+					s.saveChan <- &rtpPacket{videoFile: videoFile}
+				}
+				s.saveRid = remote.RID()
+			})
 			go func() {
 				ticker := time.NewTicker(time.Second)
 				defer ticker.Stop()
@@ -130,37 +126,59 @@ func (s *JoinRoomTrackService) OnTrack(remote *webrtc.TrackRemote, _ *webrtc.RTP
 				}
 			}()
 		}
+		layer := newVideoLayer(remote)
+		s.member.AddVideoLayer(layer)
+		track := TrackInfo{Kind: remote.Kind().String(), Rid: layer.rid}
+		// 已经在房间时推送 否则包含在memberJoined中
+		s.member.Room().PublishTrack(EventTrackAdded, s.member, track)
+		s.addToRoom()
+		s.sendToLayer(remote, layer)
+		s.member.Room().PublishTrack(EventTrackRemoved, s.member, track)
+		return
 	}
 	uid := uuid.NewString()
-	localTrack, err := webrtc.NewTrackLocalStaticRTP(remote.Codec().RTPCodecCapability, uid, uid+"_stream")
+	localTrack, err := webrtc.NewTrackLocalStaticRTP(remote.Codec().RTPCodecCapability, uid, s.userId)
 	if err != nil {
 		s.conn.Close()
 		return
 	}
-	switch remote.Kind() {
-	case webrtc.RTPCodecTypeAudio:
-		s.member.SetAudioTrack(localTrack)
-	case webrtc.RTPCodecTypeVideo:
-		s.member.SetVideoTrack(localTrack)
+	s.member.SetAudioTrack(localTrack)
+	track := TrackInfo{Kind: remote.Kind().String()}
+	s.member.Room().PublishTrack(EventTrackAdded, s.member, track)
+	s.addToRoom()
+	s.sendToTrack(remote, localTrack, audioLevelExtensionId(receiver))
+	s.member.Room().PublishTrack(EventTrackRemoved, s.member, track)
+}
+
+// audioLevelExtensionId 协商的音量扩展头id 没有时为0
+func audioLevelExtensionId(receiver *webrtc.RTPReceiver) uint8 {
+	for _, ext := range receiver.GetParameters().HeaderExtensions {
+		if ext.URI == audioLevelURI {
+			return uint8(ext.ID)
+		}
 	}
-	if s.member.AudioTrack() != nil && s.member.VideoTrack() != nil {
+	return 0
+}
+
+// addToRoom 音频和视频都收到后加入房间
+func (s *JoinRoomTrackService) addToRoom() {
+	if s.member.AudioTrack() != nil && len(s.member.VideoLayers()) > 0 {
 		s.member.Room().AddMember(s.member)
 	}
-	s.sendToTrack(remote, localTrack)
 }
 
-func (s *JoinRoomTrackService) sendToTrack(remote *webrtc.TrackRemote, track *webrtc.TrackLocalStaticRTP) {
+// sendToTrack 音频转发 按音量计算说话人
+func (s *JoinRoomTrackService) sendToTrack(remote *webrtc.TrackRemote, track *webrtc.TrackLocalStaticRTP, audioLevelId uint8) {
+	room := s.member.Room()
 	for {
 		p, _, err := remote.ReadRTP()
 		if err != nil {
 			return
 		}
-		if saveToDiskFlag {
-			s.saveChan <- &rtpPacket{
-				mimeType: remote.Codec().MimeType,
-				kind:     remote.Kind(),
-				packet:   p.Clone(),
-			}
+		s.saveToDisk(remote, p)
+		if level, ok := readAudioLevel(p, audioLevelId); ok {
+			s.member.UpdateAudioLevel(level)
+			room.updateActiveSpeaker()
 		}
 		if err = track.WriteRTP(p); err != nil {
 			logger.Logger.Error(err.Error())
@@ -169,6 +187,78 @@ func (s *JoinRoomTrackService) sendToTrack(remote *webrtc.TrackRemote, track *we
 	}
 }
 
+// sendToLayer 视频层转发给所有观看端
+func (s *JoinRoomTrackService) sendToLayer(remote *webrtc.TrackRemote, layer *videoLayer) {
+	for {
+		p, _, err := remote.ReadRTP()
+		if err != nil {
+			return
+		}
+		s.saveToDisk(remote, p)
+		layer.onPacket(p)
+		for _, forwarder := range s.member.Forwarders() {
+			if err = forwarder.writeRTP(layer, p); err != nil {
+				logger.Logger.Error(err.Error())
+			}
+		}
+	}
+}
+
+// save 保存协程 saveChan关闭后关闭文件
+func (s *JoinRoomTrackService) save(oggFile *oggwriter.OggWriter) {
+	var videoFile media.Writer
+	defer func() {
+		oggFile.Close()
+		if videoFile != nil {
+			videoFile.Close()
+		}
+	}()
+	for p := range s.saveChan {
+		switch {
+		case p.videoFile != nil:
+			videoFile = p.videoFile
+		case strings.EqualFold(p.mimeType, webrtc.MimeTypeOpus):
+			oggFile.WriteRTP(p.packet)
+		case p.kind == webrtc.RTPCodecTypeVideo && videoFile != nil:
+			videoFile.WriteRTP(p.packet)
+		}
+	}
+}
+
+func (s *JoinRoomTrackService) saveToDisk(remote *webrtc.TrackRemote, p *rtp.Packet) {
+	if !saveToDiskFlag {
+		return
+	}
+	if remote.Kind() == webrtc.RTPCodecTypeVideo && remote.RID() != s.saveRid {
+		return
+	}
+	s.saveChan <- &rtpPacket{
+		mimeType: remote.Codec().MimeType,
+		kind:     remote.Kind(),
+		packet:   p.Clone(),
+	}
+}
+
+// Room 信令连接推送所在房间的事件
+func (s *JoinRoomTrackService) Room() *Room {
+	if s.member == nil {
+		return nil
+	}
+	return s.member.Room()
+}
+
+// SetMuted 客户端通知静音 推送给房间
+func (s *JoinRoomTrackService) SetMuted(kind string, muted bool) error {
+	if s.member == nil {
+		return ErrNotInRoom
+	}
+	if err := s.member.SetMuted(kind, muted); err != nil {
+		return err
+	}
+	s.member.Room().PublishTrack(EventMute, s.member, TrackInfo{Kind: kind, Muted: muted})
+	return nil
+}
+
 func (s *JoinRoomTrackService) OnClose() {
 	if s.member != nil {
 		room := s.member.Room()
@@ -177,20 +267,18 @@ func (s *JoinRoomTrackService) OnClose() {
 		}
 	}
 	s.cancelFn()
+	// 保存协程写完后关闭文件
 	if s.saveChan != nil {
 		close(s.saveChan)
 	}
-	if s.oggFile != nil {
-		s.oggFile.Close()
-	}
-	if s.ivfFile != nil {
-		s.ivfFile.Close()
-	}
 }
 
 type RoomForwardTrackService struct {
 	conn         *webrtc.PeerConnection
 	targetMember *Member
+	// layer 观看的simulcast层 rid或auto
+	layer     string
+	forwarder *layerForwarder
 }
 
 func NewRoomForwardTrackService() RTPService {
@@ -208,14 +296,23 @@ func (s *RoomForwardTrackService) OnNewPeerConnection(conn *webrtc.PeerConnectio
 		conn.Close()
 		return
 	}
-	if _, err = conn.AddTrack(s.targetMember.VideoTrack()); err != nil {
+	forwarder, err := newLayerForwarder(s.targetMember, s.layer)
+	if err != nil {
 		conn.Close()
 		return
 	}
-	if !s.targetMember.AddListener(conn) {
+	sender, err := conn.AddTrack(forwarder.track)
+	if err != nil {
 		conn.Close()
 		return
 	}
+	if !s.targetMember.AddListener(conn) || !s.targetMember.AddForwarder(forwarder) {
+		conn.Close()
+		return
+	}
+	s.forwarder = forwarder
+	forwarder.start()
+	go forwarder.readRTCP(sender)
 }
 
 func (s *RoomForwardTrackService) AuthenticateAndInit(request *http.Request) error {
@@ -236,11 +333,24 @@ func (s *RoomForwardTrackService) AuthenticateAndInit(request *http.Request) err
 		return errors.New("invalid member")
 	}
 	s.targetMember = member
+	s.layer = request.URL.Query().Get("layer")
+	if s.layer == "" {
+		s.layer = AutoLayer
+	}
 	return nil
 }
 
+// Room 信令连接推送观看成员所在房间的事件
+func (s *RoomForwardTrackService) Room() *Room {
+	return s.targetMember.Room()
+}
+
 func (s *RoomForwardTrackService) OnDataChannel(*webrtc.DataChannel) {}
 
 func (s *RoomForwardTrackService) OnTrack(*webrtc.TrackRemote, *webrtc.RTPReceiver) {}
 
-func (s *RoomForwardTrackService) OnClose() {}
+func (s *RoomForwardTrackService) OnClose() {
+	if s.forwarder != nil {
+		s.targetMember.RemoveForwarder(s.forwarder)
+	}
+}
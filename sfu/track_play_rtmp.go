@@ -0,0 +1,324 @@
+package sfu
+
+import (
+	"errors"
+	"github.com/LeeZXin/z-live/av"
+	"github.com/LeeZXin/z-live/parser/h264"
+	"github.com/LeeZXin/z-live/rtmp"
+	"github.com/LeeZXin/zsf/logger"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+rtmp推流通过webrtc播放 低延迟
+注册为推流端的PacketWriter avcc格式的h264转为rtp
+rtmp音频通常是aac webrtc不支持 只转发视频
+*/
+
+const (
+	// rtpMtu rtp负载最大长度
+	rtpMtu = 1200
+
+	naluTypeStapA = 24
+	naluTypeFuA   = 28
+
+	RtcViewerType = "webrtc"
+)
+
+var (
+	ErrStreamNotFound = errors.New("stream not found")
+)
+
+// PlayRtmpTrackService webrtc播放rtmp推流 需要参数app name
+type PlayRtmpTrackService struct {
+	pub    rtmp.RegisterAction
+	conn   *webrtc.PeerConnection
+	writer *rtcPacketWriter
+
+	mu         sync.Mutex
+	registered bool
+	closed     bool
+}
+
+func NewPlayRtmpTrackService() RTPService {
+	return &PlayRtmpTrackService{
+		mu: sync.Mutex{},
+	}
+}
+
+func (s *PlayRtmpTrackService) IsMediaRecvService() bool {
+	return false
+}
+
+func (s *PlayRtmpTrackService) AuthenticateAndInit(request *http.Request) error {
+	app := request.URL.Query().Get("app")
+	name := request.URL.Query().Get("name")
+	if app == "" || name == "" {
+		return errors.New("app or name empty")
+	}
+	pub, ok := rtmp.FindPublisher(app + "/" + name)
+	if !ok {
+		return ErrStreamNotFound
+	}
+	s.pub = pub
+	return nil
+}
+
+func (s *PlayRtmpTrackService) OnNewPeerConnection(conn *webrtc.PeerConnection) {
+	s.conn = conn
+	track, err := webrtc.NewTrackLocalStaticRTP(videoCodecs["h264"][0].RTPCodecCapability, "video", "rtmp_stream")
+	if err != nil {
+		logger.Logger.Error(err)
+		conn.Close()
+		return
+	}
+	s.writer = newRtcPacketWriter(conn, track)
+	sender, err := conn.AddTrack(track)
+	if err != nil {
+		logger.Logger.Error(err)
+		conn.Close()
+		return
+	}
+	go s.readRTCP(sender)
+}
+
+// OnConnected dtls完成后才注册 否则srtp未就绪 gop缓存写入后被丢弃
+func (s *PlayRtmpTrackService) OnConnected() {
+	s.register()
+}
+
+// register 注册到推流端 先收到gop缓存 从缓存的关键帧开始播放
+func (s *PlayRtmpTrackService) register() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.registered || s.closed {
+		return
+	}
+	s.registered = s.pub.Register(s.writer)
+	// 推流已经结束
+	if !s.registered {
+		go s.conn.Close()
+	}
+}
+
+// resendKeyFrame 重新注册 从gop缓存的关键帧开始发送 不用等下一个关键帧
+func (s *PlayRtmpTrackService) resendKeyFrame() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.registered || s.closed {
+		return
+	}
+	// 已经在等待关键帧 忽略重复的pli
+	if !s.writer.waitKeyFrame.CompareAndSwap(false, true) {
+		return
+	}
+	s.pub.Deregister(s.writer)
+	s.registered = s.pub.Register(s.writer)
+	if !s.registered {
+		go s.conn.Close()
+	}
+}
+
+// readRTCP 收到pli或fir后重新发送缓存的关键帧
+func (s *PlayRtmpTrackService) readRTCP(sender *webrtc.RTPSender) {
+	for {
+		packets, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		for _, p := range packets {
+			switch p.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				s.resendKeyFrame()
+			}
+		}
+	}
+}
+
+func (s *PlayRtmpTrackService) OnDataChannel(*webrtc.DataChannel) {}
+
+func (s *PlayRtmpTrackService) OnTrack(*webrtc.TrackRemote, *webrtc.RTPReceiver) {}
+
+func (s *PlayRtmpTrackService) OnClose() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.registered {
+		s.pub.Deregister(s.writer)
+	}
+}
+
+// rtcPacketWriter rtmp.PacketWriter实现 h264视频帧拆分为rtp包
+type rtcPacketWriter struct {
+	conn  *webrtc.PeerConnection
+	track *webrtc.TrackLocalStaticRTP
+	sps   []byte
+	pps   []byte
+	// naluLen avcc长度字段字节数
+	naluLen int
+	seq     uint16
+	tsBase  uint32
+	// waitKeyFrame 等待关键帧 开始播放和收到pli时为true
+	waitKeyFrame atomic.Bool
+	closeOnce    sync.Once
+}
+
+func newRtcPacketWriter(conn *webrtc.PeerConnection, track *webrtc.TrackLocalStaticRTP) *rtcPacketWriter {
+	ret := &rtcPacketWriter{
+		conn:      conn,
+		track:     track,
+		naluLen:   4,
+		seq:       uint16(rand.Uint32()),
+		tsBase:    rand.Uint32(),
+		closeOnce: sync.Once{},
+	}
+	ret.waitKeyFrame.Store(true)
+	return ret
+}
+
+func (w *rtcPacketWriter) ViewerType() string {
+	return RtcViewerType
+}
+
+func (w *rtcPacketWriter) WritePacket(p *av.Packet) error {
+	if !p.IsVideo || len(p.Data) < 5 {
+		return nil
+	}
+	vh, ok := p.Header.(av.VideoPacketHeader)
+	if !ok || vh.CodecID() != av.VIDEO_H264 {
+		return nil
+	}
+	if vh.IsSeq() {
+		record, err := h264.ParseAVCDecoderConfigurationRecord(p.Data[5:])
+		if err != nil || len(record.SPS) == 0 || len(record.PPS) == 0 {
+			return nil
+		}
+		w.sps = record.SPS[0]
+		w.pps = record.PPS[0]
+		w.naluLen = record.NaluLen
+		return nil
+	}
+	if vh.IsKeyFrame() {
+		w.waitKeyFrame.Store(false)
+	} else if w.waitKeyFrame.Load() {
+		return nil
+	}
+	if w.sps == nil {
+		return nil
+	}
+	nalus := splitAvcc(p.Data[5:], w.naluLen)
+	if len(nalus) == 0 {
+		return nil
+	}
+	// 关键帧前用stap-a发送sps pps
+	payloads := make([][]byte, 0, len(nalus)+1)
+	if vh.IsKeyFrame() {
+		payloads = append(payloads, stapA(w.sps, w.pps))
+	}
+	for _, nalu := range nalus {
+		switch nalu[0] & 0x1f {
+		case 7, 8, 9:
+			// sps pps已单独发送 aud不需要
+			continue
+		}
+		payloads = append(payloads, fragmentNalu(nalu, rtpMtu)...)
+	}
+	pts := int64(p.Timestamp) + int64(vh.CompositionTime())
+	timestamp := w.tsBase + uint32(pts*90)
+	for i, payload := range payloads {
+		w.seq++
+		err := w.track.WriteRTP(&rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				Marker:         i == len(payloads)-1,
+				SequenceNumber: w.seq,
+				Timestamp:      timestamp,
+			},
+			Payload: payload,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close 推流结束 关闭peerConnection
+func (w *rtcPacketWriter) Close() {
+	w.closeOnce.Do(func() {
+		w.conn.Close()
+	})
+}
+
+// splitAvcc 按长度字段拆分nalu
+func splitAvcc(data []byte, naluLen int) [][]byte {
+	ret := make([][]byte, 0, 4)
+	for len(data) > naluLen {
+		size := 0
+		for i := 0; i < naluLen; i++ {
+			size = size<<8 | int(data[i])
+		}
+		data = data[naluLen:]
+		if size <= 0 || size > len(data) {
+			break
+		}
+		ret = append(ret, data[:size])
+		data = data[size:]
+	}
+	return ret
+}
+
+// stapA 多个nalu合并为一个rtp负载
+func stapA(nalus ...[]byte) []byte {
+	nri := byte(0)
+	size := 1
+	for _, nalu := range nalus {
+		if n := nalu[0] & 0x60; n > nri {
+			nri = n
+		}
+		size += 2 + len(nalu)
+	}
+	ret := make([]byte, 0, size)
+	ret = append(ret, nri|naluTypeStapA)
+	for _, nalu := range nalus {
+		ret = append(ret, byte(len(nalu)>>8), byte(len(nalu)))
+		ret = append(ret, nalu...)
+	}
+	return ret
+}
+
+// fragmentNalu 超过mtu的nalu拆分为fu-a
+func fragmentNalu(nalu []byte, mtu int) [][]byte {
+	if len(nalu) <= mtu {
+		return [][]byte{nalu}
+	}
+	indicator := nalu[0]&0xe0 | naluTypeFuA
+	naluType := nalu[0] & 0x1f
+	data := nalu[1:]
+	// fu indicator和fu header占两个字节
+	maxFragment := mtu - 2
+	ret := make([][]byte, 0, len(data)/maxFragment+1)
+	for i := 0; i < len(data); i += maxFragment {
+		end := i + maxFragment
+		if end > len(data) {
+			end = len(data)
+		}
+		header := naluType
+		if i == 0 {
+			header |= 0x80
+		}
+		if end == len(data) {
+			header |= 0x40
+		}
+		payload := make([]byte, 0, end-i+2)
+		payload = append(payload, indicator, header)
+		ret = append(ret, append(payload, data[i:end]...))
+	}
+	return ret
+}
@@ -2,20 +2,22 @@ package sfu
 
 import (
 	"fmt"
+	"github.com/LeeZXin/zsf/logger"
 	"github.com/pion/webrtc/v4"
 	"github.com/pion/webrtc/v4/pkg/media"
-	"github.com/pion/webrtc/v4/pkg/media/ivfwriter"
 	"github.com/pion/webrtc/v4/pkg/media/oggwriter"
 	"net/http"
 	"strings"
 	"time"
 )
 
-// SaveIvfOggTrackService 保存音视频数据到ogg，ivf中
+// SaveIvfOggTrackService 保存音视频数据到ogg，ivf中 h264保存为annexb
 type SaveIvfOggTrackService struct {
 	oggFile *oggwriter.OggWriter
-	ivfFile *ivfwriter.IVFWriter
-	conn    *webrtc.PeerConnection
+	// videoFile 收到视频track时按编码创建
+	videoFile  media.Writer
+	filePrefix string
+	conn       *webrtc.PeerConnection
 }
 
 func NewSaveIvfOggTrackService() RTPService {
@@ -37,11 +39,7 @@ func (s *SaveIvfOggTrackService) AuthenticateAndInit(request *http.Request) erro
 	if err == nil {
 		s.oggFile = oggFile
 	}
-	ivfFileName := fmt.Sprintf("%d.ivf", now)
-	ivfFile, err := ivfwriter.New(ivfFileName)
-	if err == nil {
-		s.ivfFile = ivfFile
-	}
+	s.filePrefix = fmt.Sprintf("%d", now)
 	return nil
 }
 
@@ -55,10 +53,14 @@ func (s *SaveIvfOggTrackService) OnTrack(track *webrtc.TrackRemote, receiver *we
 		if s.oggFile != nil {
 			saveToDisk(s.oggFile, track)
 		}
-	} else if strings.EqualFold(codec.MimeType, webrtc.MimeTypeVP8) {
-		if s.ivfFile != nil {
-			saveToDisk(s.ivfFile, track)
+	} else if track.Kind() == webrtc.RTPCodecTypeVideo {
+		videoFile, err := newVideoFileWriter(s.filePrefix, codec.MimeType)
+		if err != nil {
+			logger.Logger.Error(err)
+			return
 		}
+		s.videoFile = videoFile
+		saveToDisk(videoFile, track)
 	}
 }
 
@@ -79,7 +81,7 @@ func (s *SaveIvfOggTrackService) OnClose() {
 	if s.oggFile != nil {
 		s.oggFile.Close()
 	}
-	if s.ivfFile != nil {
-		s.ivfFile.Close()
+	if s.videoFile != nil {
+		s.videoFile.Close()
 	}
 }
@@ -3,10 +3,12 @@ package sfu
 import (
 	"fmt"
 	"github.com/LeeZXin/z-live/webm"
+	"github.com/LeeZXin/zsf/logger"
 	"github.com/pion/rtcp"
 	"github.com/pion/webrtc/v4"
 	"golang.org/x/net/context"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 )
@@ -14,6 +16,7 @@ import (
 // SaveToWebmTrackService 保存音视频数据到webm
 type SaveToWebmTrackService struct {
 	saver    *webm.Saver
+	fileName string
 	conn     *webrtc.PeerConnection
 	ctx      context.Context
 	cancelFn context.CancelFunc
@@ -38,14 +41,43 @@ func (s *SaveToWebmTrackService) OnNewPeerConnection(conn *webrtc.PeerConnection
 }
 
 func (s *SaveToWebmTrackService) AuthenticateAndInit(*http.Request) error {
-	fileName := fmt.Sprintf("%d.webm", time.Now().UnixMicro())
-	s.saver = webm.NewSaver(fileName)
+	s.fileName = fmt.Sprintf("%d.webm", time.Now().UnixMicro())
+	s.saver = webm.NewSaver(s.fileName)
 	return nil
 }
 
 func (s *SaveToWebmTrackService) OnDataChannel(*webrtc.DataChannel) {}
 
 func (s *SaveToWebmTrackService) OnTrack(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+	if track.Kind() == webrtc.RTPCodecTypeVideo {
+		s.sendPLI(track)
+		// webm不支持的视频编码单独保存 webm中只保存音频
+		if err := s.saver.SetVideoCodec(track.Codec().MimeType); err != nil {
+			videoFile, err := newVideoFileWriter(strings.TrimSuffix(s.fileName, ".webm"), track.Codec().MimeType)
+			if err != nil {
+				logger.Logger.Error(err)
+				return
+			}
+			saveToDisk(videoFile, track)
+			return
+		}
+	}
+	for {
+		rtp, _, err := track.ReadRTP()
+		if err != nil {
+			return
+		}
+		switch track.Kind() {
+		case webrtc.RTPCodecTypeAudio:
+			s.saver.PushOpus(rtp)
+		case webrtc.RTPCodecTypeVideo:
+			s.saver.PushVideo(rtp)
+		}
+	}
+}
+
+// sendPLI 定时请求关键帧
+func (s *SaveToWebmTrackService) sendPLI(track *webrtc.TrackRemote) {
 	s.rtcpOnce.Do(func() {
 		go func() {
 			ticker := time.NewTicker(time.Second)
@@ -60,18 +92,6 @@ func (s *SaveToWebmTrackService) OnTrack(track *webrtc.TrackRemote, _ *webrtc.RT
 			}
 		}()
 	})
-	for {
-		rtp, _, err := track.ReadRTP()
-		if err != nil {
-			return
-		}
-		switch track.Kind() {
-		case webrtc.RTPCodecTypeAudio:
-			s.saver.PushOpus(rtp)
-		case webrtc.RTPCodecTypeVideo:
-			s.saver.PushVP8(rtp)
-		}
-	}
 }
 
 func (s *SaveToWebmTrackService) OnClose() {
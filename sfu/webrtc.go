@@ -10,28 +10,11 @@ import (
 // newPeerConnection 初始化peerConnection
 func newPeerConnection(isRecv bool) (*webrtc.PeerConnection, error) {
 	m := &webrtc.MediaEngine{}
-	if err := m.RegisterCodec(webrtc.RTPCodecParameters{
-		RTPCodecCapability: webrtc.RTPCodecCapability{
-			MimeType:     webrtc.MimeTypeVP8,
-			ClockRate:    90000,
-			Channels:     0,
-			SDPFmtpLine:  "",
-			RTCPFeedback: nil,
-		},
-		PayloadType: 96,
-	}, webrtc.RTPCodecTypeVideo); err != nil {
+	if err := registerCodecs(m); err != nil {
 		return nil, err
 	}
-	if err := m.RegisterCodec(webrtc.RTPCodecParameters{
-		RTPCodecCapability: webrtc.RTPCodecCapability{
-			MimeType:     webrtc.MimeTypeOpus,
-			ClockRate:    48000,
-			Channels:     0,
-			SDPFmtpLine:  "",
-			RTCPFeedback: nil,
-		},
-		PayloadType: 111,
-	}, webrtc.RTPCodecTypeAudio); err != nil {
+	// 音量用于计算房间说话人
+	if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: audioLevelURI}, webrtc.RTPCodecTypeAudio); err != nil {
 		return nil, err
 	}
 	i := &interceptor.Registry{}
@@ -43,9 +26,13 @@ func newPeerConnection(isRecv bool) (*webrtc.PeerConnection, error) {
 	if err = webrtc.RegisterDefaultInterceptors(m, i); err != nil {
 		panic(err)
 	}
-	api := webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i))
+	settingEngine, err := getSettingEngine()
+	if err != nil {
+		return nil, err
+	}
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i), webrtc.WithSettingEngine(settingEngine))
 	config := webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{},
+		ICEServers: newICEServers(),
 	}
 	ret, err := api.NewPeerConnection(config)
 	if err != nil {
@@ -79,3 +66,8 @@ type RTPService interface {
 	// OnClose 连接关闭时触发
 	OnClose()
 }
+
+// connectedService 连接建立后需要通知的service 例如dtls完成后才能发送rtp
+type connectedService interface {
+	OnConnected()
+}
@@ -15,13 +15,34 @@ websocket service来做信令交换
 const (
 	CandidateType = "candidate"
 	OfferType     = "offer"
+	AnswerType    = "answer"
 )
 
 type WsMsg struct {
+	// Version 消息格式版本 为空时按1处理
+	Version int    `json:"version,omitempty"`
 	MsgType string `json:"msgType"`
 	Content string `json:"content"`
 }
 
+// checkVersion 不支持比服务端新的版本
+func (m *WsMsg) checkVersion() error {
+	if m.Version > EventVersion {
+		return ErrUnsupportedVersion
+	}
+	return nil
+}
+
+func (m *WsMsg) IsMuteType() bool {
+	return m.MsgType == MuteType
+}
+
+func (m *WsMsg) GetMute() (MuteMsg, error) {
+	var ret MuteMsg
+	err := json.Unmarshal([]byte(m.Content), &ret)
+	return ret, err
+}
+
 func (m *WsMsg) IsCandidateMsg() bool {
 	return m.MsgType == CandidateType
 }
@@ -54,9 +75,48 @@ func (m *WsMsg) GetOffer() (webrtc.SessionDescription, error) {
 	return ret, nil
 }
 
+func (m *WsMsg) IsAnswerType() bool {
+	return m.MsgType == AnswerType
+}
+
+func (m *WsMsg) GetAnswer() (webrtc.SessionDescription, error) {
+	return m.GetOffer()
+}
+
+// roomService 房间相关的service 信令连接会收到房间事件
+type roomService interface {
+	Room() *Room
+}
+
+// muteService 可以通知静音状态的service
+type muteService interface {
+	SetMuted(kind string, muted bool) error
+}
+
+// encodeWsMsg 服务端主动发送的消息 content为json字符串
+func encodeWsMsg(msgType string, content interface{}) (string, error) {
+	b, err := json.Marshal(content)
+	if err != nil {
+		return "", err
+	}
+	ret, err := json.Marshal(WsMsg{
+		Version: EventVersion,
+		MsgType: msgType,
+		Content: string(b),
+	})
+	return string(ret), err
+}
+
+// replyError 错误回复 不再忽略错误的消息
+func replyError(session *ws.Session, request string, err error) {
+	session.WriteTextMessage(NewErrorEvent(request, err).String())
+}
+
 type service struct {
 	conn       *webrtc.PeerConnection
 	rtpService RTPService
+	room       *Room
+	watcher    *RoomWatcher
 }
 
 func NewSignalService(rtpService RTPService) ws.Service {
@@ -94,9 +154,12 @@ func (s *service) OnOpen(session *ws.Session) {
 		}
 	})
 	peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		// 连接建立后websocket保持 用于推送房间事件
 		switch state {
 		case webrtc.PeerConnectionStateConnected:
-			session.Close(websocket.StatusNormalClosure, "")
+			if cs, ok := s.rtpService.(connectedService); ok {
+				cs.OnConnected()
+			}
 		case webrtc.PeerConnectionStateClosed, webrtc.PeerConnectionStateFailed:
 			session.Close(websocket.StatusNormalClosure, "")
 			if s.rtpService != nil {
@@ -118,49 +181,87 @@ func (s *service) OnOpen(session *ws.Session) {
 	})
 	s.rtpService.OnNewPeerConnection(peerConnection)
 	s.conn = peerConnection
+	if rs, ok := s.rtpService.(roomService); ok {
+		if room := rs.Room(); room != nil {
+			s.room = room
+			s.watcher = NewRoomWatcher(func(event *RoomEvent) {
+				session.WriteTextMessage(event.String())
+			})
+			room.AddWatcher(s.watcher)
+		}
+	}
 }
 func (s *service) OnTextMessage(session *ws.Session, text string) {
+	if s.conn == nil {
+		return
+	}
 	var msg WsMsg
 	err := json.Unmarshal([]byte(text), &msg)
 	if err != nil {
+		replyError(session, "", ErrInvalidMsg)
 		return
 	}
-	if msg.IsOfferType() {
-		offer, err := msg.GetOffer()
-		if err != nil {
-			return
-		}
-		if err = s.conn.SetRemoteDescription(offer); err != nil {
-			return
-		}
-		answer, err := s.conn.CreateAnswer(nil)
-		if err != nil {
-			return
-		}
-		if err = s.conn.SetLocalDescription(answer); err != nil {
-			return
-		}
-		outbound, err := json.Marshal(answer)
-		if err != nil {
-			return
-		}
-		if err = session.WriteTextMessage(string(outbound)); err != nil {
-			session.Close(websocket.StatusAbnormalClosure, "write err")
+	if err = msg.checkVersion(); err != nil {
+		replyError(session, msg.MsgType, err)
+		return
+	}
+	switch {
+	case msg.IsOfferType():
+		err = s.handleOffer(session, msg)
+	case msg.IsCandidateMsg():
+		var candidate webrtc.ICECandidateInit
+		if candidate, err = msg.GetCandidate(); err == nil {
+			err = s.conn.AddICECandidate(candidate)
 		}
-	} else if msg.IsCandidateMsg() {
-		candidate, err := msg.GetCandidate()
-		if err != nil {
-			return
+	case msg.IsMuteType():
+		ms, ok := s.rtpService.(muteService)
+		if !ok {
+			err = ErrUnknownMsgType
+			break
 		}
-		if err = s.conn.AddICECandidate(candidate); err != nil {
-			return
+		var mute MuteMsg
+		if mute, err = msg.GetMute(); err == nil {
+			err = ms.SetMuted(mute.Kind, mute.Muted)
 		}
+	default:
+		err = ErrUnknownMsgType
 	}
+	if err != nil {
+		replyError(session, msg.MsgType, err)
+	}
+}
+
+func (s *service) handleOffer(session *ws.Session, msg WsMsg) error {
+	offer, err := msg.GetOffer()
+	if err != nil {
+		return err
+	}
+	if err = s.conn.SetRemoteDescription(offer); err != nil {
+		return err
+	}
+	answer, err := s.conn.CreateAnswer(nil)
+	if err != nil {
+		return err
+	}
+	if err = s.conn.SetLocalDescription(answer); err != nil {
+		return err
+	}
+	outbound, err := json.Marshal(answer)
+	if err != nil {
+		return err
+	}
+	if err = session.WriteTextMessage(string(outbound)); err != nil {
+		session.Close(websocket.StatusAbnormalClosure, "write err")
+	}
+	return nil
 }
 
 func (*service) OnBinaryMessage(*ws.Session, []byte) {}
 
 func (s *service) OnClose(*ws.Session) {
+	if s.watcher != nil {
+		s.room.DelWatcher(s.watcher)
+	}
 	if s.conn != nil {
 		state := s.conn.ConnectionState()
 		if state != webrtc.PeerConnectionStateConnected {
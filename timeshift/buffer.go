@@ -0,0 +1,351 @@
+package timeshift
+
+import (
+	"context"
+	"errors"
+	"github.com/LeeZXin/z-live/amf"
+	"github.com/LeeZXin/z-live/av"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// audioKeyInterval 纯音频时每隔多久记录一个起播点 单位毫秒
+	audioKeyInterval = 1000
+	// offsetStep 时移延迟的取整粒度
+	offsetStep = 10 * time.Second
+)
+
+var (
+	ErrNoData = errors.New("no data in timeshift buffer")
+)
+
+type PacketWriter interface {
+	WritePacket(*av.Packet) error
+}
+
+// Status 时移缓存状态
+type Status struct {
+	Key            string `json:"key"`
+	FirstTimestamp uint32 `json:"firstTimestamp"`
+	LastTimestamp  uint32 `json:"lastTimestamp"`
+	// Duration 缓存的时长 单位毫秒
+	Duration int64 `json:"duration"`
+	Size     int64 `json:"size"`
+	Packets  int   `json:"packets"`
+	Live     bool  `json:"live"`
+}
+
+/*
+Buffer 直播的时移缓存
+按时间保留最近Duration的数据 超过时长或者MaxSize时按gop从头丢弃
+注册到推流端 用于延迟播放和导出片段
+*/
+type Buffer struct {
+	app    string
+	name   string
+	config Config
+
+	mu      sync.RWMutex
+	entries []*av.Packet
+	// baseSeq entries[0]的序号
+	baseSeq int64
+	// keySeqs 可以起播的关键帧序号 递增
+	keySeqs  []int64
+	size     int64
+	metadata *av.Packet
+	videoSeq *av.Packet
+	audioSeq *av.Packet
+	// notify 有新数据时关闭并替换
+	notify chan struct{}
+	closed bool
+}
+
+func newBuffer(app, name string, config Config) *Buffer {
+	return &Buffer{
+		app:    app,
+		name:   name,
+		config: config,
+		notify: make(chan struct{}),
+	}
+}
+
+func (b *Buffer) Key() string {
+	return b.app + "/" + b.name
+}
+
+func (b *Buffer) WritePacket(p *av.Packet) error {
+	p = p.Copy()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return io.EOF
+	}
+	if b.saveHeader(p) {
+		return nil
+	}
+	seq := b.baseSeq + int64(len(b.entries))
+	if b.isKeyPoint(p) {
+		b.keySeqs = append(b.keySeqs, seq)
+	}
+	b.entries = append(b.entries, p)
+	b.size += int64(len(p.Data))
+	b.trim(p.Timestamp)
+	close(b.notify)
+	b.notify = make(chan struct{})
+	return nil
+}
+
+// saveHeader 保存metadata和sequence header 返回是否是header
+func (b *Buffer) saveHeader(p *av.Packet) bool {
+	if p.IsMetadata {
+		if amf.ScriptDataName(p.Data) == amf.OnTextData {
+			return false
+		}
+		b.metadata = p
+		return true
+	}
+	if p.IsVideo {
+		vh, ok := p.Header.(av.VideoPacketHeader)
+		if ok && vh.IsSeq() {
+			b.videoSeq = p
+			return true
+		}
+		return false
+	}
+	ah, ok := p.Header.(av.AudioPacketHeader)
+	if ok && ah.SoundFormat() == av.SOUND_AAC && ah.AACPacketType() == av.AAC_SEQHDR {
+		b.audioSeq = p
+		return true
+	}
+	return false
+}
+
+// isKeyPoint 有视频时为关键帧 纯音频时每隔一段时间一个
+func (b *Buffer) isKeyPoint(p *av.Packet) bool {
+	if b.videoSeq != nil {
+		if !p.IsVideo {
+			return false
+		}
+		vh, ok := p.Header.(av.VideoPacketHeader)
+		return ok && vh.IsKeyFrame()
+	}
+	if !p.IsAudio {
+		return false
+	}
+	if len(b.keySeqs) == 0 {
+		return true
+	}
+	last := b.entry(b.keySeqs[len(b.keySeqs)-1])
+	return last == nil || p.Timestamp >= last.Timestamp+audioKeyInterval
+}
+
+func (b *Buffer) entry(seq int64) *av.Packet {
+	i := seq - b.baseSeq
+	if i < 0 || i >= int64(len(b.entries)) {
+		return nil
+	}
+	return b.entries[i]
+}
+
+// trim 超过时长或大小时按gop从头丢弃 至少保留一个gop
+func (b *Buffer) trim(lastTs uint32) {
+	if len(b.keySeqs) == 0 {
+		return
+	}
+	// 第一个关键帧之前的数据无法播放
+	b.dropBefore(b.keySeqs[0])
+	for len(b.keySeqs) > 1 {
+		next := b.entry(b.keySeqs[1])
+		overDuration := lastTs > next.Timestamp && time.Duration(lastTs-next.Timestamp)*time.Millisecond >= b.config.Duration
+		if !overDuration && b.size <= b.config.MaxSize {
+			return
+		}
+		b.keySeqs = b.keySeqs[1:]
+		b.dropBefore(b.keySeqs[0])
+	}
+}
+
+func (b *Buffer) dropBefore(seq int64) {
+	n := int(seq - b.baseSeq)
+	if n <= 0 {
+		return
+	}
+	for i := 0; i < n; i++ {
+		b.size -= int64(len(b.entries[i].Data))
+		b.entries[i] = nil
+	}
+	b.entries = b.entries[n:]
+	b.baseSeq = seq
+}
+
+func (b *Buffer) headers() []*av.Packet {
+	ret := make([]*av.Packet, 0, 3)
+	for _, p := range []*av.Packet{b.metadata, b.videoSeq, b.audioSeq} {
+		if p != nil {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
+// findKeySeq 不晚于ts的最后一个起播点 没有则返回第一个
+func (b *Buffer) findKeySeq(ts uint32) (int64, bool) {
+	if len(b.keySeqs) == 0 {
+		return 0, false
+	}
+	i := sort.Search(len(b.keySeqs), func(i int) bool {
+		return b.entry(b.keySeqs[i]).Timestamp > ts
+	}) - 1
+	if i < 0 {
+		i = 0
+	}
+	return b.keySeqs[i], true
+}
+
+func (b *Buffer) lastTimestamp() uint32 {
+	if len(b.entries) == 0 {
+		return 0
+	}
+	return b.entries[len(b.entries)-1].Timestamp
+}
+
+func (b *Buffer) Status() Status {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	ret := Status{
+		Key:     b.Key(),
+		Size:    b.size,
+		Packets: len(b.entries),
+		Live:    !b.closed,
+	}
+	if len(b.entries) > 0 {
+		ret.FirstTimestamp = b.entries[0].Timestamp
+		ret.LastTimestamp = b.lastTimestamp()
+		ret.Duration = int64(ret.LastTimestamp) - int64(ret.FirstTimestamp)
+	}
+	return ret
+}
+
+// NormalizeOffset 时移延迟按offsetStep取整 不超过缓存时长 避免每个不同的延迟都创建一路播放
+func (b *Buffer) NormalizeOffset(offset time.Duration) time.Duration {
+	if offset > b.config.Duration {
+		offset = b.config.Duration
+	}
+	ret := offset.Round(offsetStep)
+	if ret > b.config.Duration {
+		ret -= offsetStep
+	}
+	if ret < offsetStep {
+		ret = offsetStep
+	}
+	return ret
+}
+
+// Close 推流结束 已缓存的数据保留一段时间用于导出
+func (b *Buffer) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	b.closed = true
+	close(b.notify)
+	time.AfterFunc(b.config.Duration, func() {
+		deregisterBuffer(b)
+	})
+}
+
+// Cursor 从缓存中按顺序读取
+type Cursor struct {
+	b   *Buffer
+	seq int64
+}
+
+// NewCursor 定位到直播延迟offset的关键帧 返回header和关键帧的时间戳
+func (b *Buffer) NewCursor(offset time.Duration) (*Cursor, []*av.Packet, uint32, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	target := int64(b.lastTimestamp()) - offset.Milliseconds()
+	if target < 0 {
+		target = 0
+	}
+	seq, ok := b.findKeySeq(uint32(target))
+	if !ok {
+		return nil, nil, 0, ErrNoData
+	}
+	return &Cursor{
+		b:   b,
+		seq: seq,
+	}, b.headers(), b.entry(seq).Timestamp, nil
+}
+
+// Next 读取下一个packet 没有数据时阻塞 推流结束且读完返回io.EOF
+func (c *Cursor) Next(ctx context.Context) (*av.Packet, error) {
+	b := c.b
+	for {
+		b.mu.RLock()
+		// 落后于缓存范围 跳到最早的关键帧
+		if c.seq < b.baseSeq && len(b.keySeqs) > 0 {
+			c.seq = b.keySeqs[0]
+		}
+		if p := b.entry(c.seq); p != nil {
+			c.seq++
+			b.mu.RUnlock()
+			return p, nil
+		}
+		closed := b.closed
+		notify := b.notify
+		b.mu.RUnlock()
+		if closed {
+			return nil, io.EOF
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-notify:
+		}
+	}
+}
+
+// Play 从直播延迟offset处按实际时间写入writer 阻塞直到writer出错、ctx结束或者推流结束
+func (b *Buffer) Play(ctx context.Context, offset time.Duration, writer PacketWriter) error {
+	cursor, headers, startTs, err := b.NewCursor(offset)
+	if err != nil {
+		return err
+	}
+	for _, h := range headers {
+		header := *h
+		header.Timestamp = startTs
+		if err = writer.WritePacket(&header); err != nil {
+			return err
+		}
+	}
+	baseTime := time.Now()
+	for {
+		p, err := cursor.Next(ctx)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if p.Timestamp > startTs {
+			wait := time.Until(baseTime.Add(time.Duration(p.Timestamp-startTs) * time.Millisecond))
+			if wait > 0 {
+				timer := time.NewTimer(wait)
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return ctx.Err()
+				case <-timer.C:
+				}
+			}
+		}
+		if err = writer.WritePacket(p); err != nil {
+			return err
+		}
+	}
+}
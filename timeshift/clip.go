@@ -0,0 +1,169 @@
+package timeshift
+
+import (
+	"errors"
+	"fmt"
+	"github.com/LeeZXin/z-live/av"
+	"github.com/LeeZXin/z-live/flv"
+	"github.com/LeeZXin/z-live/fmp4"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	FlvFormat = "flv"
+	Mp4Format = "mp4"
+)
+
+var (
+	ErrInvalidRange = errors.New("invalid clip range")
+)
+
+// ClipInfo 导出的片段
+type ClipInfo struct {
+	Key    string `json:"key"`
+	Format string `json:"format"`
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	// StartTimestamp EndTimestamp 片段在直播中的时间戳 按关键帧对齐
+	StartTimestamp uint32 `json:"startTimestamp"`
+	EndTimestamp   uint32 `json:"endTimestamp"`
+	// Duration 单位毫秒
+	Duration int64 `json:"duration"`
+}
+
+// clipPackets 从不晚于start的关键帧开始 到不早于end的关键帧之前结束
+func (b *Buffer) clipPackets(start, end uint32) ([]*av.Packet, []*av.Packet, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	seq, ok := b.findKeySeq(start)
+	if !ok {
+		return nil, nil, ErrNoData
+	}
+	// 与缓存范围没有交集
+	if end <= b.entries[0].Timestamp || start > b.lastTimestamp() {
+		return nil, nil, ErrInvalidRange
+	}
+	var ret []*av.Packet
+	for ; ; seq++ {
+		p := b.entry(seq)
+		if p == nil {
+			break
+		}
+		if len(ret) > 0 && p.Timestamp >= end && b.isKeySeq(seq) {
+			break
+		}
+		ret = append(ret, p)
+	}
+	return ret, b.headers(), nil
+}
+
+func (b *Buffer) isKeySeq(seq int64) bool {
+	i := sort.Search(len(b.keySeqs), func(i int) bool {
+		return b.keySeqs[i] >= seq
+	})
+	return i < len(b.keySeqs) && b.keySeqs[i] == seq
+}
+
+// ExportClip 导出start到end之间的片段 单位毫秒 为直播中的时间戳 在关键帧处切割
+func (b *Buffer) ExportClip(start, end uint32, format string) (ClipInfo, error) {
+	if end <= start {
+		return ClipInfo{}, ErrInvalidRange
+	}
+	format = strings.ToLower(format)
+	if format != Mp4Format {
+		format = FlvFormat
+	}
+	packets, headers, err := b.clipPackets(start, end)
+	if err != nil {
+		return ClipInfo{}, err
+	}
+	first := packets[0].Timestamp
+	last := packets[len(packets)-1].Timestamp
+	path := filepath.Join(ClipDir(), b.app, b.name, fmt.Sprintf("%s_%d_%d.%s", b.name, first, last, format))
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return ClipInfo{}, err
+	}
+	size, err := writeClip(path, format, headers, packets, first)
+	if err != nil {
+		os.Remove(path)
+		return ClipInfo{}, err
+	}
+	return ClipInfo{
+		Key:            b.Key(),
+		Format:         format,
+		Path:           path,
+		Size:           size,
+		StartTimestamp: first,
+		EndTimestamp:   last,
+		Duration:       int64(last - first),
+	}, nil
+}
+
+// clipMuxer 片段的封装
+type clipMuxer interface {
+	WritePacket(*av.Packet) error
+	Close() error
+	Size() int64
+}
+
+type flvClipMuxer struct {
+	*flv.Muxer
+}
+
+func (*flvClipMuxer) Close() error {
+	return nil
+}
+
+// writeClip 时间戳从0开始 返回文件大小
+func writeClip(path, format string, headers, packets []*av.Packet, base uint32) (int64, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, err
+	}
+	var muxer clipMuxer
+	if format == Mp4Format {
+		muxer = fmp4.NewMuxer(file)
+	} else {
+		m := flv.NewFileMuxer(file)
+		if err = m.WriteHeader(); err != nil {
+			file.Close()
+			return 0, err
+		}
+		muxer = &flvClipMuxer{Muxer: m}
+	}
+	err = func() error {
+		for _, h := range headers {
+			header := *h
+			header.Timestamp = 0
+			if err := muxer.WritePacket(&header); err != nil {
+				return err
+			}
+		}
+		for _, p := range packets {
+			pkt := *p
+			if pkt.Timestamp > base {
+				pkt.Timestamp -= base
+			} else {
+				pkt.Timestamp = 0
+			}
+			if err := muxer.WritePacket(&pkt); err != nil {
+				return err
+			}
+		}
+		return muxer.Close()
+	}()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	// flv重写onMetaData 使文件可以拖动
+	if m, ok := muxer.(*flvClipMuxer); ok {
+		return m.Finalize(path)
+	}
+	return muxer.Size(), nil
+}
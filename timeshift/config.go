@@ -0,0 +1,85 @@
+package timeshift
+
+import (
+	"github.com/LeeZXin/zsf/property/static"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultDuration = 10 * time.Minute
+	defaultMaxSize  = 256 * 1024 * 1024
+	defaultClipDir  = "./record/clip"
+
+	// shiftSep 时移流名称 例如demo@60为demo延迟60秒
+	shiftSep = "@"
+)
+
+// Config 时移配置 可按app配置timeshift.apps.{app}.xxx 没有则使用timeshift.xxx
+type Config struct {
+	Enable bool
+	// Duration 保留最近多久的数据
+	Duration time.Duration
+	// MaxSize 内存中最多保留的字节数
+	MaxSize int64
+}
+
+// GetConfig 获取app的时移配置
+func GetConfig(app string) Config {
+	ret := Config{
+		Enable:   getString(app, "enable") == "true",
+		Duration: time.Duration(getInt(app, "duration")) * time.Second,
+		MaxSize:  int64(getInt(app, "maxSize")) * 1024 * 1024,
+	}
+	if ret.Duration <= 0 {
+		ret.Duration = defaultDuration
+	}
+	if ret.MaxSize <= 0 {
+		ret.MaxSize = defaultMaxSize
+	}
+	return ret
+}
+
+// ClipDir 导出片段的目录
+func ClipDir() string {
+	ret := static.GetString("timeshift.clipDir")
+	if ret == "" {
+		ret = defaultClipDir
+	}
+	return ret
+}
+
+func getString(app, field string) string {
+	ret := static.GetString("timeshift.apps." + app + "." + field)
+	if ret == "" {
+		ret = static.GetString("timeshift." + field)
+	}
+	return ret
+}
+
+func getInt(app, field string) int {
+	ret := static.GetInt("timeshift.apps." + app + "." + field)
+	if ret == 0 {
+		ret = static.GetInt("timeshift." + field)
+	}
+	return ret
+}
+
+// ShiftName 时移流名称
+func ShiftName(name string, offset int) string {
+	return name + shiftSep + strconv.Itoa(offset)
+}
+
+// ParseShiftName 解析时移流名称 返回原始流名称和延迟
+func ParseShiftName(name string) (string, time.Duration, bool) {
+	i := strings.LastIndex(name, shiftSep)
+	if i <= 0 {
+		return "", 0, false
+	}
+	offset, err := strconv.Atoi(name[i+1:])
+	if err != nil || offset <= 0 {
+		return "", 0, false
+	}
+	return name[:i], time.Duration(offset) * time.Second, true
+}
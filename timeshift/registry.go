@@ -0,0 +1,56 @@
+package timeshift
+
+import (
+	"sync"
+)
+
+/*
+直播的时移缓存 推流结束后保留Duration用于导出
+*/
+var (
+	bmu       = sync.RWMutex{}
+	bufferMap = make(map[string]*Buffer, 8)
+)
+
+// Start 开始缓存 需要将返回的buffer注册到推流端 同名的旧缓存被替换
+func Start(app, name string, config Config) *Buffer {
+	ret := newBuffer(app, name, config)
+	bmu.Lock()
+	old := bufferMap[ret.Key()]
+	bufferMap[ret.Key()] = ret
+	bmu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return ret
+}
+
+func Find(key string) (*Buffer, bool) {
+	bmu.RLock()
+	defer bmu.RUnlock()
+	ret, ok := bufferMap[key]
+	return ret, ok
+}
+
+func List() []Status {
+	bmu.RLock()
+	buffers := make([]*Buffer, 0, len(bufferMap))
+	for _, b := range bufferMap {
+		buffers = append(buffers, b)
+	}
+	bmu.RUnlock()
+	ret := make([]Status, 0, len(buffers))
+	for _, b := range buffers {
+		ret = append(ret, b.Status())
+	}
+	return ret
+}
+
+// deregisterBuffer 只移除自己
+func deregisterBuffer(b *Buffer) {
+	bmu.Lock()
+	defer bmu.Unlock()
+	if bufferMap[b.Key()] == b {
+		delete(bufferMap, b.Key())
+	}
+}
@@ -0,0 +1,65 @@
+package vod
+
+import (
+	"github.com/LeeZXin/zsf/property/static"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	defaultApp = "vod"
+	defaultDir = "./record"
+
+	flvSuffix = ".flv"
+)
+
+// App 点播的app 例如rtmp://host/vod/live/demo/demo_xxx_0 或http://host/vod/live/demo/demo_xxx_0.flv
+func App() string {
+	ret := static.GetString("vod.app")
+	if ret == "" {
+		ret = defaultApp
+	}
+	return ret
+}
+
+// Dir 点播文件目录 默认和录制目录相同
+func Dir() string {
+	ret := static.GetString("vod.dir")
+	if ret == "" {
+		ret = defaultDir
+	}
+	return ret
+}
+
+// ParseName rtmp的app和流名称转为点播文件名 不是点播app返回false
+// app可能带了目录 例如rtmp://host/vod/live/demo 流名称demo_xxx_0
+func ParseName(app, name string) (string, bool) {
+	vodApp := App()
+	if app == vodApp {
+		return name, true
+	}
+	if strings.HasPrefix(app, vodApp+"/") {
+		return strings.TrimPrefix(app, vodApp+"/") + "/" + name, true
+	}
+	return "", false
+}
+
+// FilePath 文件名转为点播目录下的文件路径 不能跳出点播目录
+// 兼容flash的flv:前缀 可以不带.flv后缀
+func FilePath(name string) (string, bool) {
+	name = strings.TrimPrefix(name, "flv:")
+	// 去掉query参数
+	name, _, _ = strings.Cut(name, "?")
+	if name == "" {
+		return "", false
+	}
+	if filepath.Ext(name) != flvSuffix {
+		name += flvSuffix
+	}
+	dir := filepath.Clean(Dir())
+	ret := filepath.Join(dir, filepath.Clean("/"+name))
+	if !strings.HasPrefix(ret, dir+string(filepath.Separator)) {
+		return "", false
+	}
+	return ret, true
+}
@@ -0,0 +1,220 @@
+package vod
+
+import (
+	"context"
+	"errors"
+	"github.com/LeeZXin/z-live/av"
+	"github.com/LeeZXin/z-live/flv"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// lead 比实际时间提前发送 让播放器有缓冲
+	lead = time.Second
+)
+
+var (
+	ErrClosed = errors.New("player closed")
+)
+
+type PacketWriter interface {
+	WritePacket(*av.Packet) error
+}
+
+// ctrlMsg 拖动或者暂停/恢复
+type ctrlMsg struct {
+	seek   bool
+	seekMs uint32
+	pause  bool
+}
+
+/*
+Player 按实际时间读取flv文件写入writer
+支持开始时间、播放时长、拖动和暂停
+*/
+type Player struct {
+	reader *flv.Reader
+	writer PacketWriter
+	start  uint32
+	// end 结束的时间戳 0播放到文件结束
+	end    uint32
+	ctrlCh chan ctrlMsg
+
+	// baseTs baseTime 时间戳baseTs对应的实际时间
+	baseTs   uint32
+	baseTime time.Time
+	paused   bool
+	pausedAt time.Time
+
+	ctx       context.Context
+	cancelFn  context.CancelFunc
+	closeOnce sync.Once
+}
+
+// NewPlayer start开始时间 duration播放时长 单位毫秒 duration<=0播放到文件结束
+func NewPlayer(path string, writer PacketWriter, start, duration int64) (*Player, error) {
+	reader, err := flv.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if start < 0 {
+		start = 0
+	}
+	ctx, cancelFn := context.WithCancel(context.Background())
+	ret := &Player{
+		reader:    reader,
+		writer:    writer,
+		start:     uint32(start),
+		ctrlCh:    make(chan ctrlMsg, 8),
+		ctx:       ctx,
+		cancelFn:  cancelFn,
+		closeOnce: sync.Once{},
+	}
+	if duration > 0 {
+		ret.end = uint32(start + duration)
+	}
+	return ret, nil
+}
+
+// Duration 文件时长 单位毫秒
+func (p *Player) Duration() int64 {
+	return p.reader.Duration()
+}
+
+// Run 阻塞播放 文件结束或者Close后返回
+func (p *Player) Run() error {
+	defer func() {
+		p.Close()
+		p.reader.Close()
+	}()
+	if err := p.seek(p.start); err != nil {
+		return err
+	}
+	var pending *av.Packet
+	for {
+		if p.ctx.Err() != nil {
+			return nil
+		}
+		if p.paused {
+			select {
+			case <-p.ctx.Done():
+				return nil
+			case msg := <-p.ctrlCh:
+				if err := p.handleCtrl(msg); err != nil {
+					return err
+				}
+				if msg.seek {
+					pending = nil
+				}
+			}
+			continue
+		}
+		if pending == nil {
+			pkt, err := p.reader.ReadPacket()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			// 开头的metadata已经发送过
+			if pkt.IsMetadata {
+				continue
+			}
+			if p.end > 0 && pkt.Timestamp > p.end {
+				return nil
+			}
+			pending = pkt
+		}
+		if pending.Timestamp > p.baseTs {
+			due := p.baseTime.Add(time.Duration(pending.Timestamp-p.baseTs)*time.Millisecond - lead)
+			if wait := time.Until(due); wait > 0 {
+				timer := time.NewTimer(wait)
+				select {
+				case <-p.ctx.Done():
+					timer.Stop()
+					return nil
+				case msg := <-p.ctrlCh:
+					timer.Stop()
+					if err := p.handleCtrl(msg); err != nil {
+						return err
+					}
+					if msg.seek {
+						pending = nil
+					}
+					continue
+				case <-timer.C:
+				}
+			}
+		}
+		if err := p.writer.WritePacket(pending); err != nil {
+			return err
+		}
+		pending = nil
+	}
+}
+
+func (p *Player) handleCtrl(msg ctrlMsg) error {
+	if msg.seek {
+		return p.seek(msg.seekMs)
+	}
+	if msg.pause {
+		if !p.paused {
+			p.paused = true
+			p.pausedAt = time.Now()
+		}
+	} else if p.paused {
+		p.paused = false
+		// 暂停的时间不算
+		p.baseTime = p.baseTime.Add(time.Since(p.pausedAt))
+	}
+	return nil
+}
+
+// seek 定位到关键帧 重新发送metadata和sequence header
+func (p *Player) seek(ms uint32) error {
+	ts, err := p.reader.Seek(ms)
+	if err != nil {
+		return err
+	}
+	for _, h := range p.reader.Headers() {
+		pkt := h.Copy()
+		pkt.Timestamp = ts
+		if err = p.writer.WritePacket(pkt); err != nil {
+			return err
+		}
+	}
+	p.baseTs = ts
+	p.baseTime = time.Now()
+	if p.paused {
+		p.pausedAt = p.baseTime
+	}
+	return nil
+}
+
+// Seek 拖动到ms 单位毫秒
+func (p *Player) Seek(ms uint32) error {
+	return p.sendCtrl(ctrlMsg{seek: true, seekMs: ms})
+}
+
+// Pause 暂停或恢复播放
+func (p *Player) Pause(pause bool) error {
+	return p.sendCtrl(ctrlMsg{pause: pause})
+}
+
+func (p *Player) sendCtrl(msg ctrlMsg) error {
+	select {
+	case <-p.ctx.Done():
+		return ErrClosed
+	case p.ctrlCh <- msg:
+		return nil
+	}
+}
+
+func (p *Player) Close() {
+	p.closeOnce.Do(func() {
+		p.cancelFn()
+	})
+}
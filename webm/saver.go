@@ -1,20 +1,38 @@
 package webm
 
 import (
+	"errors"
 	"github.com/at-wat/ebml-go/webm"
 	"github.com/pion/rtp"
 	"github.com/pion/rtp/codecs"
 	"github.com/pion/webrtc/v4/pkg/media/samplebuilder"
 	"os"
+	"strings"
+	"sync"
 	"time"
 )
 
-// Saver 保存webm音视频数据
+const (
+	mimeTypeVP8 = "video/VP8"
+	mimeTypeVP9 = "video/VP9"
+)
+
+var (
+	ErrUnsupportedCodec = errors.New("webm unsupported codec")
+)
+
+// Saver 保存webm音视频数据 视频支持vp8、vp9 不支持的视频编码只保存音频
 type Saver struct {
 	audioWriter, videoWriter       webm.BlockWriteCloser
 	audioBuilder, videoBuilder     *samplebuilder.SampleBuilder
 	audioTimestamp, videoTimestamp time.Duration
 	fileName                       string
+	videoCodecID                   string
+	// audioOnly 视频编码不支持时只保存音频
+	audioOnly bool
+	// videoOnly 只保存视频 没有音频轨道
+	videoOnly bool
+	mu        sync.Mutex
 }
 
 func NewSaver(fileName string) *Saver {
@@ -22,10 +40,41 @@ func NewSaver(fileName string) *Saver {
 		fileName:     fileName,
 		audioBuilder: samplebuilder.New(50, &codecs.OpusPacket{}, 48000),
 		videoBuilder: samplebuilder.New(50, &codecs.VP8Packet{}, 90000),
+		videoCodecID: "V_VP8",
 	}
 }
 
+// NewVideoSaver 只保存视频
+func NewVideoSaver(fileName, mimeType string) (*Saver, error) {
+	ret := NewSaver(fileName)
+	if err := ret.SetVideoCodec(mimeType); err != nil {
+		return nil, err
+	}
+	ret.videoOnly = true
+	return ret, nil
+}
+
+// SetVideoCodec 按协商的视频编码保存 不支持时返回ErrUnsupportedCodec 之后只保存音频
+func (s *Saver) SetVideoCodec(mimeType string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case strings.EqualFold(mimeType, mimeTypeVP8):
+		s.videoBuilder = samplebuilder.New(50, &codecs.VP8Packet{}, 90000)
+		s.videoCodecID = "V_VP8"
+	case strings.EqualFold(mimeType, mimeTypeVP9):
+		s.videoBuilder = samplebuilder.New(50, &codecs.VP9Packet{}, 90000)
+		s.videoCodecID = "V_VP9"
+	default:
+		s.audioOnly = true
+		return ErrUnsupportedCodec
+	}
+	return nil
+}
+
 func (s *Saver) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	if s.audioWriter != nil {
 		s.audioWriter.Close()
 	}
@@ -35,12 +84,19 @@ func (s *Saver) Close() {
 }
 
 func (s *Saver) PushOpus(rtpPacket *rtp.Packet) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.audioBuilder.Push(rtpPacket)
 	for {
 		sample := s.audioBuilder.Pop()
 		if sample == nil {
 			return nil
 		}
+		if s.audioWriter == nil && s.audioOnly {
+			if err := s.initWriter(0, 0); err != nil {
+				return err
+			}
+		}
 		if s.audioWriter != nil {
 			s.audioTimestamp += sample.Duration
 			if _, err := s.audioWriter.Write(true, int64(s.audioTimestamp/time.Millisecond), sample.Data); err != nil {
@@ -50,22 +106,31 @@ func (s *Saver) PushOpus(rtpPacket *rtp.Packet) error {
 	}
 }
 
-func (s *Saver) PushVP8(rtpPacket *rtp.Packet) error {
+// PushVideo 收到第一个关键帧时创建文件
+func (s *Saver) PushVideo(rtpPacket *rtp.Packet) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.audioOnly {
+		return nil
+	}
 	s.videoBuilder.Push(rtpPacket)
 	for {
 		sample := s.videoBuilder.Pop()
-		if sample == nil {
+		if sample == nil || len(sample.Data) == 0 {
 			return nil
 		}
-		videoKeyframe := sample.Data[0]&0x1 == 0
-		if videoKeyframe {
-			raw := uint(sample.Data[6]) | uint(sample.Data[7])<<8 | uint(sample.Data[8])<<16 | uint(sample.Data[9])<<24
-			width := int(raw & 0x3FFF)
-			height := int((raw >> 16) & 0x3FFF)
-			if s.videoWriter == nil {
-				if err := s.initWriter(width, height); err != nil {
-					return err
-				}
+		var (
+			videoKeyframe bool
+			width, height int
+		)
+		if s.videoCodecID == "V_VP9" {
+			videoKeyframe, width, height = parseVP9KeyFrame(sample.Data)
+		} else {
+			videoKeyframe, width, height = parseVP8KeyFrame(sample.Data)
+		}
+		if videoKeyframe && s.videoWriter == nil {
+			if err := s.initWriter(width, height); err != nil {
+				return err
 			}
 		}
 		if s.videoWriter != nil {
@@ -77,42 +142,123 @@ func (s *Saver) PushVP8(rtpPacket *rtp.Packet) error {
 	}
 }
 
-// initWriter 初始化writer
+func parseVP8KeyFrame(data []byte) (bool, int, int) {
+	if len(data) < 10 || data[0]&0x1 != 0 {
+		return false, 0, 0
+	}
+	raw := uint(data[6]) | uint(data[7])<<8 | uint(data[8])<<16 | uint(data[9])<<24
+	return true, int(raw & 0x3FFF), int((raw >> 16) & 0x3FFF)
+}
+
+// parseVP9KeyFrame 解析vp9 uncompressed header
+func parseVP9KeyFrame(data []byte) (bool, int, int) {
+	r := &bitReader{data: data}
+	if r.read(2) != 2 {
+		return false, 0, 0
+	}
+	profile := r.read(1) | r.read(1)<<1
+	if profile == 3 {
+		r.read(1)
+	}
+	// show_existing_frame
+	if r.read(1) == 1 {
+		return false, 0, 0
+	}
+	// frame_type 0为关键帧
+	if r.read(1) != 0 {
+		return false, 0, 0
+	}
+	// show_frame error_resilient_mode
+	r.read(2)
+	if r.read(24) != 0x498342 {
+		return false, 0, 0
+	}
+	if profile >= 2 {
+		r.read(1)
+	}
+	// color_space 7为rgb
+	if r.read(3) != 7 {
+		r.read(1)
+		if profile == 1 || profile == 3 {
+			r.read(3)
+		}
+	} else if profile == 1 || profile == 3 {
+		r.read(1)
+	}
+	width := int(r.read(16)) + 1
+	height := int(r.read(16)) + 1
+	if r.overflow {
+		return true, 0, 0
+	}
+	return true, width, height
+}
+
+type bitReader struct {
+	data     []byte
+	pos      int
+	overflow bool
+}
+
+func (r *bitReader) read(n int) uint32 {
+	var ret uint32
+	for i := 0; i < n; i++ {
+		if r.pos >= len(r.data)*8 {
+			r.overflow = true
+			return 0
+		}
+		bit := (r.data[r.pos/8] >> (7 - r.pos%8)) & 1
+		ret = ret<<1 | uint32(bit)
+		r.pos++
+	}
+	return ret
+}
+
+// initWriter 初始化writer 只保存音频时没有视频轨道 只保存视频时没有音频轨道
 func (s *Saver) initWriter(width, height int) error {
 	w, err := os.OpenFile(s.fileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
 	if err != nil {
 		return err
 	}
-	ws, err := webm.NewSimpleBlockWriter(w,
-		[]webm.TrackEntry{
-			{
-				Name:            "Audio",
-				TrackNumber:     1,
-				TrackUID:        12345,
-				CodecID:         "A_OPUS",
-				TrackType:       2,
-				DefaultDuration: 20000000,
-				Audio: &webm.Audio{
-					SamplingFrequency: 48000.0,
-					Channels:          2,
-				},
-			}, {
-				Name:            "Video",
-				TrackNumber:     2,
-				TrackUID:        67890,
-				CodecID:         "V_VP8",
-				TrackType:       1,
-				DefaultDuration: 33333333,
-				Video: &webm.Video{
-					PixelWidth:  uint64(width),
-					PixelHeight: uint64(height),
-				},
+	tracks := make([]webm.TrackEntry, 0, 2)
+	if !s.videoOnly {
+		tracks = append(tracks, webm.TrackEntry{
+			Name:            "Audio",
+			TrackNumber:     1,
+			TrackUID:        12345,
+			CodecID:         "A_OPUS",
+			TrackType:       2,
+			DefaultDuration: 20000000,
+			Audio: &webm.Audio{
+				SamplingFrequency: 48000.0,
+				Channels:          2,
 			},
 		})
+	}
+	if !s.audioOnly {
+		tracks = append(tracks, webm.TrackEntry{
+			Name:            "Video",
+			TrackNumber:     2,
+			TrackUID:        67890,
+			CodecID:         s.videoCodecID,
+			TrackType:       1,
+			DefaultDuration: 33333333,
+			Video: &webm.Video{
+				PixelWidth:  uint64(width),
+				PixelHeight: uint64(height),
+			},
+		})
+	}
+	ws, err := webm.NewSimpleBlockWriter(w, tracks)
 	if err != nil {
 		return err
 	}
+	if s.videoOnly {
+		s.videoWriter = ws[0]
+		return nil
+	}
 	s.audioWriter = ws[0]
-	s.videoWriter = ws[1]
+	if !s.audioOnly {
+		s.videoWriter = ws[1]
+	}
 	return nil
 }